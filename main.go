@@ -1,26 +1,57 @@
 package main
 
 import (
+	"bufio"
+	"cmp"
+	"compress/gzip"
+	"embed"
+	"encoding/binary"
 	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/fs"
 	"math"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode/utf8"
 	"unsafe"
+	"weak"
 
 	"github.com/steelseries/golisp"
 	"github.com/xyproto/vt"
 )
 
+// bundledLisp holds the games shipped with runmacs, so the binary can run
+// them without the sources on disk.
+//
+//go:embed tetris.el snake.el pong.el life.el dunnet.el gamegrid.el
+var bundledLisp embed.FS
+
+// rgbTxt is Emacs' etc/rgb.txt, the table behind color names such as
+// "yellow" or "dark slate gray".
+//
+//go:embed rgb.txt
+var rgbTxt string
+
+// bundledPrefix marks paths that refer to bundledLisp rather than the disk.
+const bundledPrefix = "bundled:"
+
+// bundledGames lists the entries offered by the game picker.
+var bundledGames = []string{"tetris", "snake", "pong", "life", "dunnet"}
+
 type elVector struct {
 	items []*golisp.Data
 }
@@ -28,6 +59,8 @@ type elVector struct {
 type runtimeState struct {
 	gameName         string
 	mainFilePath     string
+	dataDir          string
+	execDir          string
 	loadPaths        []string
 	loadingFeatures  map[string]bool
 	env              *golisp.SymbolTableFrame
@@ -36,6 +69,8 @@ type runtimeState struct {
 	gridHeight       int
 	gridDefault      *golisp.Data
 	gridDisplay      *golisp.Data
+	gridGlyphs       []gridGlyph
+	faces            map[string]*elFace
 	displayMode      *golisp.Data
 	providedFeatures map[string]bool
 	symbolProps      map[string]map[string]*golisp.Data
@@ -46,7 +81,8 @@ type runtimeState struct {
 	selectedWindowID int
 	nextWindowID     int
 	menus            map[string]*golisp.Data
-	scores           map[string][]int64
+	scoreBuffer      *elBuffer
+	gridBuffer       *elBuffer
 	warned           map[string]bool
 	funcByName       map[string]*golisp.Data
 	requireShim      bool
@@ -56,6 +92,36 @@ type runtimeState struct {
 	matchBuffer      *elBuffer
 	timerSeq         int
 	errorParents     map[string]string
+	emacsProbed      bool
+	batch            bool // --batch or --repl: print to stdio, not the echo area
+	killed           bool
+	exitStatus       int
+	evalRequests     chan evalRequest
+	currentGroup     string
+	// localsOwner is the buffer whose values perBufferVars hold.
+	localsOwner   *elBuffer
+	pendingUndo   *golisp.Data
+	undoing       bool
+	selfInsertRun int
+	// thisCommand and lastCommand say what the current and the previous
+	// command did, so kills can add up and yank-pop can follow a yank.
+	thisCommand string
+	lastCommand string
+	// historyBuffer is the text game's buffer, whose input-ring is saved.
+	historyBuffer *elBuffer
+	historyPos    int
+	historyDraft  string
+	// loop is the running terminal session, nil in batch mode or before
+	// the game loop starts.
+	loop *gameLoop
+	// minibuffers are the questions being asked, innermost last.
+	minibuffers []*minibuffer
+	stdin       *bufio.Reader
+	// prefixMap is the keymap of the prefix keys typed so far, as C-c,
+	// while the rest of the sequence is awaited; prefixKeys are their
+	// names for the echo area.
+	prefixMap  *elKeymap
+	prefixKeys []string
 }
 
 type elTimer struct {
@@ -63,6 +129,9 @@ type elTimer struct {
 	callback *golisp.Data
 	active   bool
 	nextFire time.Time
+	// running is set while the callback runs, which can take frames when
+	// it reads from the minibuffer.
+	running bool
 }
 
 type elBuffer struct {
@@ -72,12 +141,25 @@ type elBuffer struct {
 	hooks    map[string][]*golisp.Data
 	text     []rune
 	point    int
+	props    []propInterval
+	overlays []*elOverlay
+	markers  []weak.Pointer[elMarker]
+	mark     *elMarker
+	input    *elMarker
+	// narrowStart and narrowEnd are nil unless the buffer is narrowed.
+	narrowStart *elMarker
+	narrowEnd   *elMarker
+	// locals keeps the buffer's values of perBufferVars while another
+	// buffer is current.
+	locals map[string]*golisp.Data
 }
 
 type elWindow struct {
 	id     int
 	object *golisp.Data
 	buffer *elBuffer
+	// start is where the first line drawn begins, kept between frames.
+	start int
 }
 
 type elWindowConfiguration struct {
@@ -99,6 +181,79 @@ type elSignal struct {
 	data      *golisp.Data
 }
 
+// raisedSignals are the signals and throws on their way out, by the id
+// each one's text ends with. golisp flattens errors to strings as they
+// leave a lisp function, so handlers find them again by that id. The
+// handler that stops one removes it; signals that are still propagating,
+// such as one whose unwind-protect cleanup is running, stay.
+var (
+	raisedSignals = make(map[int]error)
+	lastSignalID  int
+)
+
+// raisedSignal is a signal or throw as raise returns it, with its id.
+type raisedSignal struct {
+	id  int
+	err error
+}
+
+func (r raisedSignal) Error() string {
+	return fmt.Sprintf("%s #%d", r.err, r.id)
+}
+
+func (r raisedSignal) Unwrap() error {
+	return r.err
+}
+
+var raisedIDPattern = regexp.MustCompile(` #([0-9]+)\b`)
+
+func raise(err error) error {
+	lastSignalID++
+	raisedSignals[lastSignalID] = err
+	return raisedSignal{lastSignalID, err}
+}
+
+// raisedID returns the id of the signal or throw err carries, if any.
+func raisedID(err error) (int, bool) {
+	var r raisedSignal
+	if errors.As(err, &r) {
+		return r.id, true
+	}
+	// The innermost signal's id comes last in a flattened message.
+	m := raisedIDPattern.FindAllStringSubmatch(err.Error(), -1)
+	for i := len(m) - 1; i >= 0; i-- {
+		id, _ := strconv.Atoi(m[i][1])
+		if _, ok := raisedSignals[id]; ok {
+			return id, true
+		}
+	}
+	return 0, false
+}
+
+// signalOf returns the signal or throw behind err, or err itself.
+func signalOf(err error) error {
+	var sig elSignal
+	var thrown throwSignal
+	switch {
+	case errors.As(err, &sig):
+		return sig
+	case errors.As(err, &thrown):
+		return thrown
+	}
+	if id, ok := raisedID(err); ok {
+		return raisedSignals[id]
+	}
+	return err
+}
+
+// stopSignal forgets the signal or throw err carries, once a handler
+// has stopped it.
+func stopSignal(err error) {
+	if id, ok := raisedID(err); ok {
+		delete(raisedSignals, id)
+	}
+}
+
 func (s elSignal) Error() string {
 	if s.condition == "" {
 		return "signal"
@@ -118,34 +273,216 @@ type elKeymap struct {
 	fullMap  *golisp.Data
 }
 
+type cliOptions struct {
+	file      string
+	loadPaths []string
+	dataDir   string
+	entry     string
+	extraArgs []string
+	batch     bool
+	repl      bool
+	noInit    bool
+	socket    string
+	actions   []batchAction
+}
+
+// batchAction is one -l, -f or --eval argument. They run in command-line
+// order, like in Emacs.
+type batchAction struct {
+	kind  string
+	value string
+}
+
+// batchActionFlag appends actions of one kind to a shared, ordered list.
+type batchActionFlag struct {
+	kind    string
+	actions *[]batchAction
+}
+
+func (f batchActionFlag) String() string {
+	return ""
+}
+
+func (f batchActionFlag) Set(v string) error {
+	*f.actions = append(*f.actions, batchAction{kind: f.kind, value: v})
+	return nil
+}
+
+// killEmacs is returned by kill-emacs to unwind to the top level. Handlers
+// check runtimeState.killed, since golisp wraps errors crossing functions.
+type killEmacs struct {
+	status int
+}
+
+func (k killEmacs) Error() string {
+	return "kill-emacs " + strconv.Itoa(k.status)
+}
+
+// stringListFlag collects every occurrence of a repeatable flag.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, string(os.PathListSeparator))
+}
+
+func (s *stringListFlag) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func newFlagSet(opts *cliOptions) *flag.FlagSet {
+	flags := flag.NewFlagSet(filepath.Base(os.Args[0]), flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: %s [options] <game.el> [-- args...]\n", flags.Name())
+		flags.PrintDefaults()
+	}
+	dirs := (*stringListFlag)(&opts.loadPaths)
+	flags.Var(dirs, "L", "add `dir` to the front of the load path (repeatable)")
+	flags.Var(dirs, "directory", "same as -L `dir`")
+	flags.StringVar(&opts.dataDir, "data-dir", "", "Emacs `dir` used as data-directory (etc/)")
+	flags.StringVar(&opts.entry, "entry", "", "`function` to call after loading instead of guessing one")
+	flags.BoolVar(&opts.batch, "batch", false, "run noninteractively: process -l, -f and --eval, then exit")
+	flags.BoolVar(&opts.repl, "repl", false, "read and evaluate elisp forms from stdin after -l, -f and --eval")
+	flags.BoolVar(&opts.noInit, "q", false, "do not load the init file")
+	flags.BoolVar(&opts.noInit, "no-init-file", false, "same as -q")
+	flags.StringVar(&opts.socket, "repl-socket", "", "serve a REPL for the running game on the Unix socket `path`")
+	for _, a := range []struct{ name, kind, usage string }{
+		{"l", "load", "load elisp `file` (batch mode, repeatable)"},
+		{"load", "load", "same as -l `file`"},
+		{"f", "funcall", "call `function` with no arguments (batch mode, repeatable)"},
+		{"funcall", "funcall", "same as -f `function`"},
+		{"eval", "eval", "evaluate elisp `expr` (batch mode, repeatable)"},
+	} {
+		flags.Var(batchActionFlag{kind: a.kind, actions: &opts.actions}, a.name, a.usage)
+	}
+	return flags
+}
+
+// usageError reports err with the usage, as flags does for its own
+// errors, and returns it.
+func usageError(flags *flag.FlagSet, err error) error {
+	fmt.Fprintln(flags.Output(), err)
+	flags.Usage()
+	return err
+}
+
+// parseCommandLine accepts flags before and after the game file. Everything
+// following a bare "--" is handed to elisp as command-line-args-left.
+func parseCommandLine(args []string) (*cliOptions, error) {
+	opts := &cliOptions{}
+	if i := slices.Index(args, "--"); i >= 0 {
+		opts.extraArgs = append([]string{}, args[i+1:]...)
+		args = args[:i]
+	}
+	flags := newFlagSet(opts)
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		if opts.file != "" {
+			return nil, usageError(flags, fmt.Errorf("unexpected argument: %s", rest[0]))
+		}
+		opts.file = rest[0]
+		args = rest[1:]
+	}
+	if len(opts.actions) > 0 && !opts.batch && !opts.repl {
+		return nil, usageError(flags, errors.New("-l, -f and --eval need --batch or --repl"))
+	}
+	return opts, nil
+}
+
+// buildLoadPaths orders -L directories first, then the directory of the
+// main file, then EMACSLOADPATH entries.
+func buildLoadPaths(dirs []string, filePath string) []string {
+	paths := make([]string, 0, len(dirs)+4)
+	seen := make(map[string]bool)
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		p = filepath.Clean(p)
+		if seen[p] {
+			return
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	for _, d := range dirs {
+		add(d)
+	}
+	if filePath != "" {
+		add(filepath.Dir(filePath))
+	}
+	for _, d := range filepath.SplitList(os.Getenv("EMACSLOADPATH")) {
+		add(d)
+	}
+	return paths
+}
+
+// directoryValue returns DIR with a trailing slash, the way Emacs stores
+// data-directory and exec-directory, or nil when DIR is unknown.
+func directoryValue(dir string) *golisp.Data {
+	if dir == "" {
+		return golisp.EmptyCons()
+	}
+	if !strings.HasSuffix(dir, string(filepath.Separator)) {
+		dir += string(filepath.Separator)
+	}
+	return golisp.StringWithValue(dir)
+}
+
+func stringList(items []string) *golisp.Data {
+	out := make([]*golisp.Data, 0, len(items))
+	for _, s := range items {
+		out = append(out, golisp.StringWithValue(s))
+	}
+	return golisp.ArrayToList(out)
+}
+
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "usage: %s <game.el>\n", filepath.Base(os.Args[0]))
-		os.Exit(2)
+	opts, err := parseCommandLine(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
 	}
-	filePath := os.Args[1]
-	if filepath.Ext(filePath) != ".el" {
-		fmt.Fprintf(os.Stderr, "expected a .el file, got %s\n", filePath)
+	if err != nil {
 		os.Exit(2)
 	}
-	if _, err := os.Stat(filePath); err != nil {
-		alt := filepath.Join("/home/alexander/clones/emacs-master/lisp/play", filepath.Base(filePath))
-		if _, err2 := os.Stat(alt); err2 == nil {
-			filePath = alt
+	if opts.file == "" && !opts.batch && !opts.repl {
+		game, err := pickBundledGame()
+		if err != nil {
+			newFlagSet(&cliOptions{}).Usage()
+			os.Exit(2)
+		}
+		if game == "" {
+			return
 		}
+		opts.file = game + ".el"
+	}
+	filePath := opts.file
+	if filePath != "" && !isElispFile(filePath) {
+		fmt.Fprintf(os.Stderr, "expected a .el or .el.gz file, got %s\n", filePath)
+		os.Exit(2)
+	}
+	entry := ""
+	if filePath != "" {
+		entry = elispFileStem(filePath)
 	}
-	entry := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
 	entrySymbol := entry
 	if len(entrySymbol) > 0 && isDigit(entrySymbol[0]) {
 		entrySymbol = normalizeLeadingDigitSymbol(entrySymbol)
 	}
 
 	rt := &runtimeState{
-		gameName:     entry,
-		mainFilePath: filePath,
-		grid:         make(map[[2]int]*golisp.Data),
-		gridDefault:  golisp.EmptyCons(),
-		displayMode:  golisp.Intern("glyph"),
+		gameName:    entry,
+		dataDir:     opts.dataDir,
+		grid:        make(map[[2]int]*golisp.Data),
+		gridDefault: golisp.EmptyCons(),
+		displayMode: golisp.Intern("color-tty"),
+		batch:       opts.batch || opts.repl,
 		providedFeatures: map[string]bool{
 			"cl-lib": true, "gamegrid": true, "seq": true, "subr-x": true,
 			"outline": true, "ps-print": true, "ps-print-loaddefs": true,
@@ -158,7 +495,6 @@ func main() {
 		windows:         make(map[int]*elWindow),
 		nextWindowID:    1,
 		menus:           make(map[string]*golisp.Data),
-		scores:          make(map[string][]int64),
 		warned:          make(map[string]bool),
 		funcByName:      make(map[string]*golisp.Data),
 		requireShim:     os.Getenv("ELRUN_REQUIRE_SHIM") == "1",
@@ -167,16 +503,41 @@ func main() {
 			"quit":  "error",
 		},
 	}
+	if rt.dataDir != "" {
+		// In an Emacs source tree lib-src/ sits next to etc/.
+		if libSrc := filepath.Join(filepath.Dir(filepath.Clean(rt.dataDir)), "lib-src"); isDir(libSrc) {
+			rt.execDir = libSrc
+		}
+	}
+	rt.loadPaths = buildLoadPaths(opts.loadPaths, filePath)
+	if rt.dataDir == "" {
+		rt.useSystemEmacs()
+	}
+	if _, err := os.Stat(filePath); err != nil && filePath != "" {
+		if p, ok := rt.resolveFeatureFile(entry); ok {
+			filePath = p
+		}
+	}
+	rt.mainFilePath = filePath
 	rtGlobal = rt
 	rt.ensureInitialWindowAndBuffer()
 	installElispCompat(rt)
+	_, _ = golisp.Global.BindTo(golisp.Intern("command-line-args-left"), stringList(opts.extraArgs))
 
 	env := golisp.NewSymbolTableFrameBelow(golisp.Global, "etetris")
 	rt.env = env
-	rt.loadPaths = []string{
-		filepath.Dir(filePath),
-		"/home/alexander/clones/emacs-master/lisp/play",
-		"/home/alexander/clones/emacs-master/lisp",
+
+	// Like Emacs, --batch implies -q.
+	if !opts.batch && !opts.noInit {
+		rt.loadInitFile()
+		rt.loadCustomFile()
+	}
+	if opts.batch || opts.repl {
+		status := rt.runBatch(filePath, opts.actions, env)
+		if opts.repl && status == 0 && !rt.killed {
+			status = rt.runREPL(os.Stdin, os.Stdout, env)
+		}
+		os.Exit(status)
 	}
 
 	if err := rt.loadElispFile(filePath); err != nil {
@@ -186,7 +547,11 @@ func main() {
 
 	fmt.Printf("loaded %s into elisp-compat environment\n", filePath)
 
-	entrySymbol = rt.selectEntrySymbol(filePath, entrySymbol, env)
+	if opts.entry != "" {
+		entrySymbol = opts.entry
+	} else {
+		entrySymbol = rt.selectEntrySymbol(filePath, entrySymbol, env)
+	}
 	rt.seedInitialTextBufferIfNeeded(entrySymbol)
 	invoked := false
 	if entrySymbol == "life" {
@@ -196,14 +561,17 @@ func main() {
 		}
 		invoked = true
 	}
-	if !invoked && !rt.hasStandaloneAction() {
+	if !invoked && (opts.entry != "" || !rt.hasStandaloneAction()) {
 		if err := rt.invokeEntry(entrySymbol, env); err != nil {
 			fmt.Fprintf(os.Stderr, "invoke %s: %v\n", entrySymbol, err)
 			os.Exit(1)
 		}
 	}
+	if rt.killed {
+		os.Exit(rt.exitStatus)
+	}
 	if rt.gridWidth == 0 && len(rt.timers) == 0 && !rt.shouldRunTextLoop() {
-		if rt.setupStandaloneAction(entrySymbol, env) {
+		if opts.entry == "" && rt.setupStandaloneAction(entrySymbol, env) {
 			// continue into interactive loop below
 		} else {
 			fmt.Fprintf(os.Stderr, "play: command finished without interactive loop (%s)\n", entrySymbol)
@@ -211,10 +579,244 @@ func main() {
 		}
 	}
 
-	if err := runGameLoop(rt, env); err != nil {
+	stopREPL := func() {}
+	if opts.socket != "" {
+		if stopREPL, err = rt.listenREPLSocket(opts.socket); err != nil {
+			rt.warnf("repl socket unavailable: %v", err)
+			stopREPL = func() {}
+		}
+	}
+	if rt.gridWidth == 0 {
+		rt.loadInputHistory(rt.currentBuffer())
+	}
+	err = runGameLoop(rt, env)
+	stopREPL()
+	rt.saveInputHistory()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "play: %v\n", err)
 		os.Exit(1)
 	}
+	if rt.killed {
+		os.Exit(rt.exitStatus)
+	}
+}
+
+// runBatch loads FILE, if given, and then runs the -l, -f and --eval
+// actions in order. It returns the process exit status: the argument of
+// kill-emacs, 255 after an unhandled error, or 0.
+func (rt *runtimeState) runBatch(file string, actions []batchAction, env *golisp.SymbolTableFrame) int {
+	if file != "" {
+		actions = append([]batchAction{{kind: "load", value: file}}, actions...)
+	}
+	for _, a := range actions {
+		rt.beginCommand()
+		var err error
+		switch a.kind {
+		case "load":
+			_, err = rt.loadImpl(golisp.ArrayToList([]*golisp.Data{golisp.StringWithValue(a.value)}), env)
+		case "funcall":
+			err = rt.call(a.value, env)
+		case "eval":
+			var form string
+			if form, err = preprocessElisp(a.value); err == nil {
+				_, err = golisp.ParseAndEvalInEnvironment(form, env)
+			}
+		}
+		if rt.killed {
+			return rt.exitStatus
+		}
+		if err != nil {
+			if name, ok := missingFunctionFromError(err.Error()); ok {
+				err = fmt.Errorf("needed elisp function is not implemented: %s", name)
+			}
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", a.kind, a.value, err)
+			return 255
+		}
+	}
+	return 0
+}
+
+// userConfigDir returns $XDG_CONFIG_HOME, defaulting to ~/.config.
+func userConfigDir() string {
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return dir
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config")
+	}
+	return ""
+}
+
+// userStateDir returns $XDG_STATE_HOME, defaulting to ~/.local/state.
+func userStateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return dir
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".local", "state")
+	}
+	return ""
+}
+
+// initFilePath returns ~/.runmacs.el, falling back to
+// $XDG_CONFIG_HOME/runmacs/init.el, or "" when neither exists.
+func initFilePath() string {
+	candidates := []string{}
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, filepath.Join(home, ".runmacs.el"))
+	}
+	if dir := userConfigDir(); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "runmacs", "init.el"))
+	}
+	for _, p := range candidates {
+		if st, err := os.Stat(p); err == nil && !st.IsDir() {
+			return p
+		}
+	}
+	return ""
+}
+
+// loadInitFile loads the user's init file into rt.env before the game, so
+// its setq and add-hook forms take effect once the game defines them. As in
+// Emacs, an error in the init file is reported and startup continues.
+func (rt *runtimeState) loadInitFile() {
+	path := initFilePath()
+	if path == "" {
+		return
+	}
+	golisp.Global.BindToProtected(golisp.Intern("user-init-file"), golisp.StringWithValue(path))
+	if err := rt.loadElispFile(path); err != nil {
+		rt.warnf("error in init file %s: %v", path, err)
+	}
+}
+
+func isElispFile(path string) bool {
+	return strings.HasSuffix(path, ".el") || strings.HasSuffix(path, ".el.gz")
+}
+
+// elispFileStem returns the base name of PATH without .el or .el.gz.
+func elispFileStem(path string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(filepath.Base(path), ".gz"), ".el")
+}
+
+func isDir(path string) bool {
+	st, err := os.Stat(path)
+	return err == nil && st.IsDir()
+}
+
+// emacsInstall is an Emacs found on this machine, either an installed
+// share/emacs/<version> tree or a source checkout named by EMACS_SOURCE.
+type emacsInstall struct {
+	lispDirs []string
+	dataDir  string
+	execDir  string
+}
+
+// discoverEmacsInstall probes $EMACS_SOURCE, then /usr/share/emacs/<version>
+// and /usr/local/share/emacs/<version>, newest version first.
+func discoverEmacsInstall() (emacsInstall, bool) {
+	if src := os.Getenv("EMACS_SOURCE"); src != "" {
+		if inst, ok := emacsInstallAt(src, filepath.Join(src, "lib-src")); ok {
+			return inst, true
+		}
+	}
+	for _, prefix := range []string{"/usr", "/usr/local"} {
+		roots, _ := filepath.Glob(filepath.Join(prefix, "share", "emacs", "*"))
+		sort.Slice(roots, func(i, j int) bool {
+			return compareVersions(filepath.Base(roots[i]), filepath.Base(roots[j])) > 0
+		})
+		for _, root := range roots {
+			version := filepath.Base(root)
+			if version == "" || !isDigit(version[0]) {
+				continue
+			}
+			if inst, ok := emacsInstallAt(root, libexecDir(prefix, version)); ok {
+				return inst, true
+			}
+		}
+	}
+	return emacsInstall{}, false
+}
+
+func emacsInstallAt(root, execDir string) (emacsInstall, bool) {
+	lisp := filepath.Join(root, "lisp")
+	if !isDir(lisp) {
+		return emacsInstall{}, false
+	}
+	inst := emacsInstall{}
+	if play := filepath.Join(lisp, "play"); isDir(play) {
+		inst.lispDirs = append(inst.lispDirs, play)
+	}
+	inst.lispDirs = append(inst.lispDirs, lisp)
+	if etc := filepath.Join(root, "etc"); isDir(etc) {
+		inst.dataDir = etc
+	}
+	if isDir(execDir) {
+		inst.execDir = execDir
+	}
+	return inst, true
+}
+
+// libexecDir finds the architecture specific helper directory, such as
+// /usr/libexec/emacs/29.3/x86_64-linux-gnu, for an installed version.
+func libexecDir(prefix, version string) string {
+	for _, base := range []string{"libexec", "lib"} {
+		matches, _ := filepath.Glob(filepath.Join(prefix, base, "emacs", version, "*"))
+		for _, m := range matches {
+			if isDir(m) {
+				return m
+			}
+		}
+	}
+	return ""
+}
+
+// compareVersions orders dotted version strings numerically.
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			return x - y
+		}
+	}
+	return 0
+}
+
+// useSystemEmacs runs discovery once, appending the found lisp directories
+// to the load path and filling data-directory and exec-directory when they
+// were not given. It reports whether new load paths were added.
+func (rt *runtimeState) useSystemEmacs() bool {
+	if rt.emacsProbed {
+		return false
+	}
+	rt.emacsProbed = true
+	inst, ok := discoverEmacsInstall()
+	if !ok {
+		return false
+	}
+	added := false
+	for _, dir := range inst.lispDirs {
+		if !slices.Contains(rt.loadPaths, dir) {
+			rt.loadPaths = append(rt.loadPaths, dir)
+			added = true
+		}
+	}
+	if rt.dataDir == "" && inst.dataDir != "" {
+		rt.dataDir = inst.dataDir
+		golisp.Global.BindToProtected(golisp.Intern("data-directory"), directoryValue(rt.dataDir))
+	}
+	if rt.execDir == "" && inst.execDir != "" {
+		rt.execDir = inst.execDir
+		golisp.Global.BindToProtected(golisp.Intern("exec-directory"), directoryValue(rt.execDir))
+	}
+	return added
 }
 
 func shouldRetryInvokeWithNil(msg string) bool {
@@ -349,7 +951,7 @@ func (rt *runtimeState) selectEntrySymbol(path, fallback string, env *golisp.Sym
 	if ks, ok := known[base]; ok {
 		candidates = append(candidates, ks...)
 	}
-	if source, err := os.ReadFile(path); err == nil {
+	if source, err := readElispSource(path); err == nil {
 		// Prefer explicit autoload entrypoints, avoid picking random helper functions.
 		re := regexp.MustCompile(`(?ms)^\s*;;;###autoload\s*\n\s*\(defun\s+([a-zA-Z0-9:+*/<>=!?$%._-]+)`)
 		for _, m := range re.FindAllStringSubmatch(string(source), -1) {
@@ -382,7 +984,7 @@ func (rt *runtimeState) seedInitialTextBufferIfNeeded(entrySymbol string) {
 	if buf == nil || len(buf.text) > 0 {
 		return
 	}
-	source, err := os.ReadFile(rt.mainFilePath)
+	source, err := readElispSource(rt.mainFilePath)
 	if err != nil || len(source) == 0 {
 		return
 	}
@@ -394,7 +996,7 @@ func (rt *runtimeState) ensureStandaloneTextLoopBuffer() *elBuffer {
 	buf := rt.currentBuffer()
 	if buf == nil {
 		buf = rt.ensureBuffer("*scratch*")
-		rt.selectedWindow().buffer = buf
+		rt.setCurrentBuffer(buf)
 	}
 	if buf.localMap == nil || !isKeymap(buf.localMap) {
 		buf.localMap = keymapObject(newKeymap())
@@ -422,7 +1024,7 @@ func (rt *runtimeState) setupStandaloneAction(entrySymbol string, env *golisp.Sy
 		buf := rt.ensureStandaloneTextLoopBuffer()
 		buf.text = append([]rune{}, []rune("cookie1 loaded.\nPress Ctrl-C or Esc to quit.\n\n")...)
 		buf.point = len(buf.text)
-		form := fmt.Sprintf("(cookie %q \"Loading phrase...\" \"Done.\")", "/home/alexander/clones/emacs-master/etc/spook.lines")
+		form := fmt.Sprintf("(cookie %q \"Loading phrase...\" \"Done.\")", filepath.Join(rt.dataDir, "spook.lines"))
 		if err := rt.evalForm(form, env); err != nil {
 			_, _ = insertImpl(golisp.ArrayToList([]*golisp.Data{golisp.StringWithValue("Could not load cookie phrase file.\n")}), nil)
 		}
@@ -513,20 +1115,32 @@ func installElispCompat(rt *runtimeState) {
 	golisp.Global.BindToProtected(golisp.Intern("gamegrid-display-mode"), rt.displayMode)
 	golisp.Global.BindToProtected(golisp.Intern("most-positive-fixnum"), golisp.IntegerWithValue(1<<61-1))
 	golisp.Global.BindToProtected(golisp.Intern("most-negative-fixnum"), golisp.IntegerWithValue(-(1 << 61)))
-	golisp.Global.BindToProtected(golisp.Intern("data-directory"), golisp.StringWithValue("/home/alexander/clones/emacs-master/etc/"))
-	golisp.Global.BindToProtected(golisp.Intern("exec-directory"), golisp.StringWithValue("/home/alexander/clones/emacs-master/lib-src/"))
+	golisp.Global.BindToProtected(golisp.Intern("data-directory"), directoryValue(rt.dataDir))
+	golisp.Global.BindToProtected(golisp.Intern("exec-directory"), directoryValue(rt.execDir))
 	_, _ = golisp.Global.BindTo(golisp.Intern("fill-column"), golisp.IntegerWithValue(70))
+	_, _ = golisp.Global.BindTo(golisp.Intern("undo-limit"), golisp.IntegerWithValue(160000))
+	_, _ = golisp.Global.BindTo(golisp.Intern("buffer-undo-list"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("kill-ring"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("kill-ring-yank-pointer"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("kill-ring-max"), golisp.IntegerWithValue(120))
+	_, _ = golisp.Global.BindTo(golisp.Intern("input-ring"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("input-ring-size"), golisp.IntegerWithValue(500))
+	_, _ = golisp.Global.BindTo(golisp.Intern("completion-ignore-case"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("minibuffer-history"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("yes-or-no-p-history"), golisp.EmptyCons())
+	golisp.Global.BindToProtected(golisp.Intern("noninteractive"), golisp.BooleanWithValue(rt.batch))
+	_, _ = golisp.Global.BindTo(golisp.Intern("custom-file"), golisp.EmptyCons())
 
 	golisp.MakeSpecialForm("setq", "*", setqImpl)
 	golisp.MakeSpecialForm("setq-local", "*", setqImpl)
 	golisp.MakeSpecialForm("defun", ">=2", defunImpl)
 	golisp.MakeSpecialForm("defvar", "*", defvarImpl)
 	golisp.MakeSpecialForm("defvar-local", "*", defvarImpl)
-	golisp.MakeSpecialForm("defconst", "*", defvarImpl)
-	golisp.MakeSpecialForm("defcustom", "*", defvarImpl)
+	golisp.MakeSpecialForm("defconst", "*", defconstImpl)
+	golisp.MakeSpecialForm("defcustom", ">=2", rt.defcustomImpl)
 	golisp.MakeSpecialForm("defmacro", ">=3", defmacroImpl)
 	golisp.MakeSpecialForm("defsubst", ">=2", defsubstImpl)
-	golisp.MakeSpecialForm("defface", ">=2", deffaceImpl)
+	golisp.MakeSpecialForm("defface", ">=2", rt.deffaceImpl)
 	golisp.MakeSpecialForm("defalias", "2|3", defaliasImpl)
 	golisp.MakeSpecialForm("defgroup", ">=1", defgroupImpl)
 	golisp.MakeSpecialForm("defvar-keymap", "*", defvarKeymapImpl)
@@ -559,6 +1173,7 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakeSpecialForm("unwind-protect", ">=1", unwindProtectImpl)
 	golisp.MakeSpecialForm("save-current-buffer", "*", saveCurrentBufferImpl)
 	golisp.MakeSpecialForm("save-excursion", "*", beginAliasImpl)
+	golisp.MakeSpecialForm("save-restriction", "*", saveRestrictionImpl)
 	golisp.MakeSpecialForm("with-current-buffer", ">=2", withCurrentBufferImpl)
 	golisp.MakeSpecialForm("with-temp-buffer", ">=1", withTempBufferImpl)
 
@@ -588,6 +1203,15 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("eq", "2", binaryAlias("eq?"))
 	golisp.MakePrimitiveFunction("equal", "2", equalImpl)
 	golisp.MakePrimitiveFunction("set", "2", setImpl)
+	golisp.MakePrimitiveFunction("set-default", "2", rt.setDefaultImpl)
+	golisp.MakePrimitiveFunction("custom-initialize-default", "2", rt.customInitializeDefaultImpl)
+	golisp.MakePrimitiveFunction("custom-initialize-delay", "2", rt.customInitializeDefaultImpl)
+	golisp.MakePrimitiveFunction("custom-initialize-set", "2", rt.customInitializeSetImpl)
+	golisp.MakePrimitiveFunction("custom-initialize-reset", "2", rt.customInitializeResetImpl)
+	golisp.MakePrimitiveFunction("custom-initialize-changed", "2", rt.customInitializeChangedImpl)
+	golisp.MakePrimitiveFunction("custom-set-variables", "*", rt.customSetVariablesImpl)
+	golisp.MakePrimitiveFunction("customize-set-variable", "2|3", rt.customizeSetVariableImpl)
+	golisp.MakePrimitiveFunction("customize-save-variable", "2|3", rt.customizeSaveVariableImpl)
 	golisp.MakePrimitiveFunction("functionp", "1", functionpImpl)
 	golisp.MakePrimitiveFunction("atom", "1", atomImpl)
 	golisp.MakePrimitiveFunction("listp", "1", listpImpl)
@@ -611,10 +1235,11 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("symbol-function", "1", symbolFunctionImpl)
 	golisp.MakePrimitiveFunction("intern-soft", "1|2", internSoftImpl)
 	golisp.MakePrimitiveFunction("stringp", "1", stringpImpl)
-	golisp.MakePrimitiveFunction("facep", "1", facepImpl)
+	golisp.MakePrimitiveFunction("facep", "1", rt.facepImpl)
 	golisp.MakePrimitiveFunction("natnump", "1", natnumpImpl)
 	golisp.MakePrimitiveFunction("regexp-quote", "1", regexpQuoteImpl)
-	golisp.MakePrimitiveFunction("copy-face", "2|3|4", copyFaceImpl)
+	golisp.MakePrimitiveFunction("copy-face", "2|3|4", rt.copyFaceImpl)
+	golisp.MakePrimitiveFunction("make-face", "1", rt.makeFaceImpl)
 	golisp.MakePrimitiveFunction("current-time", "0", currentTimeImpl)
 	golisp.MakePrimitiveFunction("time-convert", "1|2", timeConvertImpl)
 	golisp.MakePrimitiveFunction("time-equal-p", "2", timeEqualPImpl)
@@ -661,14 +1286,31 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("get-buffer-window", "1|2", rt.getBufferWindowImpl)
 	golisp.MakePrimitiveFunction("current-buffer", "0", rt.currentBufferImpl)
 	golisp.MakePrimitiveFunction("message", "*", rt.messageImpl)
+	golisp.MakePrimitiveFunction("princ", "1|2", rt.princImpl)
+	golisp.MakePrimitiveFunction("prin1", "1|2", rt.prin1Impl)
+	golisp.MakePrimitiveFunction("print", "1|2", rt.printImpl)
+	golisp.MakePrimitiveFunction("terpri", "0|1", rt.terpriImpl)
+	golisp.MakePrimitiveFunction("kill-emacs", "0|1", rt.killEmacsImpl)
 	golisp.MakePrimitiveFunction("error", ">=1", errorImpl)
 	golisp.MakePrimitiveFunction("user-error", ">=1", rt.userErrorImpl)
-	golisp.MakePrimitiveFunction("read-string", "1|2|3|4|5", readStringImpl)
+	golisp.MakePrimitiveFunction("read-string", "1|2|3|4|5", rt.readStringImpl)
+	golisp.MakePrimitiveFunction("read-from-minibuffer", "1|2|3|4|5|6|7", rt.readFromMinibufferImpl)
+	golisp.MakePrimitiveFunction("try-completion", "2|3", tryCompletionImpl)
+	golisp.MakePrimitiveFunction("all-completions", "2|3|4", allCompletionsImpl)
+	golisp.MakePrimitiveFunction("test-completion", "2|3", testCompletionImpl)
+	golisp.MakePrimitiveFunction("completing-read", "2|3|4|5|6|7|8", rt.completingReadImpl)
+	golisp.MakePrimitiveFunction("read-number", "1|2|3", rt.readNumberImpl)
+	golisp.MakePrimitiveFunction("read-char", "0|1|2|3", rt.readCharImpl)
+	golisp.MakePrimitiveFunction("read-char-choice", "2|3", rt.readCharChoiceImpl)
+	golisp.MakePrimitiveFunction("read-key", "0|1|2", rt.readKeyImpl)
 	golisp.MakePrimitiveFunction("format", "*", formatImpl)
 	golisp.MakePrimitiveFunction("apply", ">=2", applyImpl)
 	golisp.MakePrimitiveFunction("make-sparse-keymap", "0|1", makeSparseKeymapImpl)
 	golisp.MakePrimitiveFunction("define-key", "3", defineKeyImpl)
 	golisp.MakePrimitiveFunction("keymap-set", "3", keymapSetImpl)
+	golisp.MakePrimitiveFunction("kbd", "1", kbdImpl)
+	golisp.MakePrimitiveFunction("lookup-key", "2|3", lookupKeyImpl)
+	golisp.MakePrimitiveFunction("keymap-lookup", "2|3|4|5", keymapLookupImpl)
 	golisp.MakePrimitiveFunction("obarray-make", "1", obarrayMakeImpl)
 	golisp.MakePrimitiveFunction("expand-file-name", "1|2", expandFileNameImpl)
 	golisp.MakePrimitiveFunction("substitute-in-file-name", "1", substituteInFileNameImpl)
@@ -709,7 +1351,8 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("insert-char", "1|2|3", insertCharImpl)
 	golisp.MakePrimitiveFunction("erase-buffer", "0", eraseBufferImpl)
 	golisp.MakePrimitiveFunction("delete-blank-lines", "0", deleteBlankLinesImpl)
-	golisp.MakePrimitiveFunction("buffer-disable-undo", "0|1", firstArgOrNil)
+	golisp.MakePrimitiveFunction("buffer-disable-undo", "0|1", rt.bufferDisableUndoImpl)
+	golisp.MakePrimitiveFunction("buffer-enable-undo", "0|1", rt.bufferEnableUndoImpl)
 	golisp.MakePrimitiveFunction("buffer-live-p", "1", bufferLivePImpl)
 	golisp.MakePrimitiveFunction("generate-new-buffer", "1", rt.generateNewBufferImpl)
 	golisp.MakePrimitiveFunction("file-readable-p", "1", fileReadablePImpl)
@@ -718,8 +1361,9 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("file-attribute-modification-time", "1", fileAttributeModificationTimeImpl)
 	golisp.MakePrimitiveFunction("set-buffer-modified-p", "0|1", firstArgOrNil)
 	golisp.MakePrimitiveFunction("buffer-list", "0|1", rt.bufferListImpl)
-	golisp.MakePrimitiveFunction("undo-boundary", "0", nilValueImpl)
-	golisp.MakePrimitiveFunction("primitive-undo", "2", primitiveUndoImpl)
+	golisp.MakePrimitiveFunction("undo-boundary", "0", rt.undoBoundaryImpl)
+	golisp.MakePrimitiveFunction("primitive-undo", "2", rt.primitiveUndoImpl)
+	golisp.MakePrimitiveFunction("undo", "0|1", rt.undoImpl)
 	golisp.MakePrimitiveFunction("get-buffer-create", "1", getBufferCreateImpl)
 	golisp.MakePrimitiveFunction("get-scratch-buffer-create", "0", getScratchBufferCreateImpl)
 	golisp.MakePrimitiveFunction("get-buffer", "1", getBufferImpl)
@@ -729,6 +1373,35 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("el-point", "0", pointImpl)
 	golisp.MakePrimitiveFunction("point-min", "0", pointMinImpl)
 	golisp.MakePrimitiveFunction("point-max", "0", pointMaxImpl)
+	golisp.MakePrimitiveFunction("narrow-to-region", "2", narrowToRegionImpl)
+	golisp.MakePrimitiveFunction("widen", "0", widenImpl)
+	golisp.MakePrimitiveFunction("buffer-narrowed-p", "0", bufferNarrowedPImpl)
+	golisp.MakePrimitiveFunction("markerp", "1", markerpImpl)
+	golisp.MakePrimitiveFunction("integer-or-marker-p", "1", integerOrMarkerPImpl)
+	golisp.MakePrimitiveFunction("make-marker", "0", makeMarkerImpl)
+	golisp.MakePrimitiveFunction("point-marker", "0", pointMarkerImpl)
+	golisp.MakePrimitiveFunction("point-min-marker", "0", pointMinMarkerImpl)
+	golisp.MakePrimitiveFunction("point-max-marker", "0", pointMaxMarkerImpl)
+	golisp.MakePrimitiveFunction("set-marker", "2|3", rt.setMarkerImpl)
+	golisp.MakePrimitiveFunction("move-marker", "2|3", rt.setMarkerImpl)
+	golisp.MakePrimitiveFunction("copy-marker", "0|1|2", rt.copyMarkerImpl)
+	golisp.MakePrimitiveFunction("marker-position", "1", markerPositionImpl)
+	golisp.MakePrimitiveFunction("marker-buffer", "1", markerBufferImpl)
+	golisp.MakePrimitiveFunction("marker-insertion-type", "1", markerInsertionTypeImpl)
+	golisp.MakePrimitiveFunction("set-marker-insertion-type", "2", setMarkerInsertionTypeImpl)
+	golisp.MakePrimitiveFunction("mark", "0|1", markImpl)
+	golisp.MakePrimitiveFunction("mark-marker", "0", markMarkerImpl)
+	golisp.MakePrimitiveFunction("set-mark", "1", rt.setMarkImpl)
+	golisp.MakePrimitiveFunction("kill-new", "1|2", killNewImpl)
+	golisp.MakePrimitiveFunction("kill-append", "2", killAppendImpl)
+	golisp.MakePrimitiveFunction("current-kill", "1|2", currentKillImpl)
+	golisp.MakePrimitiveFunction("kill-region", "2", rt.killRegionImpl)
+	golisp.MakePrimitiveFunction("kill-line", "0|1", rt.killLineImpl)
+	golisp.MakePrimitiveFunction("yank", "0|1", rt.yankImpl)
+	golisp.MakePrimitiveFunction("yank-pop", "0|1", rt.yankPopImpl)
+	golisp.MakePrimitiveFunction("push-mark", "0|1|2|3", rt.pushMarkImpl)
+	golisp.MakePrimitiveFunction("region-beginning", "0", rt.regionBeginningImpl)
+	golisp.MakePrimitiveFunction("region-end", "0", rt.regionEndImpl)
 	golisp.MakePrimitiveFunction("eobp", "0", eobpImpl)
 	golisp.MakePrimitiveFunction("bolp", "0", bolpImpl)
 	golisp.MakePrimitiveFunction("eolp", "0", eolpImpl)
@@ -755,19 +1428,20 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("next-single-property-change", "2|3|4", nextSinglePropertyChangeImpl)
 	golisp.MakePrimitiveFunction("delete-region", "2", deleteRegionImpl)
 	golisp.MakePrimitiveFunction("delete-char", "0|1", deleteCharImpl)
+	golisp.MakePrimitiveFunction("forward-word", "0|1", forwardWordImpl)
 	golisp.MakePrimitiveFunction("backward-word", "0|1", backwardWordImpl)
 	golisp.MakePrimitiveFunction("append-to-buffer", "3", rt.appendToBufferImpl)
 	golisp.MakePrimitiveFunction("insert-buffer-substring", "1|2|3", rt.insertBufferSubstringImpl)
 	golisp.MakePrimitiveFunction("buffer-substring", "2", bufferSubstringImpl)
-	golisp.MakePrimitiveFunction("buffer-substring-no-properties", "2", bufferSubstringImpl)
+	golisp.MakePrimitiveFunction("buffer-substring-no-properties", "2", bufferSubstringNoPropertiesImpl)
 	golisp.MakePrimitiveFunction("insert-rectangle", "1", insertRectangleImpl)
 	golisp.MakePrimitiveFunction("newline", "0|1", newlineImpl)
 	golisp.MakePrimitiveFunction("move-to-column", "1|2", moveToColumnImpl)
 	golisp.MakePrimitiveFunction("indent-to", "1|2", indentToImpl)
 	golisp.MakePrimitiveFunction("fill-region-as-paragraph", "2|3|4|5", firstArgOrNil)
 	golisp.MakePrimitiveFunction("pop-to-buffer-same-window", "1|2", rt.popToBufferSameWindowImpl)
-	golisp.MakePrimitiveFunction("y-or-n-p", "1", yesImpl)
-	golisp.MakePrimitiveFunction("yes-or-no-p", "1", yesImpl)
+	golisp.MakePrimitiveFunction("y-or-n-p", "1", rt.yOrNPImpl)
+	golisp.MakePrimitiveFunction("yes-or-no-p", "1", rt.yesOrNoPImpl)
 	golisp.MakePrimitiveFunction("string-equal", "2", stringEqualImpl)
 	golisp.MakePrimitiveFunction("string=", "2", stringEqualImpl)
 	golisp.MakePrimitiveFunction("string-match-p", "2|3", stringMatchPImpl)
@@ -780,18 +1454,45 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("set-match-data", "1|2", setMatchDataImpl)
 	golisp.MakePrimitiveFunction("match-beginning", "1", matchBeginningImpl)
 	golisp.MakePrimitiveFunction("match-end", "1", matchEndImpl)
-	golisp.MakePrimitiveFunction("get-text-property", "2|3|4", firstArgOrNil)
-	golisp.MakePrimitiveFunction("put-text-property", "4|5", addTextPropertiesImpl)
+	golisp.MakePrimitiveFunction("get-text-property", "2|3", getTextPropertyImpl)
+	golisp.MakePrimitiveFunction("get-char-property", "2|3", getCharPropertyImpl)
+	golisp.MakePrimitiveFunction("text-properties-at", "1|2", textPropertiesAtImpl)
+	golisp.MakePrimitiveFunction("previous-single-property-change", "2|3|4", previousSinglePropertyChangeImpl)
+	golisp.MakePrimitiveFunction("next-property-change", "1|2|3", nextPropertyChangeImpl)
+	golisp.MakePrimitiveFunction("text-property-any", "4|5", textPropertyAnyImpl)
+	golisp.MakePrimitiveFunction("propertize", "*", propertizeImpl)
+	golisp.MakePrimitiveFunction("put-text-property", "4|5", putTextPropertyImpl)
 	golisp.MakePrimitiveFunction("add-text-properties", "3|4", addTextPropertiesImpl)
 	golisp.MakePrimitiveFunction("set-text-properties", "3|4", setTextPropertiesImpl)
-	golisp.MakePrimitiveFunction("remove-overlays", "0|1|2|3", removeOverlaysImpl)
+	golisp.MakePrimitiveFunction("make-overlay", "2|3|4|5", rt.makeOverlayImpl)
+	golisp.MakePrimitiveFunction("overlay-put", "3", overlayPutImpl)
+	golisp.MakePrimitiveFunction("overlay-get", "2", overlayGetImpl)
+	golisp.MakePrimitiveFunction("overlay-properties", "1", overlayPropertiesImpl)
+	golisp.MakePrimitiveFunction("overlay-start", "1", overlayStartImpl)
+	golisp.MakePrimitiveFunction("overlay-end", "1", overlayEndImpl)
+	golisp.MakePrimitiveFunction("overlay-buffer", "1", overlayBufferImpl)
+	golisp.MakePrimitiveFunction("overlayp", "1", overlaypImpl)
+	golisp.MakePrimitiveFunction("move-overlay", "3|4", rt.moveOverlayImpl)
+	golisp.MakePrimitiveFunction("delete-overlay", "1", deleteOverlayImpl)
+	golisp.MakePrimitiveFunction("overlays-at", "1|2", overlaysAtImpl)
+	golisp.MakePrimitiveFunction("overlays-in", "2", overlaysInImpl)
+	golisp.MakePrimitiveFunction("next-overlay-change", "1", nextOverlayChangeImpl)
+	golisp.MakePrimitiveFunction("remove-overlays", "0|1|2|3|4", rt.removeOverlaysImpl)
 	golisp.MakePrimitiveFunction("remove-text-properties", "3|4", removeTextPropertiesImpl)
+	golisp.MakePrimitiveFunction("remove-list-of-text-properties", "3|4", removeListOfTextPropertiesImpl)
 	golisp.MakePrimitiveFunction("untabify", "1|2", untabifyImpl)
 	golisp.MakePrimitiveFunction("lpr-print-region", "2|3|4|5", lprPrintRegionImpl)
 	golisp.MakePrimitiveFunction("current-window-configuration", "0|1", currentWindowConfigurationImpl)
 	golisp.MakePrimitiveFunction("set-window-configuration", "1", setWindowConfigurationImpl)
-	golisp.MakePrimitiveFunction("set-face-background", "2|3|4", setFaceBackgroundImpl)
-	golisp.MakePrimitiveFunction("set-face-foreground", "2|3|4", setFaceBackgroundImpl)
+	golisp.MakePrimitiveFunction("set-face-background", "2|3|4", rt.setFaceBackgroundImpl)
+	golisp.MakePrimitiveFunction("set-face-foreground", "2|3|4", rt.setFaceForegroundImpl)
+	golisp.MakePrimitiveFunction("face-background", "1|2|3", rt.faceBackgroundImpl)
+	golisp.MakePrimitiveFunction("face-foreground", "1|2|3", rt.faceForegroundImpl)
+	golisp.MakePrimitiveFunction("set-face-attribute", ">=2", rt.setFaceAttributeImpl)
+	golisp.MakePrimitiveFunction("face-attribute", "2|3|4", rt.faceAttributeImpl)
+	golisp.MakePrimitiveFunction("set-face-bold", "2|3", rt.setFaceBoldImpl)
+	golisp.MakePrimitiveFunction("set-face-underline", "2|3", rt.setFaceUnderlineImpl)
+	golisp.MakePrimitiveFunction("set-face-inverse-video", "2|3", rt.setFaceInverseVideoImpl)
 	golisp.MakePrimitiveFunction("modify-syntax-entry", "2|3", modifySyntaxEntryImpl)
 	golisp.MakePrimitiveFunction("prefix-numeric-value", "1", prefixNumericValueImpl)
 	golisp.MakePrimitiveFunction("make-bool-vector", "2", makeBoolVectorImpl)
@@ -806,6 +1507,7 @@ func installElispCompat(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("1", "*", firstArgOrNil)
 	golisp.MakeSpecialForm("declare-function", "*", declareFunctionImpl)
 
+	rt.defineStandardFaces()
 	bindGamegrid(rt)
 }
 
@@ -815,13 +1517,19 @@ func bindGamegrid(rt *runtimeState) {
 	golisp.MakePrimitiveFunction("gamegrid-kill-timer", "0", rt.gamegridKillTimerImpl)
 	golisp.MakePrimitiveFunction("gamegrid-start-timer", "2", rt.gamegridStartTimerImpl)
 	golisp.MakePrimitiveFunction("gamegrid-set-timer", "1", rt.gamegridSetTimerImpl)
-	golisp.MakePrimitiveFunction("gamegrid-add-score", "2", rt.gamegridAddScoreImpl)
+	golisp.MakePrimitiveFunction("gamegrid-add-score", "2|3", rt.gamegridAddScoreImpl)
 	golisp.MakePrimitiveFunction("gamegrid-set-cell", "3", rt.gamegridSetCellImpl)
 	golisp.MakePrimitiveFunction("gamegrid-get-cell", "2", rt.gamegridGetCellImpl)
+	golisp.MakePrimitiveFunction("user-full-name", "0|1", userFullNameImpl)
+	golisp.MakePrimitiveFunction("user-login-name", "0|1", userLoginNameImpl)
+	_, _ = golisp.Global.BindTo(golisp.Intern("gamegrid-score-file-length"), golisp.IntegerWithValue(50))
+	_, _ = golisp.Global.BindTo(golisp.Intern("gamegrid-user-score-file-directory"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("shared-game-score-directory"), golisp.EmptyCons())
+	_, _ = golisp.Global.BindTo(golisp.Intern("user-mail-address"), golisp.EmptyCons())
 }
 
 func (rt *runtimeState) loadElispFile(path string) error {
-	source, err := os.ReadFile(path)
+	source, err := readElispSource(path)
 	if err != nil {
 		return err
 	}
@@ -840,8 +1548,55 @@ func (rt *runtimeState) loadElispFile(path string) error {
 	return fmt.Errorf("needed elisp function is not implemented: %s", name)
 }
 
+// readElispSource reads PATH, decompressing it when it is gzipped. Like
+// Emacs with auto-compression-mode, a missing foo.el falls back to foo.el.gz.
+func readElispSource(path string) ([]byte, error) {
+	if name, ok := strings.CutPrefix(path, bundledPrefix); ok {
+		return bundledLisp.ReadFile(name)
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		source, err := os.ReadFile(path)
+		if err == nil || !errors.Is(err, os.ErrNotExist) {
+			return source, err
+		}
+		if _, gzErr := os.Stat(path + ".gz"); gzErr != nil {
+			return nil, err
+		}
+		path += ".gz"
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	defer zr.Close()
+	source, err := io.ReadAll(zr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return source, nil
+}
+
 func (rt *runtimeState) resolveFeatureFile(feature string) (string, bool) {
-	candidates := []string{feature + ".el", strings.ReplaceAll(feature, "-", "/") + ".el"}
+	if p, ok := rt.findInLoadPaths(feature); ok {
+		return p, true
+	}
+	if p, ok := findBundled(feature); ok {
+		return p, true
+	}
+	if rt.useSystemEmacs() {
+		return rt.findInLoadPaths(feature)
+	}
+	return "", false
+}
+
+func (rt *runtimeState) findInLoadPaths(feature string) (string, bool) {
+	slashed := strings.ReplaceAll(feature, "-", "/")
+	candidates := []string{feature + ".el", feature + ".el.gz", slashed + ".el", slashed + ".el.gz"}
 	for _, dir := range rt.loadPaths {
 		for _, rel := range candidates {
 			p := filepath.Join(dir, rel)
@@ -853,6 +1608,14 @@ func (rt *runtimeState) resolveFeatureFile(feature string) (string, bool) {
 	return "", false
 }
 
+func findBundled(feature string) (string, bool) {
+	name := feature + ".el"
+	if _, err := fs.Stat(bundledLisp, name); err != nil {
+		return "", false
+	}
+	return bundledPrefix + name, true
+}
+
 func (rt *runtimeState) warnf(format string, args ...any) {
 	fmt.Fprintf(os.Stderr, "[etetris] "+format+"\n", args...)
 }
@@ -902,6 +1665,7 @@ func (rt *runtimeState) ensureInitialWindowAndBuffer() {
 	buf := rt.ensureBuffer("*scratch*")
 	win := rt.newWindowForBuffer(buf)
 	rt.selectedWindowID = win.id
+	rt.setCurrentBuffer(buf)
 }
 
 func (rt *runtimeState) ensureBuffer(name string) *elBuffer {
@@ -909,8 +1673,13 @@ func (rt *runtimeState) ensureBuffer(name string) *elBuffer {
 		return b
 	}
 	b := &elBuffer{
-		name:  name,
-		hooks: make(map[string][]*golisp.Data),
+		name:   name,
+		hooks:  make(map[string][]*golisp.Data),
+		locals: make(map[string]*golisp.Data),
+	}
+	if strings.HasPrefix(name, " ") {
+		// As in Emacs, buffers named with a leading space keep no undo.
+		b.locals["buffer-undo-list"] = golisp.BooleanWithValue(true)
 	}
 	b.object = golisp.ObjectWithTypeAndValue("el-buffer", unsafe.Pointer(b))
 	rt.buffers[name] = b
@@ -931,7 +1700,9 @@ func (rt *runtimeState) selectedWindow() *elWindow {
 		return w
 	}
 	for _, w := range rt.windows {
+		// Its buffer becomes current, with its own buffer-local values.
 		rt.selectedWindowID = w.id
+		rt.setCurrentBuffer(w.buffer)
 		return w
 	}
 	rt.ensureInitialWindowAndBuffer()
@@ -1051,7 +1822,7 @@ func (rt *runtimeState) requireImpl(args *golisp.Data, _ *golisp.SymbolTableFram
 func (rt *runtimeState) loadImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	target := featureName(golisp.Car(args))
 	path := target
-	if !strings.HasSuffix(path, ".el") {
+	if !isElispFile(path) {
 		if p, ok := rt.resolveFeatureFile(target); ok {
 			path = p
 		} else if p, ok := rt.resolveFeatureFile(path); ok {
@@ -1075,7 +1846,7 @@ func (rt *runtimeState) provideImpl(args *golisp.Data, _ *golisp.SymbolTableFram
 func throwImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	tag := featureName(golisp.Car(args))
 	val := golisp.Cadr(args)
-	return nil, throwSignal{tag: tag, value: val}
+	return nil, raise(throwSignal{tag: tag, value: val})
 }
 
 func signalImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -1083,7 +1854,7 @@ func signalImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, er
 	if !golisp.SymbolP(cond) {
 		return nil, fmt.Errorf("signal expects condition symbol, got %s", golisp.String(cond))
 	}
-	return nil, elSignal{condition: golisp.StringValue(cond), data: golisp.Cadr(args)}
+	return nil, raise(elSignal{condition: golisp.StringValue(cond), data: golisp.Cadr(args)})
 }
 
 func (rt *runtimeState) funcallImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -1113,6 +1884,21 @@ func (rt *runtimeState) runHooksImpl(args *golisp.Data, env *golisp.SymbolTableF
 		if !golisp.SymbolP(h) {
 			continue
 		}
+		if buf := rt.currentBuffer(); buf != nil {
+			for _, fn := range buf.hooks[golisp.StringValue(h)] {
+				if golisp.SymbolP(fn) {
+					fn = env.ValueOf(fn)
+				}
+				if !golisp.FunctionOrPrimitiveP(fn) {
+					continue
+				}
+				r, err := golisp.ApplyWithoutEval(fn, golisp.EmptyCons(), env)
+				if err != nil {
+					return nil, err
+				}
+				result = r
+			}
+		}
 		hookVar := env.ValueOf(h)
 		if golisp.NilP(hookVar) {
 			continue
@@ -1145,9 +1931,14 @@ func (rt *runtimeState) runHooksImpl(args *golisp.Data, env *golisp.SymbolTableF
 	return result, nil
 }
 
-func (rt *runtimeState) addHookImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	hook := featureName(golisp.Car(args))
+// addHookImpl adds FN to the hook variable's value, so the hook also works
+// when added from the init file before the game defines the variable.
+// Buffer-local hooks live on the buffer and run before the global ones.
+func (rt *runtimeState) addHookImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	hookSym := golisp.Car(args)
+	hook := featureName(hookSym)
 	fn := golisp.Cadr(args)
+	appendFn := golisp.BooleanValue(golisp.Caddr(args))
 	isLocal := false
 	if golisp.NotNilP(golisp.Cdddr(args)) {
 		isLocal = golisp.BooleanValue(golisp.Car(golisp.Cdddr(args)))
@@ -1155,11 +1946,30 @@ func (rt *runtimeState) addHookImpl(args *golisp.Data, _ *golisp.SymbolTableFram
 	if isLocal {
 		buf := rt.currentBuffer()
 		buf.hooks[hook] = append(buf.hooks[hook], fn)
+		return fn, nil
+	}
+	var fns []*golisp.Data
+	switch cur := env.ValueOf(hookSym); {
+	case golisp.FunctionOrPrimitiveP(cur):
+		fns = []*golisp.Data{cur}
+	case golisp.ListP(cur):
+		fns = golisp.ToArray(cur)
+	}
+	for _, f := range fns {
+		if golisp.IsEqual(f, fn) {
+			return fn, nil
+		}
+	}
+	if appendFn {
+		fns = append(fns, fn)
 	} else {
-		if rt.buffers["*global*"] == nil {
-			rt.buffers["*global*"] = &elBuffer{name: "*global*", hooks: make(map[string][]*golisp.Data)}
+		fns = append([]*golisp.Data{fn}, fns...)
+	}
+	value := golisp.ArrayToList(fns)
+	if _, err := env.SetTo(hookSym, value); err != nil {
+		if _, err := rt.env.BindTo(hookSym, value); err != nil {
+			return nil, err
 		}
-		rt.buffers["*global*"].hooks[hook] = append(rt.buffers["*global*"].hooks[hook], fn)
 	}
 	return fn, nil
 }
@@ -1192,12 +2002,7 @@ func (rt *runtimeState) putImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (
 	sym := featureName(golisp.Car(args))
 	prop := featureName(golisp.Cadr(args))
 	val := golisp.Caddr(args)
-	props, ok := rt.symbolProps[sym]
-	if !ok {
-		props = make(map[string]*golisp.Data)
-		rt.symbolProps[sym] = props
-	}
-	props[prop] = val
+	rt.propsFor(sym)[prop] = val
 	return val, nil
 }
 
@@ -1222,7 +2027,7 @@ func bufferNameFromArg(d *golisp.Data) string {
 func (rt *runtimeState) switchToBufferImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	name := bufferNameFromArg(golisp.Car(args))
 	buf := rt.ensureBuffer(name)
-	rt.selectedWindow().buffer = buf
+	rt.setCurrentBuffer(buf)
 	return buf.object, nil
 }
 
@@ -1253,7 +2058,7 @@ func (rt *runtimeState) killBufferImpl(args *golisp.Data, _ *golisp.SymbolTableF
 	if len(rt.buffers) == 0 {
 		rt.ensureInitialWindowAndBuffer()
 	} else if rt.currentBuffer().name == name {
-		rt.selectedWindow().buffer = rt.ensureBuffer("*scratch*")
+		rt.setCurrentBuffer(rt.ensureBuffer("*scratch*"))
 	}
 	return golisp.BooleanWithValue(true), nil
 }
@@ -1264,7 +2069,7 @@ func (rt *runtimeState) buryBufferImpl(args *golisp.Data, _ *golisp.SymbolTableF
 		name = bufferNameFromArg(golisp.Car(args))
 	}
 	if rt.currentBuffer().name == name {
-		rt.selectedWindow().buffer = rt.ensureBuffer("*scratch*")
+		rt.setCurrentBuffer(rt.ensureBuffer("*scratch*"))
 	}
 	return golisp.BooleanWithValue(true), nil
 }
@@ -1281,6 +2086,7 @@ func (rt *runtimeState) selectWindowImpl(args *golisp.Data, _ *golisp.SymbolTabl
 	w := (*elWindow)(golisp.ObjectValue(wv))
 	rt.windows[w.id] = w
 	rt.selectedWindowID = w.id
+	rt.setCurrentBuffer(w.buffer)
 	return w.object, nil
 }
 
@@ -1305,11 +2111,13 @@ func (rt *runtimeState) setWindowBufferImpl(args *golisp.Data, _ *golisp.SymbolT
 	buf := rt.ensureBuffer(name)
 	if golisp.ObjectP(wv) && golisp.ObjectType(wv) == "el-window" {
 		w := (*elWindow)(golisp.ObjectValue(wv))
-		w.buffer = buf
 		rt.windows[w.id] = w
-		return buf.object, nil
+		if w.id != rt.selectedWindowID {
+			w.buffer = buf
+			return buf.object, nil
+		}
 	}
-	rt.selectedWindow().buffer = buf
+	rt.setCurrentBuffer(buf)
 	return buf.object, nil
 }
 
@@ -1332,8 +2140,8 @@ func (rt *runtimeState) bufferListImpl(_ *golisp.Data, _ *golisp.SymbolTableFram
 
 func (rt *runtimeState) appendToBufferImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	dstName := bufferNameFromArg(golisp.Car(args))
-	start := int(golisp.IntegerValue(golisp.Cadr(args))) - 1
-	end := int(golisp.IntegerValue(golisp.Caddr(args))) - 1
+	start := positionArg(golisp.Cadr(args))
+	end := positionArg(golisp.Caddr(args))
 	src := rt.currentBuffer()
 	dst := rt.ensureBuffer(dstName)
 	if src == nil || dst == nil {
@@ -1351,7 +2159,7 @@ func (rt *runtimeState) appendToBufferImpl(args *golisp.Data, _ *golisp.SymbolTa
 	if end > len(src.text) {
 		end = len(src.text)
 	}
-	dst.text = append(dst.text, src.text[start:end]...)
+	dst.insertTextWithProps(len(dst.text), src.text[start:end], sliceProps(src.props, start, end))
 	return golisp.EmptyCons(), nil
 }
 
@@ -1361,13 +2169,12 @@ func (rt *runtimeState) insertBufferSubstringImpl(args *golisp.Data, _ *golisp.S
 	if !ok || src == nil {
 		return golisp.EmptyCons(), nil
 	}
-	start := 0
-	end := len(src.text)
-	if golisp.NotNilP(golisp.Cdr(args)) && golisp.IntegerP(golisp.Cadr(args)) {
-		start = int(golisp.IntegerValue(golisp.Cadr(args))) - 1
+	start, end := src.begv(), src.zv()
+	if golisp.NotNilP(golisp.Cdr(args)) && positionP(golisp.Cadr(args)) {
+		start = positionArg(golisp.Cadr(args))
 	}
-	if golisp.NotNilP(golisp.Cddr(args)) && golisp.IntegerP(golisp.Caddr(args)) {
-		end = int(golisp.IntegerValue(golisp.Caddr(args))) - 1
+	if golisp.NotNilP(golisp.Cddr(args)) && positionP(golisp.Caddr(args)) {
+		end = positionArg(golisp.Caddr(args))
 	}
 	if start < 0 {
 		start = 0
@@ -1382,34 +2189,34 @@ func (rt *runtimeState) insertBufferSubstringImpl(args *golisp.Data, _ *golisp.S
 	if dst == nil {
 		return golisp.EmptyCons(), nil
 	}
-	dst.text = append(dst.text[:dst.point], append(src.text[start:end], dst.text[dst.point:]...)...)
-	dst.point += end - start
+	dst.insertTextWithProps(dst.point, src.text[start:end], sliceProps(src.props, start, end))
 	return golisp.EmptyCons(), nil
 }
 
 func bufferSubstringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return bufferSubstring(args, true), nil
+}
+
+func bufferSubstringNoPropertiesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return bufferSubstring(args, false), nil
+}
+
+// bufferSubstring returns the text between START and END in args, with
+// its text properties when withProps is set.
+func bufferSubstring(args *golisp.Data, withProps bool) *golisp.Data {
 	buf := rtGlobal.currentBuffer()
 	if buf == nil {
-		return golisp.StringWithValue(""), nil
-	}
-	start := int(golisp.IntegerValue(golisp.Car(args))) - 1
-	end := int(golisp.IntegerValue(golisp.Cadr(args))) - 1
-	if start < 0 {
-		start = 0
-	}
-	if end < 0 {
-		end = 0
-	}
-	if start > len(buf.text) {
-		start = len(buf.text)
-	}
-	if end > len(buf.text) {
-		end = len(buf.text)
+		return golisp.StringWithValue("")
 	}
+	start := buf.clampPos(positionArg(golisp.Car(args)))
+	end := buf.clampPos(positionArg(golisp.Cadr(args)))
 	if start > end {
 		start, end = end, start
 	}
-	return golisp.StringWithValue(string(buf.text[start:end])), nil
+	if !withProps {
+		return golisp.StringWithValue(string(buf.text[start:end]))
+	}
+	return stringWithProps(buf.text[start:end], sliceProps(buf.props, start, end))
 }
 
 func (rt *runtimeState) messageImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -1426,12 +2233,256 @@ func (rt *runtimeState) messageImpl(args *golisp.Data, env *golisp.SymbolTableFr
 	} else {
 		msg = golisp.String(golisp.Car(args))
 	}
-	rt.messages = append(rt.messages, msg)
+	if rt.batch {
+		fmt.Fprintln(os.Stderr, msg)
+	} else {
+		rt.messages = append(rt.messages, msg)
+	}
 	return golisp.StringWithValue(msg), nil
 }
 
-func errorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	if golisp.NilP(args) {
+// runREPL reads forms from IN in the style of ielm and evaluates them
+// directly. It returns the exit status at end of input or kill-emacs.
+func (rt *runtimeState) runREPL(in io.Reader, out io.Writer, env *golisp.SymbolTableFrame) int {
+	fmt.Fprintln(out, "*** Welcome to runmacs ***  Type (kill-emacs) or C-d to exit.")
+	err := serveREPL(in, out, func(src string) (string, error) {
+		rt.beginCommand()
+		result, err := rt.evalString(src, env)
+		if rt.killed {
+			return "", killEmacs{status: rt.exitStatus}
+		}
+		if err != nil {
+			return "", err
+		}
+		return prin1String(result), nil
+	})
+	if k, ok := err.(killEmacs); ok {
+		return k.status
+	}
+	return 0
+}
+
+// serveREPL collects lines from IN until the parentheses balance, hands
+// the source to EVAL and prints the value or error. It stops at end of
+// input or when EVAL returns killEmacs, which is passed back.
+func serveREPL(in io.Reader, out io.Writer, eval func(src string) (string, error)) error {
+	const prompt = "ELISP> "
+	sc := bufio.NewScanner(in)
+	var pending strings.Builder
+	fmt.Fprint(out, prompt)
+	for sc.Scan() {
+		pending.WriteString(sc.Text())
+		pending.WriteByte('\n')
+		src := pending.String()
+		if strings.TrimSpace(src) == "" {
+			pending.Reset()
+			fmt.Fprint(out, prompt)
+			continue
+		}
+		if !formsComplete(src) {
+			continue
+		}
+		pending.Reset()
+		value, err := eval(src)
+		if _, ok := err.(killEmacs); ok {
+			return err
+		}
+		if err != nil {
+			fmt.Fprintf(out, "*** Eval error ***  %s\n", strings.TrimSpace(err.Error()))
+		} else {
+			fmt.Fprintln(out, value)
+		}
+		fmt.Fprint(out, prompt)
+	}
+	fmt.Fprintln(out)
+	return nil
+}
+
+// evalRequest carries a form from a REPL socket connection to the game
+// loop goroutine, which evaluates it between frames.
+type evalRequest struct {
+	src   string
+	reply chan evalReply
+}
+
+type evalReply struct {
+	value string
+	err   error
+}
+
+// listenREPLSocket accepts REPL connections on the Unix socket PATH. Each
+// connection gets its own prompt, but all evaluation is funneled through
+// rt.evalRequests so it never races with timers or key handling. The
+// returned stop function closes the socket, removes its file and ends
+// the connections once the game loop no longer serves them.
+func (rt *runtimeState) listenREPLSocket(path string) (stop func(), err error) {
+	if st, err := os.Lstat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+		// A socket left behind by a previous session.
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	rt.evalRequests = make(chan evalRequest)
+	requests := rt.evalRequests
+	done := make(chan struct{})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "*** runmacs: attached to %s ***\n", rt.gameName)
+				_ = serveREPL(conn, conn, func(src string) (string, error) {
+					req := evalRequest{src: src, reply: make(chan evalReply, 1)}
+					select {
+					case requests <- req:
+					case <-done:
+						return "", killEmacs{}
+					}
+					r := <-req.reply
+					return r.value, r.err
+				})
+			}()
+		}
+	}()
+	return func() {
+		close(done)
+		ln.Close()
+		_ = os.Remove(path)
+	}, nil
+}
+
+// serveEvalRequest runs on the game loop goroutine.
+func (rt *runtimeState) serveEvalRequest(req evalRequest, env *golisp.SymbolTableFrame) {
+	rt.beginCommand()
+	result, err := rt.evalString(req.src, env)
+	switch {
+	case rt.killed:
+		req.reply <- evalReply{err: killEmacs{status: rt.exitStatus}}
+	case err != nil:
+		req.reply <- evalReply{err: err}
+	default:
+		req.reply <- evalReply{value: prin1String(result)}
+	}
+}
+
+// evalString preprocesses and evaluates every form in SRC, returning the
+// value of the last one.
+func (rt *runtimeState) evalString(src string, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	form, err := preprocessElisp(src)
+	if err != nil {
+		return nil, err
+	}
+	result, err := golisp.ParseAndEvalAllInEnvironment(form, env)
+	if err != nil {
+		if name, ok := missingFunctionFromError(err.Error()); ok {
+			return nil, fmt.Errorf("needed elisp function is not implemented: %s", name)
+		}
+		return nil, err
+	}
+	return result, nil
+}
+
+// formsComplete reports whether SRC has no unclosed parens, brackets or
+// strings. Comments and character literals such as ?( are skipped.
+func formsComplete(src string) bool {
+	depth := 0
+	rs := []rune(src)
+	for i := 0; i < len(rs); i++ {
+		switch rs[i] {
+		case '"':
+			for i++; i < len(rs) && rs[i] != '"'; i++ {
+				if rs[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(rs) {
+				return false
+			}
+		case ';':
+			for i < len(rs) && rs[i] != '\n' {
+				i++
+			}
+		case '?':
+			if i+1 < len(rs) && rs[i+1] == '\\' {
+				i++
+			}
+			i++
+		case '\\':
+			i++
+		case '(', '[':
+			depth++
+		case ')', ']':
+			depth--
+		}
+	}
+	return depth <= 0
+}
+
+// printOutput sends printed text to the destination of standard-output:
+// stdout in batch mode and the echo area otherwise. A buffer argument
+// inserts into that buffer instead.
+func (rt *runtimeState) printOutput(text string, dest *golisp.Data) {
+	if golisp.ObjectP(dest) && golisp.ObjectType(dest) == "el-buffer" {
+		orig := rt.currentBuffer()
+		rt.setCurrentBuffer((*elBuffer)(golisp.ObjectValue(dest)))
+		_, _ = insertImpl(golisp.ArrayToList([]*golisp.Data{golisp.StringWithValue(text)}), nil)
+		rt.setCurrentBuffer(orig)
+		return
+	}
+	if rt.batch {
+		fmt.Print(text)
+		return
+	}
+	if text = strings.TrimRight(text, "\n"); text != "" {
+		rt.messages = append(rt.messages, text)
+	}
+}
+
+func (rt *runtimeState) princImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	obj := golisp.Car(args)
+	rt.printOutput(princString(obj), golisp.Cadr(args))
+	return obj, nil
+}
+
+func (rt *runtimeState) prin1Impl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	obj := golisp.Car(args)
+	rt.printOutput(prin1String(obj), golisp.Cadr(args))
+	return obj, nil
+}
+
+func (rt *runtimeState) printImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	obj := golisp.Car(args)
+	rt.printOutput("\n"+prin1String(obj)+"\n", golisp.Cadr(args))
+	return obj, nil
+}
+
+func (rt *runtimeState) terpriImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	rt.printOutput("\n", golisp.Car(args))
+	return golisp.BooleanWithValue(true), nil
+}
+
+// killEmacsImpl records the exit status and unwinds to the top level. An
+// integer argument is the status; a string is printed to stderr first.
+func (rt *runtimeState) killEmacsImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	status := 0
+	switch arg := golisp.Car(args); {
+	case golisp.IntegerP(arg):
+		status = int(golisp.IntegerValue(arg))
+	case golisp.StringP(arg):
+		fmt.Fprint(os.Stderr, golisp.StringValue(arg))
+	}
+	rt.killed = true
+	rt.exitStatus = status
+	return nil, killEmacs{status: status}
+}
+
+func errorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if golisp.NilP(args) {
 		return nil, fmt.Errorf("error")
 	}
 	if golisp.StringP(golisp.Car(args)) {
@@ -1444,1212 +2495,4988 @@ func errorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, e
 	return nil, fmt.Errorf("%s", golisp.String(golisp.Car(args)))
 }
 
-func readStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// In TTY mode, text games gather input via key handling.
-	// For compatibility callers, return INITIAL-INPUT if provided, otherwise empty.
-	if golisp.NotNilP(golisp.Cddr(args)) {
-		init := golisp.Caddr(args)
-		if golisp.StringP(init) {
-			return init, nil
-		}
+// completionFunction returns collection as a function, when it is one
+// that does its own completion.
+func completionFunction(collection *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, bool) {
+	if golisp.SymbolP(collection) && golisp.NotNilP(collection) {
+		collection = env.ValueOf(collection)
 	}
-	return golisp.StringWithValue(""), nil
+	return collection, golisp.FunctionOrPrimitiveP(collection)
 }
 
-func (rt *runtimeState) userErrorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	msg := "user-error"
-	if golisp.NotNilP(args) {
-		if golisp.StringP(golisp.Car(args)) {
-			formatted, err := formatImpl(args, env)
+// completions returns the names in collection that start with s and
+// that pred, if given, accepts. collection is a list of strings or
+// symbols, an alist keyed by them, or a vector of symbols such as an
+// obarray; pred is called with each element.
+func completions(s string, collection, pred *golisp.Data, env *golisp.SymbolTableFrame) ([]string, error) {
+	var elements []*golisp.Data
+	switch {
+	case isElVector(collection):
+		elements = asElVector(collection).items
+	case golisp.PairP(collection):
+		for c := collection; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+			elements = append(elements, golisp.Car(c))
+		}
+	}
+	fold := completionIgnoreCase(env)
+	var names []string
+	for _, e := range elements {
+		key := e
+		if golisp.PairP(e) && golisp.NotNilP(e) {
+			key = golisp.Car(e)
+		}
+		if !golisp.StringP(key) && !(golisp.SymbolP(key) && golisp.NotNilP(key)) {
+			continue
+		}
+		name := golisp.StringValue(key)
+		if !hasCompletionPrefix(name, s, fold) {
+			continue
+		}
+		if golisp.NotNilP(pred) {
+			ok, err := golisp.ApplyWithoutEval(pred, golisp.Cons(e, golisp.EmptyCons()), env)
 			if err != nil {
 				return nil, err
 			}
-			msg = golisp.StringValue(formatted)
-		} else {
-			msg = golisp.String(golisp.Car(args))
+			if !golisp.BooleanValue(ok) {
+				continue
+			}
 		}
+		names = append(names, name)
 	}
-	return nil, fmt.Errorf("%s", msg)
+	return names, nil
 }
 
-func (rt *runtimeState) gamegridInitImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	rt.gridDisplay = golisp.Car(args)
-	return rt.gridDisplay, nil
+// completionIgnoreCase is completion-ignore-case as env sees it.
+func completionIgnoreCase(env *golisp.SymbolTableFrame) bool {
+	return golisp.BooleanValue(env.ValueOf(golisp.Intern("completion-ignore-case")))
 }
 
-func (rt *runtimeState) gamegridInitBufferImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	width := int(golisp.IntegerValue(golisp.Car(args)))
-	height := int(golisp.IntegerValue(golisp.Cadr(args)))
-	fill := golisp.Caddr(args)
-	rt.gridWidth = width
-	rt.gridHeight = height
-	rt.gridDefault = fill
-	rt.grid = make(map[[2]int]*golisp.Data, width*height)
-	for y := range height {
-		for x := range width {
-			rt.grid[[2]int{x, y}] = fill
-		}
+func hasCompletionPrefix(name, s string, fold bool) bool {
+	if fold {
+		_, j := sharedPrefix(name, s, true)
+		return j == len(s)
 	}
-	return fill, nil
+	return strings.HasPrefix(name, s)
 }
 
-func (rt *runtimeState) gamegridKillTimerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	delete(rt.timers, "gamegrid")
-	return golisp.EmptyCons(), nil
+// sharedPrefix returns how many bytes of a and of b make up the prefix
+// they share. With fold, runes that differ only in case match; the two
+// lengths can then differ, as the cases need not be the same size.
+func sharedPrefix(a, b string, fold bool) (int, int) {
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		ra, na := utf8.DecodeRuneInString(a[i:])
+		rb, nb := utf8.DecodeRuneInString(b[j:])
+		if ra != rb && !(fold && strings.EqualFold(a[i:i+na], b[j:j+nb])) {
+			break
+		}
+		i, j = i+na, j+nb
+	}
+	return i, j
 }
 
-func (rt *runtimeState) gamegridStartTimerImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	period := golisp.FloatValue(golisp.Car(args))
-	callback := golisp.Cadr(args)
-	p := float64(period)
-	if p <= 0 {
-		p = 0.1
+// tryCompletion is try-completion on the names s completes to: nil for
+// none, t when s is the only one, and otherwise the longest prefix they
+// share.
+func tryCompletion(s string, names []string, fold bool) *golisp.Data {
+	if len(names) == 0 {
+		return golisp.EmptyCons()
 	}
-	rt.timers["gamegrid"] = &elTimer{period: p, callback: callback, active: true, nextFire: time.Now().Add(time.Duration(p * float64(time.Second)))}
-	return callback, nil
+	prefix := names[0]
+	unique := true
+	for _, n := range names[1:] {
+		if n != names[0] {
+			unique = false
+		}
+		i, _ := sharedPrefix(prefix, n, fold)
+		prefix = prefix[:i]
+	}
+	if unique && (names[0] == s || fold && strings.EqualFold(names[0], s)) {
+		return golisp.BooleanWithValue(true)
+	}
+	return golisp.StringWithValue(prefix)
 }
 
-func (rt *runtimeState) gamegridSetTimerImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	period := golisp.FloatValue(golisp.Car(args))
-	t := rt.timers["gamegrid"]
-	if t == nil {
-		t = &elTimer{active: true}
-		rt.timers["gamegrid"] = t
-	}
-	p := float64(period)
-	if p <= 0 {
-		p = 0.1
+// completionArgs calls a function collection on STRING and PREDICATE
+// from args, with flag saying what it should do, or else lists the
+// completions of STRING.
+func completionArgs(args *golisp.Data, flag *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, []string, error) {
+	s, collection, pred := golisp.Car(args), golisp.Cadr(args), golisp.Caddr(args)
+	if fn, ok := completionFunction(collection, env); ok {
+		r, err := golisp.ApplyWithoutEval(fn, golisp.ArrayToList([]*golisp.Data{s, pred, flag}), env)
+		return r, nil, err
 	}
-	t.period = p
-	t.nextFire = time.Now().Add(time.Duration(p * float64(time.Second)))
-	return golisp.FloatWithValue(period), nil
+	names, err := completions(golisp.StringValue(s), collection, pred, env)
+	return nil, names, err
 }
 
-func (rt *runtimeState) gamegridAddScoreImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	file := featureName(golisp.Car(args))
-	score := golisp.IntegerValue(golisp.Cadr(args))
-	rt.scores[file] = append(rt.scores[file], score)
-	line := fmt.Sprintf("%d\t%d\n", time.Now().Unix(), score)
-	if f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600); err == nil {
-		_, _ = f.WriteString(line)
-		_ = f.Close()
+func tryCompletionImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	r, names, err := completionArgs(args, golisp.EmptyCons(), env)
+	if err != nil || r != nil {
+		return r, err
 	}
-	return golisp.IntegerWithValue(score), nil
+	return tryCompletion(golisp.StringValue(golisp.Car(args)), names, completionIgnoreCase(env)), nil
 }
 
-func (rt *runtimeState) gamegridSetCellImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	x := int(golisp.IntegerValue(golisp.Car(args)))
-	y := int(golisp.IntegerValue(golisp.Cadr(args)))
-	v := golisp.Caddr(args)
-	if rt.gridWidth > 0 && rt.gridHeight > 0 && (x < 0 || y < 0 || x >= rt.gridWidth || y >= rt.gridHeight) {
-		rt.warnOnce(fmt.Sprintf("cell-oob-%d-%d", x, y), "gamegrid-set-cell out of bounds: x=%d y=%d size=%dx%d", x, y, rt.gridWidth, rt.gridHeight)
+func allCompletionsImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	r, names, err := completionArgs(args, golisp.BooleanWithValue(true), env)
+	if err != nil || r != nil {
+		return r, err
 	}
-	rt.grid[[2]int{x, y}] = v
-	return v, nil
+	return stringList(names), nil
 }
 
-func (rt *runtimeState) gamegridGetCellImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	x := int(golisp.IntegerValue(golisp.Car(args)))
-	y := int(golisp.IntegerValue(golisp.Cadr(args)))
-	if v, ok := rt.grid[[2]int{x, y}]; ok {
-		return v, nil
+func testCompletionImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	r, names, err := completionArgs(args, golisp.Intern("lambda"), env)
+	if err != nil || r != nil {
+		return r, err
 	}
-	return rt.gridDefault, nil
+	fold := completionIgnoreCase(env)
+	s := golisp.StringValue(golisp.Car(args))
+	return golisp.BooleanWithValue(slices.ContainsFunc(names, func(n string) bool {
+		return n == s || fold && strings.EqualFold(n, s)
+	})), nil
 }
 
-func setqImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	if golisp.Length(args)%2 != 0 {
-		return nil, errors.New("setq expects an even number of forms")
+// minibuffer is a question asked on the bottom line of the screen. The
+// answer is typed into buf, a buffer of its own, while the caller waits
+// in readMinibuffer.
+type minibuffer struct {
+	prompt string
+	buf    *elBuffer
+	// readKey makes the next key the answer, as y-or-n-p wants.
+	readKey bool
+	key     keyEvent
+	done    bool
+	quit    bool
+	// table is what the input completes against, for completing-read,
+	// and candidates are its completions, listed above the prompt.
+	table      *completionTable
+	candidates []string
+	// note is shown after the input until the next key, as "[No match]".
+	note string
+	// deadline, when set, ends the wait with no answer.
+	deadline time.Time
+}
+
+// completionTable is the COLLECTION, PREDICATE and REQUIRE-MATCH of
+// completing-read.
+type completionTable struct {
+	collection, pred, requireMatch *golisp.Data
+}
+
+func (rt *runtimeState) activeMinibuffer() *minibuffer {
+	if n := len(rt.minibuffers); n > 0 {
+		return rt.minibuffers[n-1]
 	}
-	result := golisp.EmptyCons()
-	for c := args; golisp.NotNilP(c); c = golisp.Cddr(c) {
-		sym := golisp.Car(c)
-		if !golisp.SymbolP(sym) {
-			return nil, fmt.Errorf("setq target must be a symbol, got %s", golisp.String(sym))
-		}
-		value, err := golisp.Eval(golisp.Cadr(c), env)
-		if err != nil {
-			return nil, err
-		}
-		if _, err := env.SetTo(sym, value); err != nil {
-			if _, bindErr := env.BindTo(sym, value); bindErr != nil {
-				return nil, bindErr
-			}
+	return nil
+}
+
+// newMinibuffer sets up a minibuffer holding initial, with the history
+// in hist, a symbol, for M-p and M-n.
+func (rt *runtimeState) newMinibuffer(prompt, initial string, hist *golisp.Data) *minibuffer {
+	name := fmt.Sprintf(" *Minibuf-%d*", len(rt.minibuffers)+1)
+	delete(rt.buffers, name)
+	buf := rt.ensureBuffer(name)
+	buf.locals["buffer-undo-list"] = golisp.EmptyCons()
+	if golisp.SymbolP(hist) && golisp.NotNilP(hist) {
+		if v, ok := rt.boundValue(hist); ok {
+			buf.locals["input-ring"] = v
 		}
-		result = value
 	}
-	return result, nil
+	buf.inputMarker()
+	buf.insertText(0, []rune(initial))
+	return &minibuffer{prompt: prompt, buf: buf}
 }
 
-func defunImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	params := golisp.Cadr(args)
-	body := golisp.Cddr(args)
-	if golisp.NilP(body) {
-		body = golisp.ArrayToList([]*golisp.Data{golisp.EmptyCons()})
+// readMinibuffer waits for mb to be answered while the game loop goes
+// on. C-g signals quit.
+func (rt *runtimeState) readMinibuffer(mb *minibuffer, env *golisp.SymbolTableFrame) error {
+	rt.minibuffers = append(rt.minibuffers, mb)
+	defer func() {
+		rt.minibuffers = rt.minibuffers[:len(rt.minibuffers)-1]
+		delete(rt.buffers, mb.buf.name)
+	}()
+	done := func() bool {
+		return mb.done || !mb.deadline.IsZero() && time.Now().After(mb.deadline)
 	}
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("defun name must be a symbol, got %s", golisp.String(name))
+	if rt.runFrames(done, env) {
+		return killEmacs{status: rt.exitStatus}
 	}
-	if hasElispArgMarkers(params) {
-		fn := makeElispDefunWithOptional(name, params, body, env)
-		_, err := env.BindLocallyTo(name, fn)
-		rtGlobal.registerFunction(golisp.StringValue(name), fn)
-		return fn, err
+	if mb.quit {
+		return raise(elSignal{condition: "quit"})
 	}
-	fn := golisp.FunctionWithNameParamsBodyAndParent(golisp.StringValue(name), params, body, env)
-	_, err := env.BindLocallyTo(name, fn)
-	rtGlobal.registerFunction(golisp.StringValue(name), fn)
-	return fn, err
+	return nil
 }
 
-func hasElispArgMarkers(params *golisp.Data) bool {
-	for c := params; golisp.NotNilP(c); c = golisp.Cdr(c) {
-		p := golisp.Car(c)
-		if golisp.SymbolP(p) {
-			n := golisp.StringValue(p)
-			if n == "&optional" || n == "&rest" {
-				return true
-			}
-		}
+// minibufferKey answers or edits the innermost minibuffer.
+func (rt *runtimeState) minibufferKey(mb *minibuffer, key keyEvent, env *golisp.SymbolTableFrame) {
+	note := mb.note
+	mb.note = ""
+	switch {
+	case key == 7: // C-g
+		mb.quit, mb.done = true, true
+		return
+	case mb.readKey:
+		mb.key, mb.done = key, true
+		return
 	}
-	return false
+	orig := rt.currentBuffer()
+	rt.setCurrentBuffer(mb.buf)
+	defer rt.setCurrentBuffer(orig)
+	if key == 10 || key == 13 {
+		mb.done = rt.minibufferCanExit(mb, note == "[Confirm]", env)
+		return
+	}
+	rt.commandUndoBoundary(key)
+	rt.editText(mb.buf, key, env)
+	rt.updateCandidates(mb, env)
 }
 
-type elispParamSpec struct {
-	required []*golisp.Data
-	optional []*golisp.Data
-	rest     *golisp.Data
+// setInput replaces the input of mb with s.
+func (mb *minibuffer) setInput(s string) {
+	mb.buf.deleteText(0, len(mb.buf.text))
+	mb.buf.insertText(0, []rune(s))
+	mb.buf.point = len(mb.buf.text)
 }
 
-func parseElispParamSpec(params *golisp.Data) (elispParamSpec, error) {
-	spec := elispParamSpec{}
-	mode := "required"
-	for c := params; golisp.NotNilP(c); c = golisp.Cdr(c) {
-		p := golisp.Car(c)
-		if !golisp.SymbolP(p) {
-			return spec, fmt.Errorf("defun parameter must be symbol, got %s", golisp.String(p))
-		}
-		name := golisp.StringValue(p)
-		switch name {
-		case "&optional":
-			mode = "optional"
-			continue
-		case "&rest":
-			mode = "rest"
-			continue
-		}
-		switch mode {
-		case "required":
-			spec.required = append(spec.required, p)
-		case "optional":
-			spec.optional = append(spec.optional, p)
-		case "rest":
-			spec.rest = p
-			mode = "after-rest"
-		default:
-			return spec, fmt.Errorf("unexpected parameter after &rest: %s", name)
+// complete runs f, one of the completion functions, on the input of mb.
+func (mb *minibuffer) complete(f func(*golisp.Data, *golisp.SymbolTableFrame) (*golisp.Data, error), env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := mb.table
+	return f(golisp.ArrayToList([]*golisp.Data{golisp.StringWithValue(string(mb.buf.text)), t.collection, t.pred}), env)
+}
+
+// updateCandidates lists the completions of the input of mb.
+func (rt *runtimeState) updateCandidates(mb *minibuffer, env *golisp.SymbolTableFrame) {
+	if mb.table == nil {
+		return
+	}
+	mb.candidates = nil
+	all, err := mb.complete(allCompletionsImpl, env)
+	if err != nil {
+		rt.warnf("completion: %v", err)
+		return
+	}
+	for c := all; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+		mb.candidates = append(mb.candidates, featureName(golisp.Car(c)))
+	}
+	slices.Sort(mb.candidates)
+	mb.candidates = slices.Compact(mb.candidates)
+}
+
+// completeMinibuffer is TAB in a minibuffer: the input grows to what the
+// candidates share, with a note when there is nothing more to add.
+func (rt *runtimeState) completeMinibuffer(mb *minibuffer, env *golisp.SymbolTableFrame) error {
+	if mb.table == nil {
+		return nil
+	}
+	r, err := mb.complete(tryCompletionImpl, env)
+	if err != nil {
+		return err
+	}
+	switch {
+	case golisp.NilP(r):
+		mb.note = "[No match]"
+	case golisp.StringP(r) && golisp.StringValue(r) != string(mb.buf.text):
+		mb.setInput(golisp.StringValue(r))
+	case golisp.StringP(r):
+		if exact, _ := mb.complete(testCompletionImpl, env); golisp.BooleanValue(exact) {
+			mb.note = "[Complete, but not unique]"
 		}
+	default:
+		mb.note = "[Sole completion]"
 	}
-	return spec, nil
+	rt.updateCandidates(mb, env)
+	return nil
 }
 
-func makeElispDefunWithOptional(name, params, body *golisp.Data, parent *golisp.SymbolTableFrame) *golisp.Data {
-	fnName := golisp.StringValue(name)
-	pf := &golisp.PrimitiveFunction{
-		Name:            fnName,
-		Special:         false,
-		ArgRestrictions: []golisp.ArgRestriction{{Type: golisp.ARGS_ANY}},
-		IsRestricted:    false,
-		Body: func(args *golisp.Data, callEnv *golisp.SymbolTableFrame) (*golisp.Data, error) {
-			spec, err := parseElispParamSpec(params)
-			if err != nil {
-				return nil, err
-			}
-			local := golisp.NewSymbolTableFrameBelow(parent, fnName)
-			local.Previous = callEnv
-			argArr := golisp.ToArray(args)
-			if len(argArr) < len(spec.required) {
-				return nil, fmt.Errorf("%s expected at least %d parameters, received %d", fnName, len(spec.required), len(argArr))
-			}
-			idx := 0
-			for _, s := range spec.required {
-				if _, err := local.BindLocallyTo(s, argArr[idx]); err != nil {
-					return nil, err
-				}
-				idx++
-			}
-			for _, s := range spec.optional {
-				v := golisp.EmptyCons()
-				if idx < len(argArr) {
-					v = argArr[idx]
-					idx++
-				}
-				if _, err := local.BindLocallyTo(s, v); err != nil {
-					return nil, err
-				}
-			}
-			if spec.rest != nil {
-				rest := golisp.EmptyCons()
-				if idx < len(argArr) {
-					rest = golisp.ArrayToList(argArr[idx:])
-				}
-				if _, err := local.BindLocallyTo(spec.rest, rest); err != nil {
-					return nil, err
-				}
-				idx = len(argArr)
+// minibufferCanExit applies REQUIRE-MATCH when RET is typed. Input that
+// does not match is completed first, as minibuffer-complete-and-exit
+// does; confirm and confirm-after-completion take a second RET instead
+// of a match.
+func (rt *runtimeState) minibufferCanExit(mb *minibuffer, confirmed bool, env *golisp.SymbolTableFrame) bool {
+	t := mb.table
+	if t == nil || golisp.NilP(t.requireMatch) || len(mb.buf.text) == 0 {
+		return true
+	}
+	if exact, _ := mb.complete(testCompletionImpl, env); golisp.BooleanValue(exact) {
+		return true
+	}
+	if golisp.SymbolP(t.requireMatch) && strings.HasPrefix(golisp.StringValue(t.requireMatch), "confirm") {
+		if confirmed {
+			return true
+		}
+		mb.note = "[Confirm]"
+		return false
+	}
+	if r, _ := mb.complete(tryCompletionImpl, env); golisp.StringP(r) && golisp.StringValue(r) != string(mb.buf.text) {
+		mb.setInput(golisp.StringValue(r))
+		rt.updateCandidates(mb, env)
+		if exact, _ := mb.complete(testCompletionImpl, env); golisp.BooleanValue(exact) {
+			return true
+		}
+	}
+	mb.note = "[No match]"
+	return false
+}
+
+// drawMinibuffer shows the innermost minibuffer on row y, scrolled so
+// that point, drawn in inverse video, is in view.
+func (rt *runtimeState) drawMinibuffer(c *screen, y, w uint) {
+	mb := rt.activeMinibuffer()
+	st := rt.faceStyleFor(golisp.EmptyCons())
+	prompt := []rune(mb.prompt)
+	text := append(slices.Clone(prompt), mb.buf.text...)
+	point := len(prompt) + mb.buf.point
+	if mb.readKey {
+		point = len(text)
+	}
+	if mb.note != "" {
+		text = append(text, []rune(" "+mb.note)...)
+	}
+	rt.drawCandidates(c, mb.candidates, y, w)
+	start := max(point-int(w)+1, 0)
+	for x := 0; x < int(w); x++ {
+		r := ' '
+		if start+x < len(text) {
+			r = text[start+x]
+		}
+		cell := st
+		if start+x == point {
+			cell.inverse = !cell.inverse
+		}
+		c.WriteStyled(uint(x), y, cell, r)
+	}
+}
+
+// drawCandidates lists completion candidates in columns on the rows
+// above row y, using up to a third of the screen.
+func (rt *runtimeState) drawCandidates(c *screen, names []string, y, w uint) {
+	if len(names) == 0 || y == 0 {
+		return
+	}
+	st := rt.faceStyleFor(golisp.EmptyCons())
+	width := 0
+	for _, n := range names {
+		width = max(width, utf8.RuneCountInString(n)+2)
+	}
+	cols := max(int(w)/width, 1)
+	rows := (len(names) + cols - 1) / cols
+	_, h := c.Size()
+	rows = min(rows, max(int(h)/3, 1), int(y))
+	for row := range rows {
+		line := make([]rune, w)
+		for i := range line {
+			line[i] = ' '
+		}
+		for col := range cols {
+			i := row*cols + col
+			if i >= len(names) {
+				break
 			}
-			if idx < len(argArr) {
-				return nil, fmt.Errorf("%s expected %d parameters, received %d", fnName, idx, len(argArr))
+			name := names[i]
+			if row == rows-1 && col == cols-1 && i < len(names)-1 {
+				name = "..."
 			}
-			return evalLetBody(body, local)
-		},
+			copy(line[col*width:], []rune(name))
+		}
+		for x, r := range line {
+			c.WriteStyled(uint(x), y-uint(rows-row), st, r)
+		}
 	}
-	return golisp.PrimitiveWithNameAndFunc(fnName, pf)
 }
 
-func defsubstImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	if golisp.Length(args) < 2 {
-		return nil, errors.New("defsubst expects at least name and arglist")
+// readFromMinibuffer asks for a line of input. In batch mode, as in
+// Emacs, the prompt goes to stdout and the line comes from stdin; with
+// no terminal to ask on, initial is the answer.
+func (rt *runtimeState) readFromMinibuffer(prompt, initial string, hist *golisp.Data, table *completionTable, env *golisp.SymbolTableFrame) (string, error) {
+	if rt.batch {
+		fmt.Print(prompt)
+		if rt.stdin == nil {
+			rt.stdin = bufio.NewReader(os.Stdin)
+		}
+		line, err := rt.stdin.ReadString('\n')
+		if err != nil && line == "" {
+			return "", errors.New("Error reading from stdin")
+		}
+		return strings.TrimRight(line, "\r\n"), nil
 	}
-	if golisp.NilP(golisp.Cddr(args)) {
-		args = golisp.Append(args, golisp.ArrayToList([]*golisp.Data{golisp.EmptyCons()}))
+	if rt.loop == nil {
+		return initial, nil
 	}
-	return defunImpl(args, env)
+	mb := rt.newMinibuffer(prompt, initial, hist)
+	mb.table = table
+	rt.updateCandidates(mb, env)
+	if err := rt.readMinibuffer(mb, env); err != nil {
+		return "", err
+	}
+	answer := string(mb.buf.text)
+	rt.addToHistory(hist, answer)
+	return answer, nil
 }
 
-func defmacroImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	params := golisp.Cadr(args)
-	body := golisp.Cddr(args)
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("defmacro name must be a symbol, got %s", golisp.String(name))
+// addToHistory puts answer at the front of the history list in the
+// variable hist, unless it is empty or already there.
+func (rt *runtimeState) addToHistory(hist *golisp.Data, answer string) {
+	if !golisp.SymbolP(hist) || golisp.NilP(hist) || answer == "" {
+		return
 	}
-	var macroBody *golisp.Data
-	switch golisp.Length(body) {
-	case 0:
-		macroBody = golisp.EmptyCons()
-	case 1:
-		macroBody = golisp.Car(body)
-	default:
-		macroBody = golisp.Cons(golisp.Intern("begin"), body)
+	l, _ := rt.boundValue(hist)
+	if !golisp.PairP(l) {
+		l = golisp.EmptyCons()
+	}
+	if golisp.NotNilP(l) && golisp.StringP(golisp.Car(l)) && golisp.StringValue(golisp.Car(l)) == answer {
+		return
+	}
+	l = golisp.Cons(golisp.StringWithValue(answer), l)
+	if _, err := rt.env.SetTo(hist, l); err != nil {
+		_, _ = golisp.Global.BindTo(hist, l)
 	}
-	m := golisp.MacroWithNameParamsBodyAndParent(golisp.StringValue(name), params, macroBody, env)
-	_, err := env.BindLocallyTo(name, m)
-	return m, err
 }
 
-func deffaceImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("defface target must be a symbol, got %s", golisp.String(name))
+// minibufferHistory returns the history variable of a HIST argument,
+// which may also be (SYMBOL . POSITION).
+func minibufferHistory(hist *golisp.Data) *golisp.Data {
+	if golisp.PairP(hist) && golisp.NotNilP(hist) {
+		hist = golisp.Car(hist)
 	}
-	if _, err := env.BindLocallyTo(name, name); err != nil {
+	if golisp.NilP(hist) {
+		return golisp.Intern("minibuffer-history")
+	}
+	return hist
+}
+
+// minibufferDefault returns the first of DEFAULT-VALUE, which may be a
+// list of defaults.
+func minibufferDefault(def *golisp.Data) *golisp.Data {
+	if golisp.PairP(def) && golisp.NotNilP(def) {
+		return golisp.Car(def)
+	}
+	return def
+}
+
+// initialInput returns the text of INITIAL-INPUT, which may also be
+// (STRING . POSITION).
+func initialInput(d *golisp.Data) string {
+	if golisp.PairP(d) && golisp.NotNilP(d) {
+		d = golisp.Car(d)
+	}
+	if golisp.StringP(d) {
+		return golisp.StringValue(d)
+	}
+	return ""
+}
+
+func (rt *runtimeState) readStringImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	answer, err := rt.readFromMinibuffer(featureName(golisp.Car(args)), initialInput(golisp.Cadr(args)), minibufferHistory(golisp.Caddr(args)), nil, env)
+	if err != nil {
 		return nil, err
 	}
-	return name, nil
+	if def := minibufferDefault(golisp.Nth(args, 4)); answer == "" && golisp.StringP(def) {
+		return def, nil
+	}
+	return golisp.StringWithValue(answer), nil
 }
 
-func defaliasImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	if golisp.PairP(name) && golisp.StringValue(golisp.Car(name)) == "quote" {
-		name = golisp.Cadr(name)
+// readFromMinibufferImpl is read-from-minibuffer. KEYMAP is not used;
+// with READ the answer is read as a lisp object.
+func (rt *runtimeState) readFromMinibufferImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	answer, err := rt.readFromMinibuffer(featureName(golisp.Car(args)), initialInput(golisp.Cadr(args)), minibufferHistory(golisp.Nth(args, 5)), nil, env)
+	if err != nil {
+		return nil, err
 	}
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("defalias target must be a symbol, got %s", golisp.String(name))
+	if !golisp.BooleanValue(golisp.Nth(args, 4)) {
+		return golisp.StringWithValue(answer), nil
 	}
-	valueExpr := golisp.Cadr(args)
-	if golisp.PairP(valueExpr) && golisp.StringValue(golisp.Car(valueExpr)) == "quote" {
-		valueExpr = golisp.Cadr(valueExpr)
+	if def := minibufferDefault(golisp.Nth(args, 6)); strings.TrimSpace(answer) == "" && golisp.StringP(def) {
+		answer = golisp.StringValue(def)
 	}
-	v, err := golisp.Eval(valueExpr, env)
+	// READ only parses: the first datum of the answer is returned as it
+	// is, with nothing in it evaluated.
+	src, err := preprocessElisp(answer)
 	if err != nil {
 		return nil, err
 	}
-	_, err = env.BindLocallyTo(name, v)
-	return name, err
+	data, err := golisp.ParseAll(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("End of file during parsing")
+	}
+	return materializeLiteral(data[0]), nil
 }
 
-func defvarImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("defvar target must be a symbol, got %s", golisp.String(name))
+// completingReadImpl is completing-read: TAB completes the input
+// against COLLECTION and the candidates are listed above the prompt.
+func (rt *runtimeState) completingReadImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	table := &completionTable{collection: golisp.Cadr(args), pred: golisp.Caddr(args), requireMatch: golisp.Nth(args, 4)}
+	answer, err := rt.readFromMinibuffer(featureName(golisp.Car(args)), initialInput(golisp.Nth(args, 5)), minibufferHistory(golisp.Nth(args, 6)), table, env)
+	if err != nil {
+		return nil, err
 	}
-	value := golisp.EmptyCons()
-	if golisp.NotNilP(golisp.Cdr(args)) {
-		v, err := golisp.Eval(golisp.Cadr(args), env)
+	if answer == "" {
+		if def := minibufferDefault(golisp.Nth(args, 7)); golisp.StringP(def) {
+			return def, nil
+		}
+	}
+	return golisp.StringWithValue(answer), nil
+}
+
+// readNumberImpl asks until what is typed reads as a number.
+func (rt *runtimeState) readNumberImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	prompt, def := featureName(golisp.Car(args)), minibufferDefault(golisp.Cadr(args))
+	if golisp.NumberP(def) {
+		d := fmt.Sprintf(" (default %s)", golisp.String(def))
+		if base := strings.TrimRight(prompt, " \t"); strings.HasSuffix(base, ":") {
+			prompt = base[:len(base)-1] + d + prompt[len(base)-1:]
+		} else {
+			prompt += d
+		}
+	}
+	ask := prompt
+	for {
+		answer, err := rt.readFromMinibuffer(ask, "", minibufferHistory(golisp.Caddr(args)), nil, env)
 		if err != nil {
 			return nil, err
 		}
-		value = v
+		answer = strings.TrimSpace(answer)
+		if answer == "" && golisp.NumberP(def) {
+			return def, nil
+		}
+		if n, err := strconv.ParseInt(answer, 10, 64); err == nil {
+			return golisp.IntegerWithValue(n), nil
+		}
+		if f, err := strconv.ParseFloat(answer, 32); err == nil {
+			return golisp.FloatWithValue(float32(f)), nil
+		}
+		ask = "Please enter a number.  " + prompt
 	}
-	if _, err := env.BindLocallyTo(name, value); err != nil {
+}
+
+// event returns k as an Emacs input event: a character with Emacs
+// modifier bits, or a symbol such as C-right for a named key.
+func (k keyEvent) event() *golisp.Data {
+	if keyNames[k&^keyModifiers] != "" {
+		return golisp.Intern(strings.NewReplacer("<", "", ">", "").Replace(k.String()))
+	}
+	n := int64(k &^ keyModifiers)
+	for _, m := range emacsModifiers {
+		if m.key != 0 && k&m.key != 0 {
+			n |= int64(m.bit)
+		}
+	}
+	return golisp.IntegerWithValue(n)
+}
+
+// readKeyFromMinibuffer shows prompt and waits for one key, for at most
+// seconds when that is positive. It returns nil on timeout. In batch
+// mode the key is the next character of stdin.
+func (rt *runtimeState) readKeyFromMinibuffer(prompt string, seconds float64, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if rt.batch {
+		fmt.Print(prompt)
+		if rt.stdin == nil {
+			rt.stdin = bufio.NewReader(os.Stdin)
+		}
+		r, _, err := rt.stdin.ReadRune()
+		if err != nil {
+			return nil, errors.New("Error reading from stdin")
+		}
+		return golisp.IntegerWithValue(int64(r)), nil
+	}
+	if rt.loop == nil {
+		return nil, errors.New("No terminal to read a key from")
+	}
+	mb := rt.newMinibuffer(prompt, "", golisp.EmptyCons())
+	mb.readKey = true
+	if seconds > 0 {
+		mb.deadline = time.Now().Add(time.Duration(seconds * float64(time.Second)))
+	}
+	if err := rt.readMinibuffer(mb, env); err != nil {
 		return nil, err
 	}
-	return name, nil
+	if !mb.done {
+		return golisp.EmptyCons(), nil
+	}
+	return mb.key.event(), nil
 }
 
-func defvarKeymapImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("defvar-keymap target must be a symbol, got %s", golisp.String(name))
+// readCharImpl is read-char: PROMPT, INHERIT-INPUT-METHOD and SECONDS.
+func (rt *runtimeState) readCharImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	var seconds float64
+	if n := golisp.Caddr(args); golisp.NumberP(n) {
+		seconds = float64(golisp.FloatValue(n))
 	}
-	km := newKeymap()
-	full := false
-	for c := golisp.Cdr(args); golisp.NotNilP(c); {
-		k := golisp.Car(c)
-		c = golisp.Cdr(c)
-		if golisp.SymbolP(k) && strings.HasPrefix(golisp.StringValue(k), ":") {
-			if golisp.StringValue(k) == ":full" && golisp.NotNilP(c) && golisp.NotNilP(golisp.Car(c)) {
-				full = true
-			}
-			if golisp.NotNilP(c) {
-				c = golisp.Cdr(c)
+	ev, err := rt.readKeyFromMinibuffer(featureName(golisp.Car(args)), seconds, env)
+	if err != nil {
+		return nil, err
+	}
+	if golisp.SymbolP(ev) {
+		return nil, errors.New("Non-character input-event")
+	}
+	return ev, nil
+}
+
+// readCharChoiceImpl asks until one of CHARS is typed.
+func (rt *runtimeState) readCharChoiceImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	prompt := featureName(golisp.Car(args))
+	for {
+		ev, err := rt.readKeyFromMinibuffer(prompt, 0, env)
+		if err != nil {
+			return nil, err
+		}
+		for c := golisp.Cadr(args); golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+			if golisp.IntegerP(ev) && golisp.IntegerP(golisp.Car(c)) && golisp.IntegerValue(ev) == golisp.IntegerValue(golisp.Car(c)) {
+				return ev, nil
 			}
-			continue
 		}
-		if golisp.NilP(c) {
-			break
+	}
+}
+
+func (rt *runtimeState) readKeyImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.readKeyFromMinibuffer(featureName(golisp.Car(args)), 0, env)
+}
+
+// yOrNPImpl asks for y or n, as a single key on the terminal or a line
+// in batch mode.
+func (rt *runtimeState) yOrNPImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if !rt.batch && rt.loop == nil {
+		return golisp.BooleanWithValue(true), nil
+	}
+	prompt := featureName(golisp.Car(args)) + "(y or n) "
+	ask := prompt
+	for {
+		var key keyEvent
+		if rt.batch {
+			line, err := rt.readFromMinibuffer(ask, "", golisp.EmptyCons(), nil, env)
+			if err != nil {
+				return nil, err
+			}
+			if line = strings.TrimSpace(line); line != "" {
+				key = keyEvent(line[0])
+			}
+		} else {
+			mb := rt.newMinibuffer(ask, "", golisp.EmptyCons())
+			mb.readKey = true
+			if err := rt.readMinibuffer(mb, env); err != nil {
+				return nil, err
+			}
+			key = mb.key
 		}
-		v := golisp.Car(c)
-		c = golisp.Cdr(c)
-		key := keySpecString(k, env)
-		if key == "" {
-			continue
+		switch key {
+		case 'y', 'Y', ' ':
+			return golisp.BooleanWithValue(true), nil
+		case 'n', 'N', 127:
+			return golisp.BooleanWithValue(false), nil
 		}
-		km.bindings[key] = v
+		ask = "Please answer y or n.  " + prompt
+	}
+}
+
+// yesOrNoPImpl asks for "yes" or "no" typed out in full.
+func (rt *runtimeState) yesOrNoPImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if !rt.batch && rt.loop == nil {
+		return golisp.BooleanWithValue(true), nil
+	}
+	prompt := featureName(golisp.Car(args)) + "(yes or no) "
+	ask := prompt
+	for {
+		answer, err := rt.readFromMinibuffer(ask, "", golisp.Intern("yes-or-no-p-history"), nil, env)
+		if err != nil {
+			return nil, err
+		}
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "yes":
+			return golisp.BooleanWithValue(true), nil
+		case "no":
+			return golisp.BooleanWithValue(false), nil
+		}
+		ask = "Please answer yes or no.  " + prompt
+	}
+}
+
+func (rt *runtimeState) userErrorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	msg := "user-error"
+	if golisp.NotNilP(args) {
+		if golisp.StringP(golisp.Car(args)) {
+			formatted, err := formatImpl(args, env)
+			if err != nil {
+				return nil, err
+			}
+			msg = golisp.StringValue(formatted)
+		} else {
+			msg = golisp.String(golisp.Car(args))
+		}
+	}
+	return nil, fmt.Errorf("%s", msg)
+}
+
+func (rt *runtimeState) gamegridInitImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	rt.gridDisplay = golisp.Car(args)
+	rt.gridGlyphs = nil
+	if v := asElVector(rt.gridDisplay); v != nil {
+		rt.gridGlyphs = make([]gridGlyph, len(v.items))
+		for c, spec := range v.items {
+			rt.gridGlyphs[c] = rt.resolveGridGlyph(c, spec)
+		}
+	}
+	return rt.gridDisplay, nil
+}
+
+func (rt *runtimeState) gamegridInitBufferImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	width := int(golisp.IntegerValue(golisp.Car(args)))
+	height := int(golisp.IntegerValue(golisp.Cadr(args)))
+	fill := golisp.Caddr(args)
+	rt.gridWidth = width
+	rt.gridHeight = height
+	rt.gridDefault = fill
+	rt.gridBuffer = rt.currentBuffer()
+	rt.grid = make(map[[2]int]*golisp.Data, width*height)
+	for y := range height {
+		for x := range width {
+			rt.grid[[2]int{x, y}] = fill
+		}
+	}
+	return fill, nil
+}
+
+func (rt *runtimeState) gamegridKillTimerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	delete(rt.timers, "gamegrid")
+	return golisp.EmptyCons(), nil
+}
+
+func (rt *runtimeState) gamegridStartTimerImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	period := golisp.FloatValue(golisp.Car(args))
+	callback := golisp.Cadr(args)
+	p := float64(period)
+	if p <= 0 {
+		p = 0.1
+	}
+	rt.timers["gamegrid"] = &elTimer{period: p, callback: callback, active: true, nextFire: time.Now().Add(time.Duration(p * float64(time.Second)))}
+	return callback, nil
+}
+
+func (rt *runtimeState) gamegridSetTimerImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	period := golisp.FloatValue(golisp.Car(args))
+	t := rt.timers["gamegrid"]
+	if t == nil {
+		t = &elTimer{active: true}
+		rt.timers["gamegrid"] = t
+	}
+	p := float64(period)
+	if p <= 0 {
+		p = 0.1
+	}
+	t.period = p
+	t.nextFire = time.Now().Add(time.Duration(p * float64(time.Second)))
+	return golisp.FloatWithValue(period), nil
+}
+
+// gamegridAddScoreImpl works like gamegrid-add-score-insecure: it adds a
+// "score<TAB>date<TAB>user <email>" line, keeps the best
+// gamegrid-score-file-length entries sorted and shows the table.
+func (rt *runtimeState) gamegridAddScoreImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	file := featureName(golisp.Car(args))
+	score := golisp.IntegerValue(golisp.Cadr(args))
+	reverse := golisp.BooleanValue(golisp.Caddr(args))
+	keep := 50
+	if n := env.ValueOf(golisp.Intern("gamegrid-score-file-length")); golisp.IntegerP(n) {
+		keep = int(golisp.IntegerValue(n))
+	}
+	line := fmt.Sprintf("%05d\t%s\t%s <%s>", score, time.Now().Format("Mon Jan _2 15:04:05 2006"),
+		userFullName(), userMailAddress(env))
+	var lastErr error
+	for _, path := range scoreFileCandidates(file, env) {
+		lines, err := updateScoreFile(path, line, reverse, keep)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		rt.showScoreBuffer(path, lines, line)
+		return golisp.IntegerWithValue(score), nil
+	}
+	if lastErr != nil {
+		rt.warnf("gamegrid-add-score %s: %v", file, lastErr)
+	}
+	return golisp.IntegerWithValue(score), nil
+}
+
+// scoreFileCandidates lists where FILE may be written, best first: an
+// absolute FILE as is, an existing file in shared-game-score-directory,
+// then gamegrid-user-score-file-directory (~/.emacs.d/games/).
+func scoreFileCandidates(file string, env *golisp.SymbolTableFrame) []string {
+	if filepath.IsAbs(file) {
+		return []string{file}
+	}
+	var paths []string
+	if shared := env.ValueOf(golisp.Intern("shared-game-score-directory")); golisp.StringP(shared) {
+		p := filepath.Join(expandHome(golisp.StringValue(shared)), file)
+		if _, err := os.Stat(p); err == nil {
+			paths = append(paths, p)
+		}
+	}
+	dir := ""
+	if v := env.ValueOf(golisp.Intern("gamegrid-user-score-file-directory")); golisp.StringP(v) {
+		dir = expandHome(golisp.StringValue(v))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		dir = filepath.Join(home, ".emacs.d", "games")
+	}
+	if dir != "" {
+		paths = append(paths, filepath.Join(dir, file))
+	}
+	return paths
+}
+
+// updateScoreFile merges LINE into the score file at PATH and returns the
+// lines written. Scores sort highest first, or lowest first when REVERSE;
+// equal scores keep their order, so older entries stay ahead.
+func updateScoreFile(path, line string, reverse bool, keep int) ([]string, error) {
+	var lines []string
+	if data, err := os.ReadFile(path); err == nil {
+		for l := range strings.SplitSeq(string(data), "\n") {
+			if strings.TrimSpace(l) != "" {
+				lines = append(lines, l)
+			}
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	lines = append(lines, line)
+	scoreOf := func(l string) int64 {
+		fields := strings.Fields(l)
+		if len(fields) == 0 {
+			return 0
+		}
+		n, _ := strconv.ParseInt(fields[0], 10, 64)
+		return n
+	}
+	sort.SliceStable(lines, func(i, j int) bool {
+		if reverse {
+			return scoreOf(lines[i]) < scoreOf(lines[j])
+		}
+		return scoreOf(lines[i]) > scoreOf(lines[j])
+	})
+	if keep > 0 && len(lines) > keep {
+		lines = lines[:keep]
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		return nil, err
+	}
+	return lines, nil
+}
+
+// showScoreBuffer displays the score table in place of the game, with
+// point on the new entry, the way gamegrid pops up the score file.
+func (rt *runtimeState) showScoreBuffer(path string, lines []string, added string) {
+	buf := rt.ensureBuffer(filepath.Base(path))
+	// Like erase-buffer: a reused table keeps no properties of the old one.
+	buf.widen()
+	buf.deleteText(0, len(buf.text))
+	buf.insertText(0, []rune(strings.Join(lines, "\n")+"\n"))
+	buf.point = 0
+	offset := 0
+	for _, l := range lines {
+		if l == added {
+			buf.point = offset
+			break
+		}
+		offset += utf8.RuneCountInString(l) + 1
+	}
+	rt.scoreBuffer = buf
+	rt.setCurrentBuffer(buf)
+}
+
+func expandHome(p string) string {
+	if after, ok := strings.CutPrefix(p, "~"); ok && (after == "" || after[0] == '/') {
+		if home, err := os.UserHomeDir(); err == nil {
+			return home + after
+		}
+	}
+	return p
+}
+
+// userFullName follows Emacs: $NAME, then the passwd entry.
+func userFullName() string {
+	if name := os.Getenv("NAME"); name != "" {
+		return name
+	}
+	if u, err := user.Current(); err == nil && u.Name != "" {
+		return u.Name
+	}
+	return userLoginName()
+}
+
+func userLoginName() string {
+	for _, v := range []string{"LOGNAME", "USER"} {
+		if name := os.Getenv(v); name != "" {
+			return name
+		}
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// userMailAddress is user-mail-address, $EMAIL or login@host.
+func userMailAddress(env *golisp.SymbolTableFrame) string {
+	if v := env.ValueOf(golisp.Intern("user-mail-address")); golisp.StringP(v) && golisp.StringValue(v) != "" {
+		return golisp.StringValue(v)
+	}
+	if mail := os.Getenv("EMAIL"); mail != "" {
+		return mail
+	}
+	host, _ := os.Hostname()
+	return userLoginName() + "@" + host
+}
+
+func userFullNameImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.StringWithValue(userFullName()), nil
+}
+
+func userLoginNameImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.StringWithValue(userLoginName()), nil
+}
+
+func (rt *runtimeState) gamegridSetCellImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	x := int(golisp.IntegerValue(golisp.Car(args)))
+	y := int(golisp.IntegerValue(golisp.Cadr(args)))
+	v := golisp.Caddr(args)
+	if rt.gridWidth > 0 && rt.gridHeight > 0 && (x < 0 || y < 0 || x >= rt.gridWidth || y >= rt.gridHeight) {
+		rt.warnOnce(fmt.Sprintf("cell-oob-%d-%d", x, y), "gamegrid-set-cell out of bounds: x=%d y=%d size=%dx%d", x, y, rt.gridWidth, rt.gridHeight)
+	}
+	rt.grid[[2]int{x, y}] = v
+	return v, nil
+}
+
+func (rt *runtimeState) gamegridGetCellImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	x := int(golisp.IntegerValue(golisp.Car(args)))
+	y := int(golisp.IntegerValue(golisp.Cadr(args)))
+	if v, ok := rt.grid[[2]int{x, y}]; ok {
+		return v, nil
+	}
+	return rt.gridDefault, nil
+}
+
+func setqImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if golisp.Length(args)%2 != 0 {
+		return nil, errors.New("setq expects an even number of forms")
+	}
+	result := golisp.EmptyCons()
+	for c := args; golisp.NotNilP(c); c = golisp.Cddr(c) {
+		sym := golisp.Car(c)
+		if !golisp.SymbolP(sym) {
+			return nil, fmt.Errorf("setq target must be a symbol, got %s", golisp.String(sym))
+		}
+		value, err := golisp.Eval(golisp.Cadr(c), env)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := env.SetTo(sym, value); err != nil {
+			// As in Emacs, setting an unbound variable creates a global
+			// binding, even from inside a function or hook.
+			global := env
+			if rtGlobal != nil && rtGlobal.env != nil {
+				global = rtGlobal.env
+			}
+			if _, bindErr := global.BindTo(sym, value); bindErr != nil {
+				return nil, bindErr
+			}
+		}
+		result = value
+	}
+	return result, nil
+}
+
+func defunImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	params := golisp.Cadr(args)
+	body := golisp.Cddr(args)
+	if golisp.NilP(body) {
+		body = golisp.ArrayToList([]*golisp.Data{golisp.EmptyCons()})
+	}
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defun name must be a symbol, got %s", golisp.String(name))
+	}
+	if hasElispArgMarkers(params) {
+		fn := makeElispDefunWithOptional(name, params, body, env)
+		_, err := env.BindLocallyTo(name, fn)
+		rtGlobal.registerFunction(golisp.StringValue(name), fn)
+		return fn, err
+	}
+	fn := golisp.FunctionWithNameParamsBodyAndParent(golisp.StringValue(name), params, body, env)
+	_, err := env.BindLocallyTo(name, fn)
+	rtGlobal.registerFunction(golisp.StringValue(name), fn)
+	return fn, err
+}
+
+func hasElispArgMarkers(params *golisp.Data) bool {
+	for c := params; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		p := golisp.Car(c)
+		if golisp.SymbolP(p) {
+			n := golisp.StringValue(p)
+			if n == "&optional" || n == "&rest" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type elispParamSpec struct {
+	required []*golisp.Data
+	optional []*golisp.Data
+	rest     *golisp.Data
+}
+
+func parseElispParamSpec(params *golisp.Data) (elispParamSpec, error) {
+	spec := elispParamSpec{}
+	mode := "required"
+	for c := params; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		p := golisp.Car(c)
+		if !golisp.SymbolP(p) {
+			return spec, fmt.Errorf("defun parameter must be symbol, got %s", golisp.String(p))
+		}
+		name := golisp.StringValue(p)
+		switch name {
+		case "&optional":
+			mode = "optional"
+			continue
+		case "&rest":
+			mode = "rest"
+			continue
+		}
+		switch mode {
+		case "required":
+			spec.required = append(spec.required, p)
+		case "optional":
+			spec.optional = append(spec.optional, p)
+		case "rest":
+			spec.rest = p
+			mode = "after-rest"
+		default:
+			return spec, fmt.Errorf("unexpected parameter after &rest: %s", name)
+		}
+	}
+	return spec, nil
+}
+
+func makeElispDefunWithOptional(name, params, body *golisp.Data, parent *golisp.SymbolTableFrame) *golisp.Data {
+	fnName := golisp.StringValue(name)
+	pf := &golisp.PrimitiveFunction{
+		Name:            fnName,
+		Special:         false,
+		ArgRestrictions: []golisp.ArgRestriction{{Type: golisp.ARGS_ANY}},
+		IsRestricted:    false,
+		Body: func(args *golisp.Data, callEnv *golisp.SymbolTableFrame) (*golisp.Data, error) {
+			spec, err := parseElispParamSpec(params)
+			if err != nil {
+				return nil, err
+			}
+			local := golisp.NewSymbolTableFrameBelow(parent, fnName)
+			local.Previous = callEnv
+			argArr := golisp.ToArray(args)
+			if len(argArr) < len(spec.required) {
+				return nil, fmt.Errorf("%s expected at least %d parameters, received %d", fnName, len(spec.required), len(argArr))
+			}
+			idx := 0
+			for _, s := range spec.required {
+				if _, err := local.BindLocallyTo(s, argArr[idx]); err != nil {
+					return nil, err
+				}
+				idx++
+			}
+			for _, s := range spec.optional {
+				v := golisp.EmptyCons()
+				if idx < len(argArr) {
+					v = argArr[idx]
+					idx++
+				}
+				if _, err := local.BindLocallyTo(s, v); err != nil {
+					return nil, err
+				}
+			}
+			if spec.rest != nil {
+				rest := golisp.EmptyCons()
+				if idx < len(argArr) {
+					rest = golisp.ArrayToList(argArr[idx:])
+				}
+				if _, err := local.BindLocallyTo(spec.rest, rest); err != nil {
+					return nil, err
+				}
+				idx = len(argArr)
+			}
+			if idx < len(argArr) {
+				return nil, fmt.Errorf("%s expected %d parameters, received %d", fnName, idx, len(argArr))
+			}
+			return evalLetBody(body, local)
+		},
+	}
+	return golisp.PrimitiveWithNameAndFunc(fnName, pf)
+}
+
+func defsubstImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if golisp.Length(args) < 2 {
+		return nil, errors.New("defsubst expects at least name and arglist")
+	}
+	if golisp.NilP(golisp.Cddr(args)) {
+		args = golisp.Append(args, golisp.ArrayToList([]*golisp.Data{golisp.EmptyCons()}))
+	}
+	return defunImpl(args, env)
+}
+
+func defmacroImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	params := golisp.Cadr(args)
+	body := golisp.Cddr(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defmacro name must be a symbol, got %s", golisp.String(name))
+	}
+	var macroBody *golisp.Data
+	switch golisp.Length(body) {
+	case 0:
+		macroBody = golisp.EmptyCons()
+	case 1:
+		macroBody = golisp.Car(body)
+	default:
+		macroBody = golisp.Cons(golisp.Intern("begin"), body)
+	}
+	m := golisp.MacroWithNameParamsBodyAndParent(golisp.StringValue(name), params, macroBody, env)
+	_, err := env.BindLocallyTo(name, m)
+	return m, err
+}
+
+func defaliasImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if golisp.PairP(name) && golisp.StringValue(golisp.Car(name)) == "quote" {
+		name = golisp.Cadr(name)
+	}
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defalias target must be a symbol, got %s", golisp.String(name))
+	}
+	valueExpr := golisp.Cadr(args)
+	if golisp.PairP(valueExpr) && golisp.StringValue(golisp.Car(valueExpr)) == "quote" {
+		valueExpr = golisp.Cadr(valueExpr)
+	}
+	v, err := golisp.Eval(valueExpr, env)
+	if err != nil {
+		return nil, err
+	}
+	_, err = env.BindLocallyTo(name, v)
+	return name, err
+}
+
+// defvarImpl leaves an existing value alone, so a setq in the init file
+// survives the game's own defvar or defcustom.
+func defvarImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defvar target must be a symbol, got %s", golisp.String(name))
+	}
+	if b, ok := env.FindBindingFor(name); ok && !golisp.FunctionOrPrimitiveP(b.Val) {
+		return name, nil
+	}
+	return defconstImpl(args, env)
+}
+
+// defcustomImpl records the standard value and the :type, :group, :set,
+// :initialize and :options keywords as symbol properties, then lets the
+// :initialize function (custom-initialize-reset by default) set the value.
+func (rt *runtimeState) defcustomImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defcustom target must be a symbol, got %s", golisp.String(name))
+	}
+	sym := golisp.StringValue(name)
+	exp := golisp.Cadr(args)
+	props := rt.propsFor(sym)
+	props["standard-value"] = golisp.ArrayToList([]*golisp.Data{exp})
+	props["custom-group"] = golisp.EmptyCons()
+	if rt.currentGroup != "" {
+		props["custom-group"] = golisp.Intern(rt.currentGroup)
+	}
+	rest := golisp.Cddr(args)
+	if golisp.StringP(golisp.Car(rest)) {
+		props["variable-documentation"] = golisp.Car(rest)
+		rest = golisp.Cdr(rest)
+	}
+	for ; golisp.NotNilP(rest) && golisp.NotNilP(golisp.Cdr(rest)); rest = golisp.Cddr(rest) {
+		v, err := golisp.Eval(golisp.Cadr(rest), env)
+		if err != nil {
+			return nil, err
+		}
+		switch key := featureName(golisp.Car(rest)); key {
+		case ":type", ":set", ":initialize", ":options", ":group":
+			props["custom-"+strings.TrimPrefix(key, ":")] = v
+		}
+	}
+	if group := featureName(props["custom-group"]); group != "" {
+		members := rt.propsFor(group)
+		entry := golisp.ArrayToList([]*golisp.Data{name, golisp.Intern("custom-variable")})
+		members["custom-group"] = golisp.ArrayToList(append(golisp.ToArray(members["custom-group"]), entry))
+	}
+	init := props["custom-initialize"]
+	if golisp.NilP(init) {
+		init = golisp.Intern("custom-initialize-reset")
+	}
+	if golisp.SymbolP(init) {
+		init = env.ValueOf(init)
+	}
+	if !golisp.FunctionOrPrimitiveP(init) {
+		return nil, fmt.Errorf("defcustom %s: invalid :initialize function", sym)
+	}
+	if _, err := golisp.ApplyWithoutEval(init, golisp.ArrayToList([]*golisp.Data{name, exp}), env); err != nil {
+		return nil, err
+	}
+	return name, nil
+}
+
+func (rt *runtimeState) propsFor(sym string) map[string]*golisp.Data {
+	props, ok := rt.symbolProps[sym]
+	if !ok {
+		props = make(map[string]*golisp.Data)
+		rt.symbolProps[sym] = props
+	}
+	return props
+}
+
+// boundValue returns the value of a variable that is bound to something
+// other than a function, which in golisp shares the namespace.
+func (rt *runtimeState) boundValue(sym *golisp.Data) (*golisp.Data, bool) {
+	b, ok := rt.env.FindBindingFor(sym)
+	if !ok || golisp.FunctionOrPrimitiveP(b.Val) {
+		return nil, false
+	}
+	return b.Val, true
+}
+
+func (rt *runtimeState) setDefaultImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sym, v := golisp.Car(args), golisp.Cadr(args)
+	if !golisp.SymbolP(sym) {
+		return nil, fmt.Errorf("set-default expects symbol as first argument, got %s", golisp.String(sym))
+	}
+	if _, err := rt.env.SetTo(sym, v); err != nil {
+		if _, err := rt.env.BindTo(sym, v); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// customSet stores VALUE through the variable's :set function, falling back
+// to set-default.
+func (rt *runtimeState) customSet(sym, value *golisp.Data) error {
+	setter := rt.propsFor(golisp.StringValue(sym))["custom-set"]
+	if golisp.SymbolP(setter) {
+		setter = rt.env.ValueOf(setter)
+	}
+	args := golisp.ArrayToList([]*golisp.Data{sym, value})
+	if !golisp.FunctionOrPrimitiveP(setter) {
+		_, err := rt.setDefaultImpl(args, rt.env)
+		return err
+	}
+	_, err := golisp.ApplyWithoutEval(setter, args, rt.env)
+	return err
+}
+
+func (rt *runtimeState) customInitializeDefaultImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sym := golisp.Car(args)
+	if _, ok := rt.boundValue(sym); ok {
+		return golisp.EmptyCons(), nil
+	}
+	v, err := golisp.Eval(golisp.Cadr(args), rt.env)
+	if err != nil {
+		return nil, err
+	}
+	return rt.setDefaultImpl(golisp.ArrayToList([]*golisp.Data{sym, v}), rt.env)
+}
+
+func (rt *runtimeState) customInitializeSetImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sym := golisp.Car(args)
+	if _, ok := rt.boundValue(sym); ok {
+		return golisp.EmptyCons(), nil
+	}
+	v, err := golisp.Eval(golisp.Cadr(args), rt.env)
+	if err != nil {
+		return nil, err
+	}
+	return golisp.EmptyCons(), rt.customSet(sym, v)
+}
+
+// customInitializeResetImpl passes the current value, such as one set in
+// the init file or custom.el, or else the standard value through :set.
+func (rt *runtimeState) customInitializeResetImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sym := golisp.Car(args)
+	v, ok := rt.boundValue(sym)
+	if !ok {
+		var err error
+		if v, err = golisp.Eval(golisp.Cadr(args), rt.env); err != nil {
+			return nil, err
+		}
+	}
+	return golisp.EmptyCons(), rt.customSet(sym, v)
+}
+
+func (rt *runtimeState) customInitializeChangedImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if v, ok := rt.boundValue(golisp.Car(args)); ok {
+		return golisp.EmptyCons(), rt.customSet(golisp.Car(args), v)
+	}
+	return rt.customInitializeDefaultImpl(args, env)
+}
+
+// customSetVariablesImpl handles the (custom-set-variables '(VAR EXP) ...)
+// form written to custom.el.
+func (rt *runtimeState) customSetVariablesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	for c := args; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		entry := golisp.Car(c)
+		sym, exp := golisp.Car(entry), golisp.Cadr(entry)
+		if !golisp.SymbolP(sym) {
+			continue
+		}
+		rt.propsFor(golisp.StringValue(sym))["saved-value"] = golisp.ArrayToList([]*golisp.Data{exp})
+		v, err := golisp.Eval(exp, rt.env)
+		if err != nil {
+			rt.warnf("custom-set-variables %s: %v", golisp.StringValue(sym), err)
+			continue
+		}
+		if err := rt.customSet(sym, v); err != nil {
+			rt.warnf("custom-set-variables %s: %v", golisp.StringValue(sym), err)
+		}
+	}
+	return golisp.EmptyCons(), nil
+}
+
+func (rt *runtimeState) customizeSetVariableImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sym, value := golisp.Car(args), golisp.Cadr(args)
+	if !golisp.SymbolP(sym) {
+		return nil, fmt.Errorf("customize-set-variable expects a symbol, got %s", golisp.String(sym))
+	}
+	if err := rt.customSet(sym, value); err != nil {
+		return nil, err
+	}
+	rt.propsFor(golisp.StringValue(sym))["customized-value"] = golisp.ArrayToList([]*golisp.Data{customQuote(value)})
+	return value, nil
+}
+
+// customizeSaveVariableImpl sets the variable and rewrites the custom file
+// so the value is restored on the next start.
+func (rt *runtimeState) customizeSaveVariableImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	value, err := rt.customizeSetVariableImpl(args, env)
+	if err != nil {
+		return nil, err
+	}
+	props := rt.propsFor(golisp.StringValue(golisp.Car(args)))
+	props["saved-value"] = props["customized-value"]
+	delete(props, "customized-value")
+	if err := rt.saveCustomFile(); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// customQuote turns VALUE into an expression that evaluates to it.
+func customQuote(value *golisp.Data) *golisp.Data {
+	switch {
+	case golisp.NilP(value), golisp.BooleanP(value), golisp.NumberP(value), golisp.StringP(value):
+		return value
+	}
+	return golisp.ArrayToList([]*golisp.Data{golisp.Intern("quote"), value})
+}
+
+// customFilePath is the value of custom-file, or custom.el next to the
+// XDG init file.
+func (rt *runtimeState) customFilePath() string {
+	if v := rt.env.ValueOf(golisp.Intern("custom-file")); golisp.StringP(v) && golisp.StringValue(v) != "" {
+		return golisp.StringValue(v)
+	}
+	if dir := userConfigDir(); dir != "" {
+		return filepath.Join(dir, "runmacs", "custom.el")
+	}
+	return ""
+}
+
+func (rt *runtimeState) loadCustomFile() {
+	path := rt.customFilePath()
+	if path == "" {
+		return
+	}
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if err := rt.loadElispFile(path); err != nil {
+		rt.warnf("error in custom file %s: %v", path, err)
+	}
+}
+
+// saveCustomFile writes every variable with a saved-value, keeping the
+// entries of an existing file that were not loaded in this session.
+func (rt *runtimeState) saveCustomFile() error {
+	path := rt.customFilePath()
+	if path == "" {
+		return errors.New("customize-save-variable: no custom-file")
+	}
+	saved := readSavedCustomizations(path)
+	for sym, props := range rt.symbolProps {
+		if v, ok := props["saved-value"]; ok && golisp.NotNilP(v) {
+			saved[sym] = golisp.Car(v)
+		}
+	}
+	names := make([]string, 0, len(saved))
+	for sym := range saved {
+		names = append(names, sym)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString(";; Written by runmacs customize-save-variable; edit with care.\n")
+	b.WriteString("(custom-set-variables")
+	for _, sym := range names {
+		fmt.Fprintf(&b, "\n '(%s %s)", sym, prin1String(saved[sym]))
+	}
+	b.WriteString(")\n")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(b.String()), 0o644)
+}
+
+// readSavedCustomizations parses the custom-set-variables forms of PATH
+// without evaluating them.
+func readSavedCustomizations(path string) map[string]*golisp.Data {
+	saved := make(map[string]*golisp.Data)
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return saved
+	}
+	preprocessed, err := preprocessElisp(string(source))
+	if err != nil {
+		return saved
+	}
+	forms, err := golisp.ParseAll(preprocessed)
+	if err != nil {
+		return saved
+	}
+	for _, form := range forms {
+		if featureName(golisp.Car(form)) != "custom-set-variables" {
+			continue
+		}
+		for c := golisp.Cdr(form); golisp.NotNilP(c); c = golisp.Cdr(c) {
+			// Each entry is '(VAR EXP ...), that is (quote (VAR EXP ...)).
+			entry := golisp.Cadr(golisp.Car(c))
+			if golisp.SymbolP(golisp.Car(entry)) {
+				saved[golisp.StringValue(golisp.Car(entry))] = golisp.Cadr(entry)
+			}
+		}
+	}
+	return saved
+}
+
+func defconstImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defconst target must be a symbol, got %s", golisp.String(name))
+	}
+	value := golisp.EmptyCons()
+	if golisp.NotNilP(golisp.Cdr(args)) {
+		v, err := golisp.Eval(golisp.Cadr(args), env)
+		if err != nil {
+			return nil, err
+		}
+		value = v
+	}
+	if _, err := env.BindLocallyTo(name, value); err != nil {
+		return nil, err
+	}
+	return name, nil
+}
+
+func defvarKeymapImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defvar-keymap target must be a symbol, got %s", golisp.String(name))
+	}
+	km := newKeymap()
+	full := false
+	for c := golisp.Cdr(args); golisp.NotNilP(c); {
+		k := golisp.Car(c)
+		c = golisp.Cdr(c)
+		if golisp.SymbolP(k) && strings.HasPrefix(golisp.StringValue(k), ":") {
+			if golisp.StringValue(k) == ":full" && golisp.NotNilP(c) && golisp.NotNilP(golisp.Car(c)) {
+				full = true
+			}
+			if golisp.NotNilP(c) {
+				c = golisp.Cdr(c)
+			}
+			continue
+		}
+		if golisp.NilP(c) {
+			break
+		}
+		v := golisp.Car(c)
+		c = golisp.Cdr(c)
+		keys := keySequence(k, true, env)
+		if len(keys) == 0 {
+			continue
+		}
+		if err := km.define(keys, v, env); err != nil {
+			return nil, err
+		}
+	}
+	if full {
+		items := make([]*golisp.Data, 256)
+		for i := range items {
+			items[i] = golisp.EmptyCons()
+		}
+		km.fullMap = newElVector(items)
+	}
+	_, err := env.BindLocallyTo(name, keymapObject(km))
+	return name, err
+}
+
+func newKeymap() *elKeymap {
+	return &elKeymap{bindings: make(map[string]*golisp.Data)}
+}
+
+func keymapObject(km *elKeymap) *golisp.Data {
+	return golisp.ObjectWithTypeAndValue("el-keymap", unsafe.Pointer(km))
+}
+
+func isKeymap(d *golisp.Data) bool {
+	return golisp.ObjectP(d) && golisp.ObjectType(d) == "el-keymap"
+}
+
+func asKeymap(d *golisp.Data) *elKeymap {
+	return (*elKeymap)(golisp.ObjectValue(d))
+}
+
+// emacsModifiers are the modifier bits of Emacs character events, their
+// prefixes in key names and the keyEvent bits for them. No terminal
+// key carries Alt or Hyper.
+var emacsModifiers = []struct {
+	prefix string
+	bit    int
+	key    keyEvent
+}{
+	{"A-", 1 << 22, 0}, {"C-", 1 << 26, keyControl}, {"H-", 1 << 24, 0},
+	{"M-", 1 << 27, keyMeta}, {"S-", 1 << 25, keyShift}, {"s-", 1 << 23, keySuper},
+}
+
+// kbdSpecialKeys are the names kbd gives characters that have no glyph
+// of their own.
+var kbdSpecialKeys = map[string]int{"NUL": 0, "TAB": 9, "LFD": 10, "RET": 13, "ESC": 27, "SPC": 32, "DEL": 127}
+
+// keySequence splits a key sequence into the names of its keys, the
+// strings keymaps are indexed by. A string is a sequence of characters,
+// or, with kbd set, of words in kbd syntax such as "C-c C-n"; a vector
+// holds characters and symbols such as left.
+func keySequence(d *golisp.Data, kbd bool, env *golisp.SymbolTableFrame) []string {
+	var events []*golisp.Data
+	switch {
+	case golisp.StringP(d) && kbd:
+		events = kbdEvents(golisp.StringValue(d))
+	case golisp.StringP(d):
+		for _, r := range golisp.StringValue(d) {
+			events = append(events, golisp.IntegerWithValue(int64(r)))
+		}
+	case golisp.SymbolP(d) && env != nil && golisp.StringP(env.ValueOf(d)):
+		// A variable holding the key, as pong-pause-key.
+		return keySequence(env.ValueOf(d), kbd, env)
+	case isElVector(d):
+		events = asElVector(d).items
+	default:
+		events = []*golisp.Data{d}
+	}
+	var keys []string
+	for _, ev := range events {
+		name := eventKeyName(ev)
+		if name == "" {
+			return nil
+		}
+		keys = append(keys, name)
+	}
+	return keys
+}
+
+// kbdEvents reads keys in kbd syntax as Emacs input events: characters,
+// with modifier bits where they are not control characters, and symbols
+// for named keys.
+func kbdEvents(s string) []*golisp.Data {
+	var events []*golisp.Data
+	for _, word := range strings.Fields(s) {
+		mods, base := 0, word
+		for len(base) > 2 && base[1] == '-' && strings.IndexByte("ACHMSs", base[0]) >= 0 {
+			for _, m := range emacsModifiers {
+				if m.prefix == base[:2] {
+					mods |= m.bit
+				}
+			}
+			base = base[2:]
+		}
+		if name, ok := strings.CutPrefix(base, "<"); ok && strings.HasSuffix(name, ">") && len(name) > 1 {
+			prefix := word[:len(word)-len(base)]
+			events = append(events, golisp.Intern(prefix+strings.TrimSuffix(name, ">")))
+			continue
+		}
+		c, ok := kbdSpecialKeys[base]
+		if !ok {
+			r := []rune(base)
+			if mods == 0 && len(r) > 1 {
+				for _, c := range r {
+					events = append(events, golisp.IntegerWithValue(int64(c)))
+				}
+				continue
+			}
+			c = int(r[0])
+		}
+		if ctrl := 1 << 26; mods&ctrl != 0 {
+			switch {
+			case c >= 'a' && c <= 'z', c >= '@' && c <= '_':
+				c, mods = c&31, mods&^ctrl
+			case c == '?':
+				c, mods = 127, mods&^ctrl
+			}
+		}
+		events = append(events, golisp.IntegerWithValue(int64(c|mods)))
+	}
+	return events
+}
+
+// eventKeyName returns the name keymaps use for an input event, as
+// "C-c", "M-x" or "<left>".
+func eventKeyName(ev *golisp.Data) string {
+	switch {
+	case golisp.IntegerP(ev):
+		n := int(golisp.IntegerValue(ev))
+		var k keyEvent
+		mods := ""
+		for _, m := range emacsModifiers {
+			if n&m.bit == 0 {
+				continue
+			}
+			n &^= m.bit
+			if m.key != 0 {
+				k |= m.key
+			} else {
+				mods += m.prefix
+			}
+		}
+		if n < 0 || n > utf8.MaxRune {
+			return ""
+		}
+		return mods + (k | keyEvent(n)).String()
+	case golisp.SymbolP(ev) && golisp.NotNilP(ev):
+		base := golisp.StringValue(ev)
+		var k keyEvent
+		mods := ""
+		for len(base) > 2 && base[1] == '-' && strings.IndexByte("ACHMSs", base[0]) >= 0 {
+			for _, m := range emacsModifiers {
+				if m.prefix != base[:2] {
+					continue
+				}
+				if m.key != 0 {
+					k |= m.key
+				} else {
+					mods += m.prefix
+				}
+			}
+			base = base[2:]
+		}
+		for named, name := range keyNames {
+			if name == base {
+				return mods + (k | named).String()
+			}
+		}
+		return mods + k.modifierPrefix() + "<" + base + ">"
+	default:
+		return ""
+	}
+}
+
+func makeSparseKeymapImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return keymapObject(newKeymap()), nil
+}
+
+func defineKeyImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return defineKey(args, false, env)
+}
+
+// keymapSetImpl is keymap-set, whose keys are in kbd syntax.
+func keymapSetImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return defineKey(args, true, env)
+}
+
+func defineKey(args *golisp.Data, kbd bool, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m := golisp.Car(args)
+	var mSym *golisp.Data
+	if golisp.SymbolP(m) {
+		mSym = m
+	} else if golisp.PairP(m) && golisp.SymbolP(golisp.Car(m)) && golisp.StringValue(golisp.Car(m)) == "quote" {
+		q := golisp.Cadr(m)
+		if golisp.SymbolP(q) {
+			mSym = q
+			m = q
+		}
+	}
+	k := golisp.Cadr(args)
+	def := golisp.Caddr(args)
+	if golisp.SymbolP(m) {
+		m = env.ValueOf(m)
+	}
+	if golisp.NilP(m) && mSym != nil {
+		m = keymapObject(newKeymap())
+		if _, err := env.BindTo(mSym, m); err != nil {
+			if _, err2 := env.BindLocallyTo(mSym, m); err2 != nil {
+				return nil, err2
+			}
+		}
+	}
+	if !isKeymap(m) {
+		m = keymapObject(newKeymap())
+		if mSym != nil {
+			if _, err := env.BindTo(mSym, m); err != nil {
+				_, _ = env.BindLocallyTo(mSym, m)
+			}
+		}
+	}
+	keys := keySequence(k, kbd, env)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("define-key unsupported key spec: %s", golisp.String(k))
+	}
+	km := asKeymap(m)
+	if err := km.define(keys, def, env); err != nil {
+		return nil, err
+	}
+	if km.fullMap != nil && len(keys) == 1 {
+		if c := []rune(featureName(k)); golisp.StringP(k) && len(c) == 1 && c[0] < 256 || golisp.IntegerP(k) && golisp.IntegerValue(k) < 256 {
+			code := golisp.IntegerValue(k)
+			if golisp.StringP(k) {
+				code = int64(c[0])
+			}
+			_, _ = asetImpl(golisp.ArrayToList([]*golisp.Data{
+				km.fullMap,
+				golisp.IntegerWithValue(code),
+				def,
+			}), env)
+		}
+	}
+	return def, nil
+}
+
+// define binds the key sequence keys to def, making prefix keymaps for
+// all but the last key as needed.
+func (km *elKeymap) define(keys []string, def *golisp.Data, env *golisp.SymbolTableFrame) error {
+	for i, k := range keys[:len(keys)-1] {
+		b, ok := km.bindings[k]
+		if !ok || golisp.NilP(b) {
+			b = keymapObject(newKeymap())
+			km.bindings[k] = b
+		}
+		sub := prefixKeymap(b, env)
+		if sub == nil {
+			return fmt.Errorf("Key sequence %s starts with non-prefix key %s", strings.Join(keys, " "), strings.Join(keys[:i+1], " "))
+		}
+		km = sub
+	}
+	km.bindings[keys[len(keys)-1]] = def
+	return nil
+}
+
+// lookup returns the binding of the key sequence keys, nil if it has
+// none, or the number of keys that form a complete command when the
+// sequence runs past one, as lookup-key does.
+func (km *elKeymap) lookup(keys []string, env *golisp.SymbolTableFrame) *golisp.Data {
+	for i, k := range keys {
+		b, ok := km.bindings[k]
+		if !ok {
+			return golisp.EmptyCons()
+		}
+		if i == len(keys)-1 {
+			if golisp.PairP(b) && golisp.SymbolP(golisp.Car(b)) && golisp.StringValue(golisp.Car(b)) == "quote" {
+				// defvar-keymap keeps the commands as written.
+				return golisp.Cadr(b)
+			}
+			return b
+		}
+		if km = prefixKeymap(b, env); km == nil {
+			return golisp.IntegerWithValue(int64(i + 1))
+		}
+	}
+	return golisp.EmptyCons()
+}
+
+func lookupKey(args *golisp.Data, kbd bool, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m := golisp.Car(args)
+	if !isKeymap(m) {
+		return nil, fmt.Errorf("Wrong type argument: keymapp, %s", golisp.String(m))
+	}
+	keys := keySequence(golisp.Cadr(args), kbd, env)
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("Invalid key: %s", golisp.String(golisp.Cadr(args)))
+	}
+	return asKeymap(m).lookup(keys, env), nil
+}
+
+func lookupKeyImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return lookupKey(args, false, env)
+}
+
+func keymapLookupImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return lookupKey(args, true, env)
+}
+
+// prefixKeymap returns the keymap a binding makes its key a prefix of,
+// or nil for a command. The keymap may be the value of a symbol, as
+// ctl-x-map.
+func prefixKeymap(binding *golisp.Data, env *golisp.SymbolTableFrame) *elKeymap {
+	if golisp.PairP(binding) && golisp.SymbolP(golisp.Car(binding)) && golisp.StringValue(golisp.Car(binding)) == "quote" {
+		binding = golisp.Cadr(binding)
+	}
+	if golisp.SymbolP(binding) && golisp.NotNilP(binding) && env != nil {
+		binding = env.ValueOf(binding)
+	}
+	if binding == nil || !isKeymap(binding) {
+		return nil
+	}
+	return asKeymap(binding)
+}
+
+// kbdImpl is kbd: a string when every key is a character, otherwise a
+// vector of events.
+func kbdImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	events := kbdEvents(featureName(golisp.Car(args)))
+	var sb strings.Builder
+	for _, ev := range events {
+		if !golisp.IntegerP(ev) || golisp.IntegerValue(ev) > 127 {
+			return newElVector(events), nil
+		}
+		sb.WriteRune(rune(golisp.IntegerValue(ev)))
+	}
+	return golisp.StringWithValue(sb.String()), nil
+}
+
+func obarrayMakeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	n := max(golisp.IntegerValue(golisp.Car(args)), 0)
+	items := make([]*golisp.Data, int(n))
+	for i := range items {
+		items[i] = golisp.EmptyCons()
+	}
+	return newElVector(items), nil
+}
+
+func expandFileNameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := featureName(golisp.Car(args))
+	if filepath.IsAbs(name) {
+		return golisp.StringWithValue(filepath.Clean(name)), nil
+	}
+	base := ""
+	if golisp.NotNilP(golisp.Cdr(args)) {
+		base = featureName(golisp.Cadr(args))
+	}
+	if base == "" {
+		home, _ := os.UserHomeDir()
+		base = home
+	}
+	return golisp.StringWithValue(filepath.Clean(filepath.Join(base, name))), nil
+}
+
+func substituteInFileNameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := featureName(golisp.Car(args))
+	if strings.HasPrefix(s, "~") {
+		if home, err := os.UserHomeDir(); err == nil {
+			if s == "~" {
+				s = home
+			} else if after, ok := strings.CutPrefix(s, "~/"); ok {
+				s = filepath.Join(home, after)
+			}
+		}
+	}
+	return golisp.StringWithValue(os.ExpandEnv(s)), nil
+}
+
+func executableFindImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := featureName(golisp.Car(args))
+	if name == "" {
+		return golisp.EmptyCons(), nil
+	}
+	p, err := exec.LookPath(name)
+	if err != nil {
+		// Emacs callers often guard with (or (executable-find ..) (error ..)).
+		// Returning NAME keeps optional external tools from hard-failing startup.
+		return golisp.StringWithValue(name), nil
+	}
+	return golisp.StringWithValue(p), nil
+}
+
+func locateUserEmacsFileImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	home, _ := os.UserHomeDir()
+	root := filepath.Join(home, ".emacs.d")
+	name := featureName(golisp.Car(args))
+	if name == "" {
+		return golisp.StringWithValue(root), nil
+	}
+	return golisp.StringWithValue(filepath.Join(root, name)), nil
+}
+
+func defineObsoleteFunctionAliasImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return defaliasImpl(args, env)
+}
+
+func makeObsoleteVariableImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	// Emacs uses this for metadata/warnings; runtime behavior can be a no-op.
+	return golisp.Car(args), nil
+}
+
+func makeObsoleteImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	// Compatibility no-op for obsolete warnings.
+	return golisp.Car(args), nil
+}
+
+func currentTimeImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.IntegerWithValue(time.Now().Unix()), nil
+}
+
+func timeConvertImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	// Minimal compatibility: pass through current-time tuples and numbers.
+	return golisp.Car(args), nil
+}
+
+func timeEqualPImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(golisp.IsEqual(golisp.Car(args), golisp.Cadr(args))), nil
+}
+
+func currentTimeStringImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.StringWithValue(time.Now().Format("Mon Jan _2 15:04:05 2006")), nil
+}
+
+func defineErrorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("define-error expects symbol, got %s", golisp.String(name))
+	}
+	parent := "error"
+	if golisp.NotNilP(golisp.Cddr(args)) && golisp.SymbolP(golisp.Caddr(args)) {
+		parent = golisp.StringValue(golisp.Caddr(args))
+	}
+	if rtGlobal != nil {
+		rtGlobal.errorParents[golisp.StringValue(name)] = parent
+	}
+	_, _ = env.BindTo(name, name)
+	return name, nil
+}
+
+func forceModeLineUpdateImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(true), nil
+}
+
+func fsetImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sym := golisp.Car(args)
+	if golisp.PairP(sym) && golisp.SymbolP(golisp.Car(sym)) && golisp.StringValue(golisp.Car(sym)) == "quote" {
+		sym = golisp.Cadr(sym)
+	}
+	if !golisp.SymbolP(sym) {
+		return nil, fmt.Errorf("fset expects symbol as first argument, got %s", golisp.String(sym))
+	}
+	valExpr := golisp.Cadr(args)
+	if golisp.PairP(valExpr) && golisp.SymbolP(golisp.Car(valExpr)) && golisp.StringValue(golisp.Car(valExpr)) == "quote" {
+		valExpr = golisp.Cadr(valExpr)
+	}
+	val, err := golisp.Eval(valExpr, env)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := env.SetTo(sym, val); err != nil {
+		if _, err2 := env.BindTo(sym, val); err2 != nil {
+			return nil, err2
+		}
+	}
+	return val, nil
+}
+
+func rplacaImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	cell := golisp.Car(args)
+	val := golisp.Cadr(args)
+	if !golisp.PairP(cell) {
+		return nil, fmt.Errorf("rplaca expects cons cell, got %s", golisp.String(cell))
+	}
+	golisp.ConsValue(cell).Car = val
+	return val, nil
+}
+
+func declareFunctionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if golisp.NotNilP(args) {
+		return golisp.Car(args), nil
+	}
+	return golisp.EmptyCons(), nil
+}
+
+func frameHeightImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.IntegerWithValue(40), nil
+}
+
+func frameWidthImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.IntegerWithValue(120), nil
+}
+
+func windowHeightImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.IntegerWithValue(40), nil
+}
+
+func windowWidthImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.IntegerWithValue(120), nil
+}
+
+func charToStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	c := golisp.Car(args)
+	if golisp.IntegerP(c) {
+		return golisp.StringWithValue(string(rune(golisp.IntegerValue(c)))), nil
+	}
+	if golisp.StringP(c) {
+		return c, nil
+	}
+	return golisp.StringWithValue(golisp.String(c)), nil
+}
+
+func stringToCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := featureName(golisp.Car(args))
+	r := []rune(s)
+	if len(r) == 0 {
+		return golisp.IntegerWithValue(0), nil
+	}
+	return golisp.IntegerWithValue(int64(r[0])), nil
+}
+
+func minImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	best := golisp.Car(args)
+	if !golisp.NumberP(best) {
+		return nil, fmt.Errorf("min expects numbers, got %s", golisp.String(best))
+	}
+	bestF := float64(golisp.FloatValue(best))
+	if golisp.IntegerP(best) {
+		bestF = float64(golisp.IntegerValue(best))
+	}
+	allInt := golisp.IntegerP(best)
+	for c := golisp.Cdr(args); golisp.NotNilP(c); c = golisp.Cdr(c) {
+		v := golisp.Car(c)
+		if !golisp.NumberP(v) {
+			return nil, fmt.Errorf("min expects numbers, got %s", golisp.String(v))
+		}
+		f := float64(golisp.FloatValue(v))
+		if golisp.IntegerP(v) {
+			f = float64(golisp.IntegerValue(v))
+		} else {
+			allInt = false
+		}
+		if f < bestF {
+			bestF = f
+		}
+	}
+	if allInt {
+		return golisp.IntegerWithValue(int64(bestF)), nil
+	}
+	return golisp.FloatWithValue(float32(bestF)), nil
+}
+
+func maxImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	best := golisp.Car(args)
+	if !golisp.NumberP(best) {
+		return nil, fmt.Errorf("max expects numbers, got %s", golisp.String(best))
+	}
+	bestF := float64(golisp.FloatValue(best))
+	if golisp.IntegerP(best) {
+		bestF = float64(golisp.IntegerValue(best))
+	}
+	allInt := golisp.IntegerP(best)
+	for c := golisp.Cdr(args); golisp.NotNilP(c); c = golisp.Cdr(c) {
+		v := golisp.Car(c)
+		if !golisp.NumberP(v) {
+			return nil, fmt.Errorf("max expects numbers, got %s", golisp.String(v))
+		}
+		f := float64(golisp.FloatValue(v))
+		if golisp.IntegerP(v) {
+			f = float64(golisp.IntegerValue(v))
+		} else {
+			allInt = false
+		}
+		if f > bestF {
+			bestF = f
+		}
+	}
+	if allInt {
+		return golisp.IntegerWithValue(int64(bestF)), nil
+	}
+	return golisp.FloatWithValue(float32(bestF)), nil
+}
+
+func absImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	v := golisp.Car(args)
+	switch {
+	case golisp.IntegerP(v):
+		n := golisp.IntegerValue(v)
+		if n < 0 {
+			n = -n
+		}
+		return golisp.IntegerWithValue(n), nil
+	case golisp.FloatP(v):
+		f := float64(golisp.FloatValue(v))
+		if f < 0 {
+			f = -f
+		}
+		return golisp.FloatWithValue(float32(f)), nil
+	default:
+		return golisp.IntegerWithValue(0), nil
+	}
+}
+
+func floorImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	a := golisp.Car(args)
+	num, ok := numberAsFloat(a)
+	if !ok {
+		return golisp.IntegerWithValue(0), nil
+	}
+	if golisp.NotNilP(golisp.Cdr(args)) {
+		b := golisp.Cadr(args)
+		den, ok := numberAsFloat(b)
+		if !ok || den == 0 {
+			return golisp.IntegerWithValue(0), nil
+		}
+		num = num / den
+	}
+	return golisp.IntegerWithValue(int64(math.Floor(num))), nil
+}
+
+func oddpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	v := golisp.Car(args)
+	if !golisp.IntegerP(v) {
+		return golisp.BooleanWithValue(false), nil
+	}
+	return golisp.BooleanWithValue((golisp.IntegerValue(v) % 2) != 0), nil
+}
+
+func evenpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	v := golisp.Car(args)
+	if !golisp.IntegerP(v) {
+		return golisp.BooleanWithValue(false), nil
+	}
+	return golisp.BooleanWithValue((golisp.IntegerValue(v) % 2) == 0), nil
+}
+
+func equalImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(golisp.IsEqual(golisp.Car(args), golisp.Cadr(args))), nil
+}
+
+func numberAsFloat(v *golisp.Data) (float64, bool) {
+	switch {
+	case golisp.IntegerP(v):
+		return float64(golisp.IntegerValue(v)), true
+	case golisp.FloatP(v):
+		return float64(golisp.FloatValue(v)), true
+	default:
+		return 0, false
+	}
+}
+
+func compareChain(args *golisp.Data, cmp func(a, b float64) bool) (*golisp.Data, error) {
+	items := golisp.ToArray(args)
+	if len(items) < 2 {
+		return nil, fmt.Errorf("comparison expects at least 2 arguments")
+	}
+	prev, ok := numberAsFloat(items[0])
+	if !ok {
+		return golisp.BooleanWithValue(false), nil
+	}
+	for i := 1; i < len(items); i++ {
+		cur, ok := numberAsFloat(items[i])
+		if !ok {
+			return golisp.BooleanWithValue(false), nil
+		}
+		if !cmp(prev, cur) {
+			return golisp.BooleanWithValue(false), nil
+		}
+		prev = cur
+	}
+	return golisp.BooleanWithValue(true), nil
+}
+
+func lessImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return compareChain(args, func(a, b float64) bool { return a < b })
+}
+
+func lessEqImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return compareChain(args, func(a, b float64) bool { return a <= b })
+}
+
+func greaterImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return compareChain(args, func(a, b float64) bool { return a > b })
+}
+
+func greaterEqImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return compareChain(args, func(a, b float64) bool { return a >= b })
+}
+
+func setImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := golisp.Car(args)
+	v := golisp.Cadr(args)
+	if !golisp.SymbolP(s) {
+		return nil, fmt.Errorf("set expects symbol as first argument, got %s", golisp.String(s))
+	}
+	if _, err := env.SetTo(s, v); err != nil {
+		if _, err2 := env.BindTo(s, v); err2 != nil {
+			return nil, err2
+		}
+	}
+	return v, nil
+}
+
+func functionpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	v := golisp.Car(args)
+	return golisp.BooleanWithValue(golisp.FunctionOrPrimitiveP(v) || golisp.MacroP(v)), nil
+}
+
+func atomImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(!golisp.PairP(golisp.Car(args))), nil
+}
+
+func listpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	v := golisp.Car(args)
+	return golisp.BooleanWithValue(golisp.NilP(v) || golisp.ListP(v)), nil
+}
+
+func symbolpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(golisp.SymbolP(golisp.Car(args))), nil
+}
+
+func internImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := featureName(golisp.Car(args))
+	if name == "" {
+		return golisp.EmptyCons(), nil
+	}
+	return internKeyword(golisp.Intern(name)), nil
+}
+
+func symbolNameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := golisp.Car(args)
+	if golisp.SymbolP(s) {
+		return golisp.StringWithValue(golisp.StringValue(s)), nil
+	}
+	return golisp.StringWithValue(golisp.String(s)), nil
+}
+
+func stringpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(golisp.StringP(golisp.Car(args))), nil
+}
+
+func symbolValueImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := golisp.Car(args)
+	if !golisp.SymbolP(s) {
+		return nil, fmt.Errorf("symbol-value expects symbol, got %s", golisp.String(s))
+	}
+	return env.ValueOf(s), nil
+}
+
+func symbolFunctionImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := golisp.Car(args)
+	if !golisp.SymbolP(s) {
+		return golisp.EmptyCons(), nil
+	}
+	v := env.ValueOf(s)
+	if golisp.FunctionOrPrimitiveP(v) || golisp.MacroP(v) {
+		return v, nil
+	}
+	return golisp.EmptyCons(), nil
+}
+
+func internSoftImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := featureName(golisp.Car(args))
+	if name == "" {
+		return golisp.EmptyCons(), nil
+	}
+	return golisp.Intern(name), nil
+}
+
+func natnumpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	v := golisp.Car(args)
+	return golisp.BooleanWithValue(golisp.IntegerP(v) && golisp.IntegerValue(v) >= 0), nil
+}
+
+func regexpQuoteImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.StringWithValue(regexp.QuoteMeta(featureName(golisp.Car(args)))), nil
+}
+
+func displayColorPImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(true), nil
+}
+
+func displayImagesPImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(false), nil
+}
+
+func frameVisiblePImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(true), nil
+}
+
+func visibleFrameListImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.ArrayToList([]*golisp.Data{golisp.Intern("frame-0")}), nil
+}
+
+func selectedFrameImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.Intern("frame-0"), nil
+}
+
+func frameSelectedWindowImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rtGlobal.selectedWindow().object, nil
+}
+
+func selectFrameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if golisp.NotNilP(args) {
+		return golisp.Car(args), nil
+	}
+	return selectedFrameImpl(nil, nil)
+}
+
+func windowFrameImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.Intern("frame-0"), nil
+}
+
+func frameParameterImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	param := featureName(golisp.Cadr(args))
+	switch param {
+	case "cursor-type":
+		return golisp.Intern("box"), nil
+	default:
+		return golisp.EmptyCons(), nil
+	}
+}
+
+func frameMonitorAttributesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	// Minimal subset expected by gamegrid: geometry and workarea vectors.
+	geom := golisp.ArrayToList([]*golisp.Data{
+		golisp.IntegerWithValue(0), golisp.IntegerWithValue(0),
+		golisp.IntegerWithValue(1024), golisp.IntegerWithValue(768),
+	})
+	work := golisp.ArrayToList([]*golisp.Data{
+		golisp.IntegerWithValue(0), golisp.IntegerWithValue(0),
+		golisp.IntegerWithValue(1024), golisp.IntegerWithValue(768),
+	})
+	return golisp.ArrayToList([]*golisp.Data{
+		golisp.Cons(golisp.Intern("geometry"), geom),
+		golisp.Cons(golisp.Intern("workarea"), work),
+	}), nil
+}
+
+func windowBodyPixelEdgesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	// left top right bottom
+	return golisp.ArrayToList([]*golisp.Data{
+		golisp.IntegerWithValue(0),
+		golisp.IntegerWithValue(0),
+		golisp.IntegerWithValue(1024),
+		golisp.IntegerWithValue(768),
+	}), nil
+}
+
+func linePixelHeightImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.IntegerWithValue(1), nil
+}
+
+func makeStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	n := int(golisp.IntegerValue(golisp.Car(args)))
+	fill := golisp.Cadr(args)
+	if n < 0 {
+		n = 0
+	}
+	ch := rune(0)
+	if golisp.IntegerP(fill) {
+		ch = rune(golisp.IntegerValue(fill))
+	} else {
+		s := featureName(fill)
+		if s != "" {
+			ch = []rune(s)[0]
+		}
+	}
+	if ch == 0 {
+		ch = ' '
+	}
+	items := make([]*golisp.Data, n)
+	for i := 0; i < n; i++ {
+		items[i] = golisp.IntegerWithValue(int64(ch))
+	}
+	return newElVector(items), nil
+}
+
+func mapcarImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	fn := golisp.Car(args)
+	if golisp.PairP(fn) && golisp.SymbolP(golisp.Car(fn)) && golisp.StringValue(golisp.Car(fn)) == "quote" {
+		fn = golisp.Cadr(fn)
+	}
+	seq := golisp.Cadr(args)
+	out := make([]*golisp.Data, 0)
+	var iterate *golisp.Data
+	switch {
+	case golisp.StringP(seq):
+		rs := []rune(golisp.StringValue(seq))
+		items := make([]*golisp.Data, 0, len(rs))
+		for _, r := range rs {
+			items = append(items, golisp.IntegerWithValue(int64(r)))
+		}
+		iterate = golisp.ArrayToList(items)
+	case golisp.ListP(seq):
+		iterate = seq
+	case isElVector(seq):
+		iterate = golisp.ArrayToList(asElVector(seq).items)
+	default:
+		return golisp.EmptyCons(), nil
+	}
+	for c := iterate; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		item := golisp.Car(c)
+		call := golisp.ArrayToList([]*golisp.Data{fn, item})
+		v, err := rtGlobal.funcallImpl(call, env)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return golisp.ArrayToList(out), nil
+}
+
+func mapcImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	_, err := mapcarImpl(args, env)
+	if err != nil {
+		return nil, err
+	}
+	return golisp.Cadr(args), nil
+}
+
+func nconcImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	acc := make([]*golisp.Data, 0)
+	for c := args; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		v := golisp.Car(c)
+		if golisp.ListP(v) {
+			acc = append(acc, golisp.ToArray(v)...)
+		}
+	}
+	return golisp.ArrayToList(acc), nil
+}
+
+func delqImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	item := golisp.Car(args)
+	seq := golisp.Cadr(args)
+	if !golisp.ListP(seq) {
+		return golisp.EmptyCons(), nil
+	}
+	out := make([]*golisp.Data, 0)
+	for c := seq; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		v := golisp.Car(c)
+		if golisp.IsEqual(v, item) {
+			continue
+		}
+		out = append(out, v)
+	}
+	return golisp.ArrayToList(out), nil
+}
+
+func splitStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := featureName(golisp.Car(args))
+	sep := " "
+	if golisp.NotNilP(golisp.Cdr(args)) {
+		raw := featureName(golisp.Cadr(args))
+		if raw != "" {
+			sep = raw
+		}
+	}
+	parts := strings.Split(s, sep)
+	out := make([]*golisp.Data, 0, len(parts))
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		out = append(out, golisp.StringWithValue(p))
+	}
+	return golisp.ArrayToList(out), nil
+}
+
+func mapconcatImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	fn := golisp.Car(args)
+	seq := golisp.Cadr(args)
+	sep := featureName(golisp.Caddr(args))
+	call := golisp.ArrayToList([]*golisp.Data{fn, seq})
+	mapped, err := mapcarImpl(call, env)
+	if err != nil {
+		return nil, err
+	}
+	parts := make([]string, 0)
+	for c := mapped; golisp.NotNilP(c); c = golisp.Cdr(c) {
+		parts = append(parts, featureName(golisp.Car(c)))
+	}
+	return golisp.StringWithValue(strings.Join(parts, sep)), nil
+}
+
+func downcaseImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.StringWithValue(strings.ToLower(featureName(golisp.Car(args)))), nil
+}
+
+func capitalizeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	s := []rune(strings.ToLower(featureName(golisp.Car(args))))
+	inWord := false
+	for i, r := range s {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			if !inWord && r >= 'a' && r <= 'z' {
+				s[i] = rune(r - 32)
+			}
+			inWord = true
+		} else {
+			inWord = false
+		}
+	}
+	return golisp.StringWithValue(string(s)), nil
+}
+
+func prin1ToStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if golisp.BooleanValue(golisp.Cadr(args)) {
+		return golisp.StringWithValue(princString(golisp.Car(args))), nil
+	}
+	return golisp.StringWithValue(prin1String(golisp.Car(args))), nil
+}
+
+// prin1String renders D the way Emacs prin1 would: nil and t instead of
+// () and #t, escaped strings, [vectors] and #<...> for opaque objects.
+func prin1String(d *golisp.Data) string {
+	var b strings.Builder
+	writePrinted(&b, d, true)
+	return b.String()
+}
+
+// princString is prin1String without quoting strings.
+func princString(d *golisp.Data) string {
+	var b strings.Builder
+	writePrinted(&b, d, false)
+	return b.String()
+}
+
+func writePrinted(b *strings.Builder, d *golisp.Data, escape bool) {
+	switch {
+	case d == nil || golisp.NilP(d):
+		b.WriteString("nil")
+	case golisp.BooleanP(d):
+		if golisp.BooleanValue(d) {
+			b.WriteString("t")
+		} else {
+			b.WriteString("nil")
+		}
+	case golisp.StringP(d):
+		if !escape {
+			b.WriteString(golisp.StringValue(d))
+			return
+		}
+		b.WriteByte('"')
+		for _, r := range golisp.StringValue(d) {
+			if r == '"' || r == '\\' {
+				b.WriteByte('\\')
+			}
+			b.WriteRune(r)
+		}
+		b.WriteByte('"')
+	case golisp.DottedPairP(d):
+		b.WriteByte('(')
+		writePrinted(b, golisp.Car(d), escape)
+		b.WriteString(" . ")
+		writePrinted(b, golisp.Cdr(d), escape)
+		b.WriteByte(')')
+	case golisp.ListP(d):
+		if golisp.SymbolP(golisp.Car(d)) && golisp.StringValue(golisp.Car(d)) == "quote" &&
+			golisp.PairP(golisp.Cdr(d)) && golisp.NilP(golisp.Cddr(d)) {
+			b.WriteByte('\'')
+			writePrinted(b, golisp.Cadr(d), escape)
+			return
+		}
+		b.WriteByte('(')
+		c := d
+		for first := true; golisp.NotNilP(c) && golisp.ListP(c); c = golisp.Cdr(c) {
+			if !first {
+				b.WriteByte(' ')
+			}
+			first = false
+			writePrinted(b, golisp.Car(c), escape)
+		}
+		if golisp.NotNilP(c) {
+			b.WriteString(" . ")
+			writePrinted(b, c, escape)
+		}
+		b.WriteByte(')')
+	case isElVector(d):
+		b.WriteByte('[')
+		for i, item := range asElVector(d).items {
+			if i > 0 {
+				b.WriteByte(' ')
+			}
+			writePrinted(b, item, escape)
+		}
+		b.WriteByte(']')
+	case golisp.ObjectP(d):
+		switch golisp.ObjectType(d) {
+		case "el-buffer":
+			fmt.Fprintf(b, "#<buffer %s>", (*elBuffer)(golisp.ObjectValue(d)).name)
+		case "el-window":
+			w := (*elWindow)(golisp.ObjectValue(d))
+			if w.buffer != nil {
+				fmt.Fprintf(b, "#<window %d on %s>", w.id, w.buffer.name)
+			} else {
+				fmt.Fprintf(b, "#<window %d>", w.id)
+			}
+		case "el-keymap":
+			b.WriteString("#<keymap>")
+		case "el-overlay":
+			o := (*elOverlay)(golisp.ObjectValue(d))
+			if o.buffer != nil {
+				fmt.Fprintf(b, "#<overlay from %d to %d in %s>", o.start+1, o.end+1, o.buffer.name)
+			} else {
+				b.WriteString("#<overlay in no buffer>")
+			}
+		case "el-marker":
+			m := (*elMarker)(golisp.ObjectValue(d))
+			if m.buffer != nil {
+				fmt.Fprintf(b, "#<marker at %d in %s>", m.pos+1, m.buffer.name)
+			} else {
+				b.WriteString("#<marker in no buffer>")
+			}
+		case "el-timer":
+			b.WriteString("#<timer>")
+		case "el-window-configuration":
+			b.WriteString("#<window-configuration>")
+		default:
+			b.WriteString("#<" + golisp.ObjectType(d) + ">")
+		}
+	case golisp.PrimitiveP(d):
+		fmt.Fprintf(b, "#<subr %s>", golisp.PrimitiveValue(d).Name)
+	case golisp.FunctionP(d):
+		fmt.Fprintf(b, "#<function %s>", golisp.FunctionValue(d).Name)
+	case golisp.MacroP(d):
+		fmt.Fprintf(b, "#<macro %s>", golisp.MacroValue(d).Name)
+	default:
+		b.WriteString(golisp.String(d))
+	}
+}
+
+func makeSyntaxTableImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return keymapObject(newKeymap()), nil
+}
+
+func modifySyntaxEntryImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.Car(args), nil
+}
+
+// propInterval gives the text properties of the characters [start, end)
+// of a buffer or string as a plist. Intervals are kept sorted and
+// disjoint, and there are none over text without properties.
+type propInterval struct {
+	start, end int
+	plist      *golisp.Data
+}
+
+// plistGet returns the value prop has in plist.
+func plistGet(plist *golisp.Data, prop string) (*golisp.Data, bool) {
+	for c := plist; golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+		if featureName(golisp.Car(c)) == prop {
+			return golisp.Cadr(c), true
+		}
+	}
+	return golisp.EmptyCons(), false
+}
+
+// plistPut returns plist with prop set to value. plist itself is left
+// alone, since intervals share their plists.
+func plistPut(plist, prop, value *golisp.Data) *golisp.Data {
+	var items []*golisp.Data
+	found := false
+	for c := plist; golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+		v := golisp.Cadr(c)
+		if featureName(golisp.Car(c)) == featureName(prop) {
+			v, found = value, true
+		}
+		items = append(items, golisp.Car(c), v)
+	}
+	if !found {
+		items = append(items, prop, value)
+	}
+	return golisp.ArrayToList(items)
+}
+
+// plistRemove returns plist without prop, leaving plist itself alone.
+func plistRemove(plist *golisp.Data, prop string) *golisp.Data {
+	var items []*golisp.Data
+	for c := plist; golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+		if featureName(golisp.Car(c)) != prop {
+			items = append(items, golisp.Car(c), golisp.Cadr(c))
+		}
+	}
+	return golisp.ArrayToList(items)
+}
+
+func plistEqual(a, b *golisp.Data) bool {
+	if golisp.Length(a) != golisp.Length(b) {
+		return false
+	}
+	for c := a; golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+		v, ok := plistGet(b, featureName(golisp.Car(c)))
+		if !ok || !golisp.IsEqual(v, golisp.Cadr(c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// appendInterval adds iv after the intervals in out, joining it to the
+// last one when they touch and carry the same properties.
+func appendInterval(out []propInterval, iv propInterval) []propInterval {
+	if iv.start >= iv.end || golisp.NilP(iv.plist) {
+		return out
+	}
+	if n := len(out); n > 0 && out[n-1].end == iv.start && plistEqual(out[n-1].plist, iv.plist) {
+		out[n-1].end = iv.end
+		return out
+	}
+	return append(out, iv)
+}
+
+// propsAt returns the plist of the character at pos.
+func propsAt(props []propInterval, pos int) *golisp.Data {
+	i, found := slices.BinarySearchFunc(props, pos, func(iv propInterval, p int) int {
+		switch {
+		case iv.end <= p:
+			return -1
+		case iv.start > p:
+			return 1
+		}
+		return 0
+	})
+	if !found {
+		return golisp.EmptyCons()
+	}
+	return props[i].plist
+}
+
+// modifyProps returns props, which cover text of length n, with the
+// plist of each character in [start, end) replaced by what f returns
+// for it.
+func modifyProps(props []propInterval, n, start, end int, f func(plist *golisp.Data) *golisp.Data) []propInterval {
+	start = min(max(start, 0), n)
+	end = min(max(end, start), n)
+	if start == end {
+		return props
+	}
+	var out []propInterval
+	pos := start
+	for _, iv := range props {
+		if iv.end <= start || iv.start >= end {
+			if iv.start >= end && pos < end {
+				out = appendInterval(out, propInterval{pos, end, f(golisp.EmptyCons())})
+				pos = end
+			}
+			out = appendInterval(out, iv)
+			continue
+		}
+		out = appendInterval(out, propInterval{iv.start, start, iv.plist})
+		s, e := max(iv.start, start), min(iv.end, end)
+		if pos < s {
+			out = appendInterval(out, propInterval{pos, s, f(golisp.EmptyCons())})
+		}
+		out = appendInterval(out, propInterval{s, e, f(iv.plist)})
+		out = appendInterval(out, propInterval{end, iv.end, iv.plist})
+		pos = e
+	}
+	if pos < end {
+		out = appendInterval(out, propInterval{pos, end, f(golisp.EmptyCons())})
+	}
+	return out
+}
+
+// sliceProps returns the intervals of props over [start, end), moved so
+// that start becomes 0.
+func sliceProps(props []propInterval, start, end int) []propInterval {
+	var out []propInterval
+	for _, iv := range props {
+		s, e := max(iv.start, start), min(iv.end, end)
+		if s < e {
+			out = append(out, propInterval{s - start, e - start, iv.plist})
+		}
+	}
+	return out
+}
+
+// pasteProps returns props with the intervals of from laid over the
+// text at offset onwards.
+func pasteProps(props []propInterval, n, offset int, from []propInterval) []propInterval {
+	for _, iv := range from {
+		plist := iv.plist
+		props = modifyProps(props, n, offset+iv.start, offset+iv.end, func(*golisp.Data) *golisp.Data {
+			return plist
+		})
+	}
+	return props
+}
+
+// stringProps holds the text properties of strings, which have no room
+// for them in golisp. An entry is dropped once its string is collected,
+// which happens on the runtime's cleanup goroutine, hence the lock.
+var stringProps = struct {
+	sync.Mutex
+	m map[weak.Pointer[golisp.Data]][]propInterval
+}{m: map[weak.Pointer[golisp.Data]][]propInterval{}}
+
+func stringPropsOf(s *golisp.Data) []propInterval {
+	stringProps.Lock()
+	defer stringProps.Unlock()
+	return stringProps.m[weak.Make(s)]
+}
+
+func setStringProps(s *golisp.Data, props []propInterval) {
+	key := weak.Make(s)
+	stringProps.Lock()
+	defer stringProps.Unlock()
+	if _, ok := stringProps.m[key]; !ok && len(props) > 0 {
+		runtime.AddCleanup(s, func(key weak.Pointer[golisp.Data]) {
+			stringProps.Lock()
+			delete(stringProps.m, key)
+			stringProps.Unlock()
+		}, key)
+	}
+	if len(props) == 0 {
+		delete(stringProps.m, key)
+		return
+	}
+	stringProps.m[key] = props
+}
+
+// stringWithProps makes a string of rs carrying props.
+func stringWithProps(rs []rune, props []propInterval) *golisp.Data {
+	s := golisp.StringWithValue(string(rs))
+	setStringProps(s, props)
+	return s
+}
+
+func (b *elBuffer) propsAt(pos int) *golisp.Data {
+	return propsAt(b.props, pos)
+}
+
+// insertText puts rs at pos. The new text has no properties, and point
+// moves along when it is at or after pos, as it does for insert.
+func (b *elBuffer) insertText(pos int, rs []rune) {
+	pos = min(max(pos, 0), len(b.text))
+	n := len(rs)
+	if n == 0 {
+		return
+	}
+	b.recordInsert(pos, n)
+	b.text = slices.Insert(b.text, pos, rs...)
+	var out []propInterval
+	for _, iv := range b.props {
+		switch {
+		case iv.end <= pos:
+			out = append(out, iv)
+		case iv.start >= pos:
+			out = append(out, propInterval{iv.start + n, iv.end + n, iv.plist})
+		default:
+			out = append(out, propInterval{iv.start, pos, iv.plist}, propInterval{pos + n, iv.end + n, iv.plist})
+		}
+	}
+	b.props = out
+	if b.point >= pos {
+		b.point += n
+	}
+	b.adjustMarkers(func(p int, insertionType bool) int {
+		if p > pos || (p == pos && insertionType) {
+			return p + n
+		}
+		return p
+	})
+	for _, o := range b.overlays {
+		if o.start > pos || (o.start == pos && o.frontAdvance) {
+			o.start += n
+		}
+		if o.end > pos || (o.end == pos && o.rearAdvance) {
+			o.end += n
+		}
+		o.start = min(o.start, o.end)
+	}
+}
+
+// insertTextWithProps is insertText for text that brings props along,
+// such as a propertized string or a piece of another buffer.
+func (b *elBuffer) insertTextWithProps(pos int, rs []rune, props []propInterval) {
+	pos = min(max(pos, 0), len(b.text))
+	b.insertText(pos, rs)
+	b.props = pasteProps(b.props, len(b.text), pos, props)
+}
+
+// deleteText removes [start, end) along with its properties. Positions
+// inside the deleted text, point included, end up at start.
+func (b *elBuffer) deleteText(start, end int) {
+	start = min(max(start, 0), len(b.text))
+	end = min(max(end, start), len(b.text))
+	if start == end {
+		return
+	}
+	b.recordDelete(start, end)
+	b.text = slices.Delete(b.text, start, end)
+	shift := func(p int) int {
+		switch {
+		case p <= start:
+			return p
+		case p < end:
+			return start
+		}
+		return p - (end - start)
+	}
+	var out []propInterval
+	for _, iv := range b.props {
+		out = appendInterval(out, propInterval{shift(iv.start), shift(iv.end), iv.plist})
+	}
+	b.props = out
+	b.point = shift(b.point)
+	b.adjustMarkers(func(p int, _ bool) int {
+		return shift(p)
+	})
+	for _, o := range b.overlays {
+		o.start, o.end = shift(o.start), shift(o.end)
+	}
+}
+
+// undoDisabled reports whether l, an undo list, is t: the buffer does
+// not record changes.
+func undoDisabled(l *golisp.Data) bool {
+	return golisp.NotNilP(l) && !golisp.PairP(l)
+}
+
+// perBufferVars are the variables each buffer has its own value of. The
+// current buffer's values are in the variables themselves, where lisp
+// can see and set them; other buffers keep theirs until they become
+// current again.
+var perBufferVars = []string{"buffer-undo-list", "input-ring"}
+
+func (rt *runtimeState) localValue(buf *elBuffer, name string) *golisp.Data {
+	if buf == rt.localsOwner {
+		return golisp.Global.ValueOf(golisp.Intern(name))
+	}
+	if v, ok := buf.locals[name]; ok {
+		return v
+	}
+	return golisp.EmptyCons()
+}
+
+func (rt *runtimeState) setLocalValue(buf *elBuffer, name string, v *golisp.Data) {
+	if buf == rt.localsOwner {
+		_, _ = golisp.Global.BindTo(golisp.Intern(name), v)
+		return
+	}
+	buf.locals[name] = v
+}
+
+// bindPerBufferVar binds sym, if it is one of perBufferVars, to v in the
+// current buffer until restore puts the old value back. let binds these
+// variables dynamically, as Emacs does, so that the changes its body makes
+// see (let ((buffer-undo-list t)) ...) wherever they are made.
+func (rt *runtimeState) bindPerBufferVar(sym, v *golisp.Data) (restore func(), ok bool) {
+	name := golisp.StringValue(sym)
+	if rt == nil || !slices.Contains(perBufferVars, name) {
+		return nil, false
+	}
+	buf := rt.currentBuffer()
+	old := rt.localValue(buf, name)
+	rt.setLocalValue(buf, name, v)
+	return func() { rt.setLocalValue(buf, name, old) }, true
+}
+
+// swapLocals hands perBufferVars over to buf when it has become the
+// current buffer.
+func (rt *runtimeState) swapLocals(buf *elBuffer) {
+	old := rt.localsOwner
+	for _, name := range perBufferVars {
+		sym := golisp.Intern(name)
+		if old != nil {
+			old.locals[name] = golisp.Global.ValueOf(sym)
+		}
+		v := golisp.EmptyCons()
+		if buf != nil {
+			if l, ok := buf.locals[name]; ok {
+				v = l
+			}
+		}
+		_, _ = golisp.Global.BindTo(sym, v)
+	}
+	rt.localsOwner = buf
+}
+
+// undoListOf returns buf's undo list, t when it records no changes.
+func (rt *runtimeState) undoListOf(buf *elBuffer) *golisp.Data {
+	return rt.localValue(buf, "buffer-undo-list")
+}
+
+func (rt *runtimeState) setUndoList(buf *elBuffer, l *golisp.Data) {
+	rt.setLocalValue(buf, "buffer-undo-list", l)
+}
+
+// setCurrentBuffer makes buf current in the selected window.
+func (rt *runtimeState) setCurrentBuffer(buf *elBuffer) {
+	rt.selectedWindow().buffer = buf
+	rt.swapLocals(buf)
+}
+
+// undoListForChange returns b's undo list ready for a change at pos: it
+// gets point pushed when this is the first change since a boundary and
+// point is elsewhere, so undo can put it back. ok is false when b does
+// not record changes.
+func (b *elBuffer) undoListForChange(pos ...int) (l *golisp.Data, ok bool) {
+	if rtGlobal == nil {
+		return nil, false
+	}
+	l = rtGlobal.undoListOf(b)
+	if undoDisabled(l) {
+		return nil, false
+	}
+	if golisp.NilP(l) || golisp.NilP(golisp.Car(l)) {
+		if !slices.Contains(pos, b.point) {
+			l = golisp.Cons(golisp.IntegerWithValue(int64(b.point+1)), l)
+		}
+	}
+	return l, true
+}
+
+// recordInsert notes that n characters went in at pos, as (BEG . END).
+// Typing one character after another extends the same entry.
+func (b *elBuffer) recordInsert(pos, n int) {
+	l, ok := b.undoListForChange(pos)
+	if !ok {
+		return
+	}
+	head := golisp.Car(l)
+	if golisp.NotNilP(head) && golisp.PairP(head) && golisp.IntegerP(golisp.Car(head)) &&
+		golisp.IntegerP(golisp.Cdr(head)) && golisp.IntegerValue(golisp.Cdr(head)) == int64(pos+1) {
+		l = golisp.Cons(golisp.Cons(golisp.Car(head), golisp.IntegerWithValue(int64(pos+n+1))), golisp.Cdr(l))
+	} else {
+		l = golisp.Cons(golisp.Cons(golisp.IntegerWithValue(int64(pos+1)), golisp.IntegerWithValue(int64(pos+n+1))), l)
+	}
+	rtGlobal.setUndoList(b, l)
+}
+
+// recordDelete notes that [start, end) is about to go, as (TEXT . POS).
+// POS is negative when point was at the end of the text.
+func (b *elBuffer) recordDelete(start, end int) {
+	l, ok := b.undoListForChange(start, end)
+	if !ok {
+		return
+	}
+	text := stringWithProps(b.text[start:end], sliceProps(b.props, start, end))
+	pos := int64(start + 1)
+	if b.point == end {
+		pos = -pos
+	}
+	rtGlobal.setUndoList(b, golisp.Cons(golisp.Cons(text, golisp.IntegerWithValue(pos)), l))
+}
+
+// undoBoundary ends the current group of changes to buf, then drops the
+// oldest groups once the list holds more than undo-limit characters.
+func (rt *runtimeState) undoBoundary(buf *elBuffer) {
+	if buf == nil {
+		return
+	}
+	l := rt.undoListOf(buf)
+	if undoDisabled(l) || golisp.NilP(l) || golisp.NilP(golisp.Car(l)) {
+		return
+	}
+	l = golisp.Cons(golisp.EmptyCons(), l)
+	limit := int64(160000)
+	if v, ok := rt.boundValue(golisp.Intern("undo-limit")); ok && golisp.IntegerP(v) {
+		limit = golisp.IntegerValue(v)
+	}
+	size := int64(0)
+	for c := l; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+		entry := golisp.Car(c)
+		size++
+		if golisp.PairP(entry) && golisp.StringP(golisp.Car(entry)) {
+			size += int64(len(golisp.StringValue(golisp.Car(entry))))
+		}
+		next := golisp.Cdr(c)
+		if size > limit && golisp.NotNilP(next) && golisp.PairP(next) && golisp.NilP(golisp.Car(next)) {
+			golisp.ConsValue(c).Cdr = golisp.EmptyCons()
+			break
+		}
+	}
+	rt.setUndoList(buf, l)
+}
+
+// commandUndoBoundary ends the undo group of the previous command, as the
+// Emacs command loop does, except that up to 20 typed characters in a
+// row are undone together.
+func (rt *runtimeState) commandUndoBoundary(key keyEvent) {
+	// A key that ends a key sequence runs the sequence's command instead.
+	selfInsert := (rt.gridWidth == 0 || rt.activeMinibuffer() != nil) && rt.prefixMap == nil && key >= 32 && key <= 126
+	if key != 31 {
+		rt.undoing = false
+	}
+	if selfInsert && rt.selfInsertRun > 0 && rt.selfInsertRun < 20 {
+		rt.selfInsertRun++
+		return
+	}
+	rt.selfInsertRun = 0
+	if selfInsert {
+		rt.selfInsertRun = 1
+	}
+	rt.undoBoundary(rt.currentBuffer())
+}
+
+// primitiveUndo undoes n groups of changes from the front of l, and
+// returns the rest of it.
+func (rt *runtimeState) primitiveUndo(n int, l *golisp.Data) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return l, nil
+	}
+	outside := errors.New("Changes to be undone are outside visible portion of buffer")
+	for ; n > 0; n-- {
+		for golisp.NotNilP(l) && golisp.PairP(l) {
+			entry := golisp.Car(l)
+			l = golisp.Cdr(l)
+			if golisp.NilP(entry) {
+				break
+			}
+			if golisp.IntegerP(entry) {
+				buf.point = buf.clampPos(int(golisp.IntegerValue(entry)) - 1)
+				continue
+			}
+			if !golisp.PairP(entry) {
+				continue
+			}
+			car, cdr := golisp.Car(entry), golisp.Cdr(entry)
+			switch {
+			case golisp.IntegerP(car) && golisp.IntegerP(cdr):
+				start, end := int(golisp.IntegerValue(car))-1, int(golisp.IntegerValue(cdr))-1
+				if start < buf.begv() || end > buf.zv() {
+					return nil, outside
+				}
+				// Point goes first, so undoing this puts it back here.
+				buf.point = start
+				buf.deleteText(start, end)
+			case golisp.StringP(car) && golisp.IntegerP(cdr):
+				pos := int(golisp.IntegerValue(cdr))
+				start := max(pos, -pos) - 1
+				if start < buf.begv() || start > buf.zv() {
+					return nil, outside
+				}
+				buf.point = start
+				buf.insertTextWithProps(start, []rune(golisp.StringValue(car)), stringPropsOf(car))
+				if pos > 0 {
+					buf.point = start
+				}
+			}
+		}
+	}
+	return l, nil
+}
+
+func (rt *runtimeState) primitiveUndoImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.primitiveUndo(int(golisp.IntegerValue(golisp.Car(args))), golisp.Cadr(args))
+}
+
+// undoImpl is the undo command. Repeated, it keeps going back through
+// the list it started on; after any other command it starts again from
+// the front, so it undoes the undoing first.
+func (rt *runtimeState) undoImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	n := 1
+	if golisp.IntegerP(golisp.Car(args)) {
+		n = int(golisp.IntegerValue(golisp.Car(args)))
+	}
+	l := rt.undoListOf(buf)
+	if undoDisabled(l) {
+		return nil, errors.New("No undo information in this buffer")
+	}
+	if !rt.undoing {
+		for golisp.NotNilP(l) && golisp.PairP(l) && golisp.NilP(golisp.Car(l)) {
+			l = golisp.Cdr(l)
+		}
+		rt.pendingUndo = l
+	}
+	rt.undoBoundary(buf)
+	if golisp.NilP(rt.pendingUndo) {
+		rt.undoing = false
+		return nil, errors.New("No further undo information")
+	}
+	rest, err := rt.primitiveUndo(n, rt.pendingUndo)
+	if err != nil {
+		return nil, err
+	}
+	rt.pendingUndo, rt.undoing = rest, true
+	rt.undoBoundary(buf)
+	if !rt.batch {
+		rt.messages = append(rt.messages, "Undo")
+	}
+	return golisp.EmptyCons(), nil
+}
+
+func (rt *runtimeState) undoBoundaryImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	rt.undoBoundary(rt.currentBuffer())
+	return golisp.EmptyCons(), nil
+}
+
+func (rt *runtimeState) bufferDisableUndoImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if buf := rt.bufferArg(golisp.Car(args)); buf != nil {
+		rt.setUndoList(buf, golisp.BooleanWithValue(true))
+	}
+	return golisp.EmptyCons(), nil
+}
+
+func (rt *runtimeState) bufferEnableUndoImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if buf := rt.bufferArg(golisp.Car(args)); buf != nil && undoDisabled(rt.undoListOf(buf)) {
+		rt.setUndoList(buf, golisp.EmptyCons())
+	}
+	return golisp.EmptyCons(), nil
+}
+
+// propertyText is the text a text property function acts on. Buffer
+// positions count from 1 and string positions from 0; first says which.
+type propertyText struct {
+	props []propInterval
+	size  int
+	first int
+	store func([]propInterval)
+}
+
+// propertyTarget returns the text of OBJECT, which is a string, a
+// buffer, or nil for the current buffer. It returns nil when there is
+// no such text.
+func propertyTarget(object *golisp.Data) *propertyText {
+	if golisp.StringP(object) {
+		return &propertyText{
+			props: stringPropsOf(object),
+			size:  utf8.RuneCountInString(golisp.StringValue(object)),
+			store: func(props []propInterval) { setStringProps(object, props) },
+		}
+	}
+	var buf *elBuffer
+	switch {
+	case golisp.NilP(object):
+		buf = rtGlobal.currentBuffer()
+	case golisp.ObjectP(object) && golisp.ObjectType(object) == "el-buffer":
+		buf = (*elBuffer)(golisp.ObjectValue(object))
+	}
+	if buf == nil {
+		return nil
+	}
+	return &propertyText{
+		props: buf.props,
+		size:  len(buf.text),
+		first: 1,
+		store: func(props []propInterval) { buf.props = props },
+	}
+}
+
+// position turns the lisp position v into an index into the text.
+func (t *propertyText) position(v *golisp.Data) int {
+	if m, ok := markerArg(v); ok {
+		return m.pos
+	}
+	return int(golisp.IntegerValue(v)) - t.first
+}
+
+// modify applies f to the plists over START and END, which are taken
+// from args in either order.
+func (t *propertyText) modify(args *golisp.Data, f func(plist *golisp.Data) *golisp.Data) {
+	start, end := t.position(golisp.Car(args)), t.position(golisp.Cadr(args))
+	if start > end {
+		start, end = end, start
+	}
+	t.props = modifyProps(t.props, t.size, start, end, f)
+	t.store(t.props)
+}
+
+// nextChange returns the first position after pos at which the
+// properties differ from those at pos according to same, or -1 if they
+// hold to the end of the text.
+func (t *propertyText) nextChange(pos int, same func(a, b *golisp.Data) bool) int {
+	here := propsAt(t.props, pos)
+	for _, iv := range t.props {
+		for _, p := range [2]int{iv.start, iv.end} {
+			if p > pos && p < t.size && !same(here, propsAt(t.props, p)) {
+				return p
+			}
+		}
+	}
+	return -1
+}
+
+// previousChange is nextChange going backwards: it compares characters
+// before positions, and returns -1 if nothing changes back to the start.
+func (t *propertyText) previousChange(pos int, same func(a, b *golisp.Data) bool) int {
+	here := propsAt(t.props, pos-1)
+	for i := len(t.props) - 1; i >= 0; i-- {
+		iv := t.props[i]
+		for _, p := range [2]int{iv.end, iv.start} {
+			if p < pos && p > 0 && !same(here, propsAt(t.props, p-1)) {
+				return p
+			}
+		}
+	}
+	return -1
+}
+
+// sameProp makes a comparison for nextChange that looks at prop only.
+func sameProp(prop *golisp.Data) func(a, b *golisp.Data) bool {
+	name := featureName(prop)
+	return func(a, b *golisp.Data) bool {
+		va, _ := plistGet(a, name)
+		vb, _ := plistGet(b, name)
+		return golisp.IsEqual(va, vb)
+	}
+}
+
+// propertyChange finishes the property change functions: p is the
+// change found, or -1, and limit is the optional LIMIT argument.
+func (t *propertyText) propertyChange(p int, limit *golisp.Data, forward bool) *golisp.Data {
+	if golisp.NotNilP(limit) {
+		l := t.position(limit)
+		if p < 0 || (forward && p > l) || (!forward && p < l) {
+			return limit
+		}
+	}
+	if p < 0 {
+		return golisp.EmptyCons()
+	}
+	return golisp.IntegerWithValue(int64(p + t.first))
+}
+
+func propertizeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	sv := golisp.Car(args)
+	if !golisp.StringP(sv) {
+		return nil, fmt.Errorf("propertize expects string, got %s", golisp.String(sv))
+	}
+	rs := []rune(golisp.StringValue(sv))
+	props := modifyProps(stringPropsOf(sv), len(rs), 0, len(rs), func(plist *golisp.Data) *golisp.Data {
+		for c := golisp.Cdr(args); golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+			plist = plistPut(plist, golisp.Car(c), golisp.Cadr(c))
+		}
+		return plist
+	})
+	return stringWithProps(rs, props), nil
+}
+
+func getTextPropertyImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Caddr(args))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	v, _ := plistGet(propsAt(t.props, t.position(golisp.Car(args))), featureName(golisp.Cadr(args)))
+	return v, nil
+}
+
+func textPropertiesAtImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Cadr(args))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	return golisp.Copy(propsAt(t.props, t.position(golisp.Car(args)))), nil
+}
+
+func nextSinglePropertyChangeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Caddr(args))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	p := t.nextChange(t.position(golisp.Car(args)), sameProp(golisp.Cadr(args)))
+	return t.propertyChange(p, golisp.Nth(args, 4), true), nil
+}
+
+func previousSinglePropertyChangeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Caddr(args))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	p := t.previousChange(t.position(golisp.Car(args)), sameProp(golisp.Cadr(args)))
+	return t.propertyChange(p, golisp.Nth(args, 4), false), nil
+}
+
+func nextPropertyChangeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Cadr(args))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	p := t.nextChange(t.position(golisp.Car(args)), plistEqual)
+	return t.propertyChange(p, golisp.Caddr(args), true), nil
+}
+
+func textPropertyAnyImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Nth(args, 5))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	start, end := t.position(golisp.Car(args)), t.position(golisp.Cadr(args))
+	name, value := featureName(golisp.Caddr(args)), golisp.Nth(args, 4)
+	for p := max(start, 0); p < min(end, t.size); p++ {
+		if v, _ := plistGet(propsAt(t.props, p), name); golisp.IsEqual(v, value) {
+			return golisp.IntegerWithValue(int64(p + t.first)), nil
+		}
+	}
+	return golisp.EmptyCons(), nil
+}
+
+func putTextPropertyImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Nth(args, 5))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	prop, value := golisp.Caddr(args), golisp.Nth(args, 4)
+	t.modify(args, func(plist *golisp.Data) *golisp.Data {
+		return plistPut(plist, prop, value)
+	})
+	return golisp.EmptyCons(), nil
+}
+
+func addTextPropertiesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Nth(args, 4))
+	if t == nil {
+		return golisp.EmptyCons(), nil
+	}
+	props := golisp.Caddr(args)
+	t.modify(args, func(plist *golisp.Data) *golisp.Data {
+		for c := props; golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+			plist = plistPut(plist, golisp.Car(c), golisp.Cadr(c))
+		}
+		return plist
+	})
+	return golisp.BooleanWithValue(true), nil
+}
+
+func setTextPropertiesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	t := propertyTarget(golisp.Nth(args, 4))
+	if t == nil {
+		return golisp.BooleanWithValue(true), nil
+	}
+	props := golisp.Caddr(args)
+	t.modify(args, func(*golisp.Data) *golisp.Data {
+		return props
+	})
+	return golisp.BooleanWithValue(true), nil
+}
+
+// removeTextProperties removes the properties named in names, a list,
+// from the text, and reports whether any were there.
+func removeTextProperties(args, names *golisp.Data) *golisp.Data {
+	t := propertyTarget(golisp.Nth(args, 4))
+	if t == nil {
+		return golisp.EmptyCons()
+	}
+	changed := false
+	t.modify(args, func(plist *golisp.Data) *golisp.Data {
+		for c := names; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+			name := featureName(golisp.Car(c))
+			if _, ok := plistGet(plist, name); ok {
+				plist, changed = plistRemove(plist, name), true
+			}
+		}
+		return plist
+	})
+	return golisp.BooleanWithValue(changed)
+}
+
+func removeTextPropertiesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	var names []*golisp.Data
+	for c := golisp.Caddr(args); golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cddr(c) {
+		names = append(names, golisp.Car(c))
+	}
+	return removeTextProperties(args, golisp.ArrayToList(names)), nil
+}
+
+func removeListOfTextPropertiesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return removeTextProperties(args, golisp.Caddr(args)), nil
+}
+
+// elMarker is a buffer position that moves with the text around it. A
+// marker that points nowhere has no buffer. With insertionType set it
+// advances over text inserted right at it, as point does.
+type elMarker struct {
+	object        *golisp.Data
+	buffer        *elBuffer
+	pos           int
+	insertionType bool
+}
+
+func newMarker() *elMarker {
+	m := &elMarker{}
+	m.object = golisp.ObjectWithTypeAndValue("el-marker", unsafe.Pointer(m))
+	return m
+}
+
+// set points m at pos of buf, or nowhere when buf is nil. Buffers only
+// hold their markers weakly, so markers lisp lets go of are collected.
+func (m *elMarker) set(buf *elBuffer, pos int) {
+	if m.buffer != buf {
+		if m.buffer != nil {
+			m.buffer.markers = slices.DeleteFunc(m.buffer.markers, func(w weak.Pointer[elMarker]) bool {
+				return w.Value() == m
+			})
+		}
+		if buf != nil {
+			buf.markers = append(buf.markers, weak.Make(m))
+		}
+		m.buffer = buf
+	}
+	m.pos = 0
+	if buf != nil {
+		m.pos = min(max(pos, 0), len(buf.text))
+	}
+}
+
+// adjustMarkers moves each marker of b to where f puts it, and forgets
+// the ones that have been collected.
+func (b *elBuffer) adjustMarkers(f func(pos int, insertionType bool) int) {
+	b.markers = slices.DeleteFunc(b.markers, func(w weak.Pointer[elMarker]) bool {
+		m := w.Value()
+		if m == nil {
+			return true
+		}
+		m.pos = f(m.pos, m.insertionType)
+		return false
+	})
+}
+
+// markMarker returns the buffer's mark, which points nowhere until the
+// mark is first set.
+func (b *elBuffer) markMarker() *elMarker {
+	if b.mark == nil {
+		b.mark = newMarker()
+	}
+	return b.mark
+}
+
+// inputMarker returns the marker at the start of the player's input in
+// a text game. It starts out at point, and handleKey moves it past the
+// game's answer each time a line is entered.
+func (b *elBuffer) inputMarker() *elMarker {
+	if b.input == nil {
+		b.input = newMarker()
+		b.input.set(b, b.point)
+	}
+	return b.input
+}
+
+func markerArg(d *golisp.Data) (*elMarker, bool) {
+	if golisp.ObjectP(d) && golisp.ObjectType(d) == "el-marker" {
+		return (*elMarker)(golisp.ObjectValue(d)), true
+	}
+	return nil, false
+}
+
+// positionArg returns the 0-based buffer position d stands for, d being
+// a 1-based integer or a marker.
+func positionArg(d *golisp.Data) int {
+	if m, ok := markerArg(d); ok {
+		return m.pos
 	}
-	if full {
-		items := make([]*golisp.Data, 256)
-		for i := range items {
-			items[i] = golisp.EmptyCons()
-		}
-		km.fullMap = newElVector(items)
+	return int(golisp.IntegerValue(d)) - 1
+}
+
+func positionP(d *golisp.Data) bool {
+	_, ok := markerArg(d)
+	return ok || golisp.IntegerP(d)
+}
+
+func markerPosition(m *elMarker) *golisp.Data {
+	if m.buffer == nil {
+		return golisp.EmptyCons()
 	}
-	_, err := env.BindLocallyTo(name, keymapObject(km))
-	return name, err
+	return golisp.IntegerWithValue(int64(m.pos + 1))
 }
 
-func newKeymap() *elKeymap {
-	return &elKeymap{bindings: make(map[string]*golisp.Data)}
+func markerpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	_, ok := markerArg(golisp.Car(args))
+	return golisp.BooleanWithValue(ok), nil
 }
 
-func keymapObject(km *elKeymap) *golisp.Data {
-	return golisp.ObjectWithTypeAndValue("el-keymap", unsafe.Pointer(km))
+func integerOrMarkerPImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return golisp.BooleanWithValue(positionP(golisp.Car(args))), nil
 }
 
-func isKeymap(d *golisp.Data) bool {
-	return golisp.ObjectP(d) && golisp.ObjectType(d) == "el-keymap"
+func makeMarkerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return newMarker().object, nil
 }
 
-func asKeymap(d *golisp.Data) *elKeymap {
-	return (*elKeymap)(golisp.ObjectValue(d))
+func pointMarkerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m := newMarker()
+	if buf := rtGlobal.currentBuffer(); buf != nil {
+		m.set(buf, buf.point)
+	}
+	return m.object, nil
 }
 
-func keySpecString(d *golisp.Data, env *golisp.SymbolTableFrame) string {
-	switch {
-	case golisp.StringP(d):
-		return golisp.StringValue(d)
-	case golisp.IntegerP(d):
-		n := int(golisp.IntegerValue(d))
-		if n >= 32 && n <= 126 {
-			return string(rune(n))
-		}
-		switch n {
-		case 9:
-			return "TAB"
-		case 10, 13:
-			return "RET"
-		case 27:
-			return "ESC"
-		}
-		return ""
-	case golisp.SymbolP(d):
-		if env != nil {
-			if v := env.ValueOf(d); golisp.StringP(v) {
-				return golisp.StringValue(v)
-			}
-		}
-		switch golisp.StringValue(d) {
-		case "tab":
-			return "TAB"
-		case "return":
-			return "RET"
-		case "escape":
-			return "ESC"
-		default:
-			return golisp.StringValue(d)
-		}
-	case isElVector(d):
-		vec := asElVector(d)
-		if len(vec.items) == 0 {
-			return ""
-		}
-		return keySpecString(vec.items[0], env)
-	default:
-		return ""
+func pointMinMarkerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m := newMarker()
+	if buf := rtGlobal.currentBuffer(); buf != nil {
+		m.set(buf, buf.begv())
 	}
+	return m.object, nil
 }
 
-func makeSparseKeymapImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return keymapObject(newKeymap()), nil
+func pointMaxMarkerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m := newMarker()
+	if buf := rtGlobal.currentBuffer(); buf != nil {
+		m.set(buf, buf.zv())
+	}
+	return m.object, nil
 }
 
-func defineKeyImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	m := golisp.Car(args)
-	var mSym *golisp.Data
-	if golisp.SymbolP(m) {
-		mSym = m
-	} else if golisp.PairP(m) && golisp.SymbolP(golisp.Car(m)) && golisp.StringValue(golisp.Car(m)) == "quote" {
-		q := golisp.Cadr(m)
-		if golisp.SymbolP(q) {
-			mSym = q
-			m = q
-		}
+// setMarker points m at POSITION, an integer, a marker or nil for
+// nowhere, in BUFFER or else the current buffer.
+func (rt *runtimeState) setMarker(m *elMarker, position, buffer *golisp.Data) error {
+	if golisp.NilP(position) {
+		m.set(nil, 0)
+		return nil
 	}
-	k := golisp.Cadr(args)
-	def := golisp.Caddr(args)
-	if golisp.SymbolP(m) {
-		m = env.ValueOf(m)
+	if !positionP(position) {
+		return fmt.Errorf("wrong-type-argument integer-or-marker-p %s", golisp.String(position))
 	}
-	if golisp.NilP(m) && mSym != nil {
-		m = keymapObject(newKeymap())
-		if _, err := env.BindTo(mSym, m); err != nil {
-			if _, err2 := env.BindLocallyTo(mSym, m); err2 != nil {
-				return nil, err2
-			}
+	buf := rt.bufferArg(buffer)
+	if src, ok := markerArg(position); ok {
+		if src.buffer == nil {
+			m.set(nil, 0)
+			return nil
 		}
-	}
-	if !isKeymap(m) {
-		m = keymapObject(newKeymap())
-		if mSym != nil {
-			if _, err := env.BindTo(mSym, m); err != nil {
-				_, _ = env.BindLocallyTo(mSym, m)
-			}
+		if golisp.NilP(buffer) {
+			buf = src.buffer
 		}
 	}
-	key := keySpecString(k, env)
-	if key == "" {
-		return nil, fmt.Errorf("define-key unsupported key spec: %s", golisp.String(k))
+	m.set(buf, positionArg(position))
+	return nil
+}
+
+func (rt *runtimeState) setMarkerImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m, ok := markerArg(golisp.Car(args))
+	if !ok {
+		return nil, fmt.Errorf("wrong-type-argument markerp %s", golisp.String(golisp.Car(args)))
 	}
-	km := asKeymap(m)
-	km.bindings[key] = def
-	if km.fullMap != nil && len(key) == 1 {
-		_, _ = asetImpl(golisp.ArrayToList([]*golisp.Data{
-			km.fullMap,
-			golisp.IntegerWithValue(int64(key[0])),
-			def,
-		}), env)
+	if err := rt.setMarker(m, golisp.Cadr(args), golisp.Caddr(args)); err != nil {
+		return nil, err
 	}
-	return def, nil
+	return m.object, nil
 }
 
-func keymapSetImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return defineKeyImpl(args, env)
+func (rt *runtimeState) copyMarkerImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m := newMarker()
+	m.insertionType = golisp.BooleanValue(golisp.Cadr(args))
+	if err := rt.setMarker(m, golisp.Car(args), golisp.EmptyCons()); err != nil {
+		return nil, err
+	}
+	return m.object, nil
 }
 
-func obarrayMakeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	n := max(golisp.IntegerValue(golisp.Car(args)), 0)
-	items := make([]*golisp.Data, int(n))
-	for i := range items {
-		items[i] = golisp.EmptyCons()
+func markerPositionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m, ok := markerArg(golisp.Car(args))
+	if !ok {
+		return nil, fmt.Errorf("wrong-type-argument markerp %s", golisp.String(golisp.Car(args)))
 	}
-	return newElVector(items), nil
+	return markerPosition(m), nil
 }
 
-func expandFileNameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := featureName(golisp.Car(args))
-	if filepath.IsAbs(name) {
-		return golisp.StringWithValue(filepath.Clean(name)), nil
+func markerBufferImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m, ok := markerArg(golisp.Car(args))
+	if !ok {
+		return nil, fmt.Errorf("wrong-type-argument markerp %s", golisp.String(golisp.Car(args)))
 	}
-	base := ""
-	if golisp.NotNilP(golisp.Cdr(args)) {
-		base = featureName(golisp.Cadr(args))
+	if m.buffer == nil {
+		return golisp.EmptyCons(), nil
 	}
-	if base == "" {
-		home, _ := os.UserHomeDir()
-		base = home
+	return m.buffer.object, nil
+}
+
+func markerInsertionTypeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m, ok := markerArg(golisp.Car(args))
+	if !ok {
+		return nil, fmt.Errorf("wrong-type-argument markerp %s", golisp.String(golisp.Car(args)))
 	}
-	return golisp.StringWithValue(filepath.Clean(filepath.Join(base, name))), nil
+	return golisp.BooleanWithValue(m.insertionType), nil
 }
 
-func substituteInFileNameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := featureName(golisp.Car(args))
-	if strings.HasPrefix(s, "~") {
-		if home, err := os.UserHomeDir(); err == nil {
-			if s == "~" {
-				s = home
-			} else if after, ok := strings.CutPrefix(s, "~/"); ok {
-				s = filepath.Join(home, after)
-			}
-		}
+func setMarkerInsertionTypeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	m, ok := markerArg(golisp.Car(args))
+	if !ok {
+		return nil, fmt.Errorf("wrong-type-argument markerp %s", golisp.String(golisp.Car(args)))
 	}
-	return golisp.StringWithValue(os.ExpandEnv(s)), nil
+	m.insertionType = golisp.BooleanValue(golisp.Cadr(args))
+	return golisp.Cadr(args), nil
 }
 
-func executableFindImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := featureName(golisp.Car(args))
-	if name == "" {
+func markImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
 		return golisp.EmptyCons(), nil
 	}
-	p, err := exec.LookPath(name)
+	return markerPosition(buf.markMarker()), nil
+}
+
+func markMarkerImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return newMarker().object, nil
+	}
+	return buf.markMarker().object, nil
+}
+
+func (rt *runtimeState) setMarkImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	if err := rt.setMarker(buf.markMarker(), golisp.Car(args), golisp.EmptyCons()); err != nil {
+		return nil, err
+	}
+	return golisp.Car(args), nil
+}
+
+// pushMarkImpl sets the mark at POSITION, or at point. There is no mark
+// ring to push the old mark onto.
+func (rt *runtimeState) pushMarkImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	position := golisp.Car(args)
+	if golisp.NilP(position) {
+		position = golisp.IntegerWithValue(int64(buf.point + 1))
+	}
+	if err := rt.setMarker(buf.markMarker(), position, golisp.EmptyCons()); err != nil {
+		return nil, err
+	}
+	return golisp.EmptyCons(), nil
+}
+
+// region returns the bounds of the text between point and mark.
+func (rt *runtimeState) region() (int, int, error) {
+	buf := rt.currentBuffer()
+	if buf == nil || buf.markMarker().buffer == nil {
+		return 0, 0, errors.New("The mark is not set now, so there is no region")
+	}
+	return min(buf.point, buf.mark.pos), max(buf.point, buf.mark.pos), nil
+}
+
+func (rt *runtimeState) regionBeginningImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	start, _, err := rt.region()
 	if err != nil {
-		// Emacs callers often guard with (or (executable-find ..) (error ..)).
-		// Returning NAME keeps optional external tools from hard-failing startup.
-		return golisp.StringWithValue(name), nil
+		return nil, err
 	}
-	return golisp.StringWithValue(p), nil
+	return golisp.IntegerWithValue(int64(start + 1)), nil
 }
 
-func locateUserEmacsFileImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	home, _ := os.UserHomeDir()
-	root := filepath.Join(home, ".emacs.d")
-	name := featureName(golisp.Car(args))
-	if name == "" {
-		return golisp.StringWithValue(root), nil
+func (rt *runtimeState) regionEndImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	_, end, err := rt.region()
+	if err != nil {
+		return nil, err
 	}
-	return golisp.StringWithValue(filepath.Join(root, name)), nil
+	return golisp.IntegerWithValue(int64(end + 1)), nil
 }
 
-func defineObsoleteFunctionAliasImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return defaliasImpl(args, env)
+// killRing returns kill-ring and kill-ring-yank-pointer, the tail of it
+// that current-kill and yank start from.
+func killRing() (ring, yank *golisp.Data) {
+	ring = golisp.Global.ValueOf(golisp.Intern("kill-ring"))
+	yank = golisp.Global.ValueOf(golisp.Intern("kill-ring-yank-pointer"))
+	if !golisp.PairP(ring) || golisp.NilP(ring) {
+		ring = golisp.EmptyCons()
+	}
+	if !golisp.PairP(yank) || golisp.NilP(yank) {
+		yank = ring
+	}
+	return ring, yank
 }
 
-func makeObsoleteVariableImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// Emacs uses this for metadata/warnings; runtime behavior can be a no-op.
-	return golisp.Car(args), nil
+func setKillRing(ring, yank *golisp.Data) {
+	_, _ = golisp.Global.BindTo(golisp.Intern("kill-ring"), ring)
+	_, _ = golisp.Global.BindTo(golisp.Intern("kill-ring-yank-pointer"), yank)
 }
 
-func makeObsoleteImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// Compatibility no-op for obsolete warnings.
-	return golisp.Car(args), nil
+// killNew puts s at the front of the kill ring, or in place of the
+// latest kill, and drops kills past kill-ring-max.
+func killNew(s *golisp.Data, replace bool) {
+	ring, _ := killRing()
+	if replace && golisp.NotNilP(ring) {
+		ring = golisp.Cdr(ring)
+	}
+	ring = truncateList(golisp.Cons(s, ring), "kill-ring-max", 120)
+	setKillRing(ring, ring)
 }
 
-func copyFaceImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.Car(args), nil
+// truncateList cuts l, in place, to as many elements as the variable
+// limit says, or to def of them.
+func truncateList(l *golisp.Data, limit string, def int) *golisp.Data {
+	n := def
+	if v := golisp.Global.ValueOf(golisp.Intern(limit)); golisp.IntegerP(v) {
+		n = max(int(golisp.IntegerValue(v)), 1)
+	}
+	for c := l; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+		if n--; n == 0 {
+			golisp.ConsValue(c).Cdr = golisp.EmptyCons()
+			break
+		}
+	}
+	return l
 }
 
-func currentTimeImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(time.Now().Unix()), nil
+// killAppend adds s to the latest kill, in front of it if before.
+func killAppend(s *golisp.Data, before bool) {
+	ring, _ := killRing()
+	if golisp.NilP(ring) {
+		killNew(s, false)
+		return
+	}
+	parts := []*golisp.Data{golisp.Car(ring), s}
+	if before {
+		parts[0], parts[1] = s, parts[0]
+	}
+	joined, _ := concatImpl(golisp.ArrayToList(parts), nil)
+	killNew(joined, true)
 }
 
-func timeConvertImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// Minimal compatibility: pass through current-time tuples and numbers.
-	return golisp.Car(args), nil
+// currentKill moves the yank pointer n kills further back, wrapping at
+// the end of the ring, and returns the kill it lands on.
+func currentKill(n int, doNotMove bool) (*golisp.Data, error) {
+	ring, yank := killRing()
+	size := golisp.Length(ring)
+	if size == 0 {
+		return nil, errors.New("Kill ring is empty")
+	}
+	at := size - golisp.Length(yank)
+	at = ((at+n)%size + size) % size
+	c := ring
+	for range at {
+		c = golisp.Cdr(c)
+	}
+	if !doNotMove {
+		setKillRing(ring, c)
+	}
+	return golisp.Car(c), nil
 }
 
-func timeEqualPImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(golisp.IsEqual(golisp.Car(args), golisp.Cadr(args))), nil
+func killNewImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	killNew(golisp.Car(args), golisp.BooleanValue(golisp.Cadr(args)))
+	return golisp.EmptyCons(), nil
 }
 
-func currentTimeStringImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.StringWithValue(time.Now().Format("Mon Jan _2 15:04:05 2006")), nil
+func killAppendImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	killAppend(golisp.Car(args), golisp.BooleanValue(golisp.Cadr(args)))
+	return golisp.EmptyCons(), nil
 }
 
-func defineErrorImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := golisp.Car(args)
-	if !golisp.SymbolP(name) {
-		return nil, fmt.Errorf("define-error expects symbol, got %s", golisp.String(name))
+func currentKillImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return currentKill(int(golisp.IntegerValue(golisp.Car(args))), golisp.BooleanValue(golisp.Cadr(args)))
+}
+
+// killText deletes [start, end) from buf onto the kill ring. Right after
+// another kill command it adds to that kill instead, in front when
+// killing backward, so C-k C-k kills two lines as one.
+func (rt *runtimeState) killText(buf *elBuffer, start, end int) {
+	start, end = buf.clampPos(start), buf.clampPos(end)
+	backward := end < start
+	if backward {
+		start, end = end, start
 	}
-	parent := "error"
-	if golisp.NotNilP(golisp.Cddr(args)) && golisp.SymbolP(golisp.Caddr(args)) {
-		parent = golisp.StringValue(golisp.Caddr(args))
+	text := stringWithProps(buf.text[start:end], sliceProps(buf.props, start, end))
+	if rt.lastCommand == "kill" {
+		killAppend(text, backward)
+	} else {
+		killNew(text, false)
 	}
-	if rtGlobal != nil {
-		rtGlobal.errorParents[golisp.StringValue(name)] = parent
+	buf.deleteText(start, end)
+	rt.thisCommand = "kill"
+}
+
+func (rt *runtimeState) killRegionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
 	}
-	_, _ = env.BindTo(name, name)
-	return name, nil
+	if !positionP(golisp.Car(args)) || !positionP(golisp.Cadr(args)) {
+		return nil, errors.New("The mark is not set now, so there is no region")
+	}
+	rt.killText(buf, positionArg(golisp.Car(args)), positionArg(golisp.Cadr(args)))
+	return golisp.EmptyCons(), nil
 }
 
-func forceModeLineUpdateImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(true), nil
+// killLineImpl kills the rest of the line, or the newline if only
+// whitespace is left. With ARG it kills that many lines including their
+// newlines, or back to the start of the line and ARG lines before it
+// when ARG is zero or negative.
+func (rt *runtimeState) killLineImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	lo, hi := buf.begv(), buf.zv()
+	end := buf.point
+	switch arg := golisp.Car(args); {
+	case !golisp.IntegerP(arg):
+		if end == hi {
+			return nil, errors.New("End of buffer")
+		}
+		for end < hi && buf.text[end] != '\n' {
+			end++
+		}
+		if strings.TrimSpace(string(buf.text[buf.point:end])) == "" && end < hi {
+			end++
+		}
+	case golisp.IntegerValue(arg) > 0:
+		for n := golisp.IntegerValue(arg); n > 0 && end < hi; n-- {
+			for end < hi && buf.text[end] != '\n' {
+				end++
+			}
+			if end < hi {
+				end++
+			}
+		}
+	default:
+		for n := -golisp.IntegerValue(arg); end > lo; n-- {
+			for end > lo && buf.text[end-1] != '\n' {
+				end--
+			}
+			if n == 0 {
+				break
+			}
+			end--
+		}
+	}
+	rt.killText(buf, buf.point, end)
+	return golisp.EmptyCons(), nil
+}
+
+// insertKill inserts a kill at point with the mark at its start, as
+// yank and yank-pop leave it.
+func (rt *runtimeState) insertKill(buf *elBuffer, s *golisp.Data) {
+	buf.markMarker().set(buf, buf.point)
+	buf.insertTextWithProps(buf.point, []rune(golisp.StringValue(s)), stringPropsOf(s))
+	rt.thisCommand = "yank"
+}
+
+// yankImpl inserts the latest kill, or with ARG the ARGth most recent.
+func (rt *runtimeState) yankImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	n := 0
+	if golisp.IntegerP(golisp.Car(args)) {
+		n = int(golisp.IntegerValue(golisp.Car(args))) - 1
+	}
+	s, err := currentKill(n, false)
+	if err != nil {
+		return nil, err
+	}
+	rt.insertKill(buf, s)
+	return golisp.EmptyCons(), nil
 }
 
-func fsetImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	sym := golisp.Car(args)
-	if golisp.PairP(sym) && golisp.SymbolP(golisp.Car(sym)) && golisp.StringValue(golisp.Car(sym)) == "quote" {
-		sym = golisp.Cadr(sym)
+// yankPopImpl replaces the text just yanked with an earlier kill.
+func (rt *runtimeState) yankPopImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
 	}
-	if !golisp.SymbolP(sym) {
-		return nil, fmt.Errorf("fset expects symbol as first argument, got %s", golisp.String(sym))
+	if rt.lastCommand != "yank" && rt.thisCommand != "yank" {
+		return nil, errors.New("Previous command was not a yank")
 	}
-	valExpr := golisp.Cadr(args)
-	if golisp.PairP(valExpr) && golisp.SymbolP(golisp.Car(valExpr)) && golisp.StringValue(golisp.Car(valExpr)) == "quote" {
-		valExpr = golisp.Cadr(valExpr)
+	n := 1
+	if golisp.IntegerP(golisp.Car(args)) {
+		n = int(golisp.IntegerValue(golisp.Car(args)))
 	}
-	val, err := golisp.Eval(valExpr, env)
+	s, err := currentKill(n, false)
 	if err != nil {
 		return nil, err
 	}
-	if _, err := env.SetTo(sym, val); err != nil {
-		if _, err2 := env.BindTo(sym, val); err2 != nil {
-			return nil, err2
-		}
+	start, end, err := rt.region()
+	if err != nil {
+		return nil, err
 	}
-	return val, nil
+	buf.deleteText(start, end)
+	buf.point = start
+	rt.insertKill(buf, s)
+	return golisp.EmptyCons(), nil
 }
 
-func rplacaImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	cell := golisp.Car(args)
-	val := golisp.Cadr(args)
-	if !golisp.PairP(cell) {
-		return nil, fmt.Errorf("rplaca expects cons cell, got %s", golisp.String(cell))
+// begv and zv bound the accessible portion of the buffer, as in Emacs:
+// all of the text unless it has been narrowed.
+func (b *elBuffer) begv() int {
+	if b.narrowStart == nil {
+		return 0
 	}
-	golisp.ConsValue(cell).Car = val
-	return val, nil
+	return b.narrowStart.pos
 }
 
-func declareFunctionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	if golisp.NotNilP(args) {
-		return golisp.Car(args), nil
+func (b *elBuffer) zv() int {
+	if b.narrowEnd == nil {
+		return len(b.text)
 	}
-	return golisp.EmptyCons(), nil
-}
-
-func frameHeightImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(40), nil
+	return b.narrowEnd.pos
 }
 
-func frameWidthImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(120), nil
+// clampPos keeps p within the accessible portion.
+func (b *elBuffer) clampPos(p int) int {
+	return min(max(p, b.begv()), b.zv())
 }
 
-func windowHeightImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(40), nil
+// narrow makes [start, end) the accessible portion. The bounds are
+// markers, the end one advancing, so text inserted at either end is
+// still accessible.
+func (b *elBuffer) narrow(start, end int) {
+	start = min(max(start, 0), len(b.text))
+	end = min(max(end, 0), len(b.text))
+	if start > end {
+		start, end = end, start
+	}
+	if b.narrowStart == nil {
+		b.narrowStart, b.narrowEnd = newMarker(), newMarker()
+		b.narrowEnd.insertionType = true
+	}
+	b.narrowStart.set(b, start)
+	b.narrowEnd.set(b, end)
+	b.point = b.clampPos(b.point)
 }
 
-func windowWidthImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(120), nil
+func (b *elBuffer) widen() {
+	if b.narrowStart != nil {
+		b.narrowStart.set(nil, 0)
+		b.narrowEnd.set(nil, 0)
+		b.narrowStart, b.narrowEnd = nil, nil
+	}
 }
 
-func charToStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	c := golisp.Car(args)
-	if golisp.IntegerP(c) {
-		return golisp.StringWithValue(string(rune(golisp.IntegerValue(c)))), nil
-	}
-	if golisp.StringP(c) {
-		return c, nil
+func narrowToRegionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if buf := rtGlobal.currentBuffer(); buf != nil {
+		buf.narrow(positionArg(golisp.Car(args)), positionArg(golisp.Cadr(args)))
 	}
-	return golisp.StringWithValue(golisp.String(c)), nil
+	return golisp.EmptyCons(), nil
 }
 
-func stringToCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := featureName(golisp.Car(args))
-	r := []rune(s)
-	if len(r) == 0 {
-		return golisp.IntegerWithValue(0), nil
+func widenImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	if buf := rtGlobal.currentBuffer(); buf != nil {
+		buf.widen()
 	}
-	return golisp.IntegerWithValue(int64(r[0])), nil
+	return golisp.EmptyCons(), nil
 }
 
-func minImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	best := golisp.Car(args)
-	if !golisp.NumberP(best) {
-		return nil, fmt.Errorf("min expects numbers, got %s", golisp.String(best))
-	}
-	bestF := float64(golisp.FloatValue(best))
-	if golisp.IntegerP(best) {
-		bestF = float64(golisp.IntegerValue(best))
-	}
-	allInt := golisp.IntegerP(best)
-	for c := golisp.Cdr(args); golisp.NotNilP(c); c = golisp.Cdr(c) {
-		v := golisp.Car(c)
-		if !golisp.NumberP(v) {
-			return nil, fmt.Errorf("min expects numbers, got %s", golisp.String(v))
-		}
-		f := float64(golisp.FloatValue(v))
-		if golisp.IntegerP(v) {
-			f = float64(golisp.IntegerValue(v))
-		} else {
-			allInt = false
-		}
-		if f < bestF {
-			bestF = f
-		}
-	}
-	if allInt {
-		return golisp.IntegerWithValue(int64(bestF)), nil
-	}
-	return golisp.FloatWithValue(float32(bestF)), nil
+func bufferNarrowedPImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	return golisp.BooleanWithValue(buf != nil && buf.narrowStart != nil), nil
 }
 
-func maxImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	best := golisp.Car(args)
-	if !golisp.NumberP(best) {
-		return nil, fmt.Errorf("max expects numbers, got %s", golisp.String(best))
+// saveRestrictionImpl puts back the narrowing of the current buffer when
+// its body is done, however it ends. The saved bounds follow edits the
+// body makes.
+func saveRestrictionImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return beginAliasImpl(args, env)
 	}
-	bestF := float64(golisp.FloatValue(best))
-	if golisp.IntegerP(best) {
-		bestF = float64(golisp.IntegerValue(best))
+	var start, end *elMarker
+	if buf.narrowStart != nil {
+		start, end = newMarker(), newMarker()
+		start.set(buf, buf.narrowStart.pos)
+		end.set(buf, buf.narrowEnd.pos)
+		end.insertionType = true
 	}
-	allInt := golisp.IntegerP(best)
-	for c := golisp.Cdr(args); golisp.NotNilP(c); c = golisp.Cdr(c) {
-		v := golisp.Car(c)
-		if !golisp.NumberP(v) {
-			return nil, fmt.Errorf("max expects numbers, got %s", golisp.String(v))
-		}
-		f := float64(golisp.FloatValue(v))
-		if golisp.IntegerP(v) {
-			f = float64(golisp.IntegerValue(v))
-		} else {
-			allInt = false
-		}
-		if f > bestF {
-			bestF = f
+	defer func() {
+		if start == nil || start.buffer != buf {
+			buf.widen()
+			return
 		}
-	}
-	if allInt {
-		return golisp.IntegerWithValue(int64(bestF)), nil
-	}
-	return golisp.FloatWithValue(float32(bestF)), nil
+		buf.narrow(start.pos, end.pos)
+		start.set(nil, 0)
+		end.set(nil, 0)
+	}()
+	return beginAliasImpl(args, env)
 }
 
-func absImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	switch {
-	case golisp.IntegerP(v):
-		n := golisp.IntegerValue(v)
-		if n < 0 {
-			n = -n
-		}
-		return golisp.IntegerWithValue(n), nil
-	case golisp.FloatP(v):
-		f := float64(golisp.FloatValue(v))
-		if f < 0 {
-			f = -f
-		}
-		return golisp.FloatWithValue(float32(f)), nil
-	default:
-		return golisp.IntegerWithValue(0), nil
-	}
+// elOverlay gives [start, end) of a buffer properties of its own, which
+// are drawn over the text properties there. A deleted overlay has no
+// buffer. The advance flags say whether start and end move along with
+// text inserted right at them.
+type elOverlay struct {
+	object       *golisp.Data
+	buffer       *elBuffer
+	start, end   int
+	plist        *golisp.Data
+	frontAdvance bool
+	rearAdvance  bool
 }
 
-func floorImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	a := golisp.Car(args)
-	num, ok := numberAsFloat(a)
-	if !ok {
-		return golisp.IntegerWithValue(0), nil
+// get returns the overlay's prop, falling back on the properties of its
+// category symbol as Emacs does.
+func (o *elOverlay) get(prop string) *golisp.Data {
+	if v, ok := plistGet(o.plist, prop); ok {
+		return v
 	}
-	if golisp.NotNilP(golisp.Cdr(args)) {
-		b := golisp.Cadr(args)
-		den, ok := numberAsFloat(b)
-		if !ok || den == 0 {
-			return golisp.IntegerWithValue(0), nil
+	if cat, ok := plistGet(o.plist, "category"); ok && golisp.SymbolP(cat) {
+		if v, ok := rtGlobal.propsFor(golisp.StringValue(cat))[prop]; ok {
+			return v
 		}
-		num = num / den
 	}
-	return golisp.IntegerWithValue(int64(math.Floor(num))), nil
+	return golisp.EmptyCons()
 }
 
-func oddpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	if !golisp.IntegerP(v) {
-		return golisp.BooleanWithValue(false), nil
+func (o *elOverlay) priority() int64 {
+	if p := o.get("priority"); golisp.IntegerP(p) {
+		return golisp.IntegerValue(p)
 	}
-	return golisp.BooleanWithValue((golisp.IntegerValue(v) % 2) != 0), nil
+	return 0
 }
 
-func evenpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	if !golisp.IntegerP(v) {
-		return golisp.BooleanWithValue(false), nil
+// attach puts the overlay over [start, end) of buf, in either order.
+func (o *elOverlay) attach(buf *elBuffer, start, end int) {
+	if start > end {
+		start, end = end, start
 	}
-	return golisp.BooleanWithValue((golisp.IntegerValue(v) % 2) == 0), nil
-}
-
-func equalImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(golisp.IsEqual(golisp.Car(args), golisp.Cadr(args))), nil
+	if o.buffer != buf {
+		o.detach()
+		buf.overlays = append(buf.overlays, o)
+		o.buffer = buf
+	}
+	o.start = min(max(start, 0), len(buf.text))
+	o.end = min(max(end, 0), len(buf.text))
 }
 
-func numberAsFloat(v *golisp.Data) (float64, bool) {
-	switch {
-	case golisp.IntegerP(v):
-		return float64(golisp.IntegerValue(v)), true
-	case golisp.FloatP(v):
-		return float64(golisp.FloatValue(v)), true
-	default:
-		return 0, false
+func (o *elOverlay) detach() {
+	if o.buffer != nil {
+		o.buffer.overlays = slices.DeleteFunc(o.buffer.overlays, func(x *elOverlay) bool { return x == o })
+		o.buffer = nil
 	}
 }
 
-func compareChain(args *golisp.Data, cmp func(a, b float64) bool) (*golisp.Data, error) {
-	items := golisp.ToArray(args)
-	if len(items) < 2 {
-		return nil, fmt.Errorf("comparison expects at least 2 arguments")
-	}
-	prev, ok := numberAsFloat(items[0])
-	if !ok {
-		return golisp.BooleanWithValue(false), nil
-	}
-	for i := 1; i < len(items); i++ {
-		cur, ok := numberAsFloat(items[i])
-		if !ok {
-			return golisp.BooleanWithValue(false), nil
-		}
-		if !cmp(prev, cur) {
-			return golisp.BooleanWithValue(false), nil
+// overlaysAt returns the overlays of b over pos, lowest priority first,
+// so that later ones win.
+func (b *elBuffer) overlaysAt(pos int) []*elOverlay {
+	var out []*elOverlay
+	for _, o := range b.overlays {
+		if o.start <= pos && pos < o.end {
+			out = append(out, o)
 		}
-		prev = cur
 	}
-	return golisp.BooleanWithValue(true), nil
-}
-
-func lessImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return compareChain(args, func(a, b float64) bool { return a < b })
-}
-
-func lessEqImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return compareChain(args, func(a, b float64) bool { return a <= b })
+	slices.SortStableFunc(out, func(x, y *elOverlay) int {
+		return cmp.Compare(x.priority(), y.priority())
+	})
+	return out
 }
 
-func greaterImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return compareChain(args, func(a, b float64) bool { return a > b })
+// overlaysIn returns the overlays of b that overlap [start, end), along
+// with empty ones at start, or at end when that is the end of the text.
+func (b *elBuffer) overlaysIn(start, end int) []*elOverlay {
+	var out []*elOverlay
+	for _, o := range b.overlays {
+		switch {
+		case o.start == o.end:
+			if o.start == start || (start <= o.start && o.start < end) || (o.start == end && end == len(b.text)) {
+				out = append(out, o)
+			}
+		case o.start < end && o.end > start:
+			out = append(out, o)
+		}
+	}
+	return out
 }
 
-func greaterEqImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return compareChain(args, func(a, b float64) bool { return a >= b })
+func overlayArg(d *golisp.Data) (*elOverlay, error) {
+	if golisp.ObjectP(d) && golisp.ObjectType(d) == "el-overlay" {
+		return (*elOverlay)(golisp.ObjectValue(d)), nil
+	}
+	return nil, fmt.Errorf("wrong-type-argument overlayp %s", golisp.String(d))
 }
 
-func setImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := golisp.Car(args)
-	v := golisp.Cadr(args)
-	if !golisp.SymbolP(s) {
-		return nil, fmt.Errorf("set expects symbol as first argument, got %s", golisp.String(s))
+// bufferArg returns the buffer d names, or the current buffer for nil.
+func (rt *runtimeState) bufferArg(d *golisp.Data) *elBuffer {
+	if golisp.NilP(d) {
+		return rt.currentBuffer()
 	}
-	if _, err := env.SetTo(s, v); err != nil {
-		if _, err2 := env.BindTo(s, v); err2 != nil {
-			return nil, err2
-		}
+	if b, ok := rt.buffers[bufferNameFromArg(d)]; ok {
+		return b
 	}
-	return v, nil
+	return nil
 }
 
-func functionpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	return golisp.BooleanWithValue(golisp.FunctionOrPrimitiveP(v) || golisp.MacroP(v)), nil
+func (rt *runtimeState) makeOverlayImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.bufferArg(golisp.Caddr(args))
+	if buf == nil {
+		return nil, fmt.Errorf("make-overlay: no such buffer %s", golisp.String(golisp.Caddr(args)))
+	}
+	o := &elOverlay{
+		plist:        golisp.EmptyCons(),
+		frontAdvance: golisp.BooleanValue(golisp.Nth(args, 4)),
+		rearAdvance:  golisp.BooleanValue(golisp.Nth(args, 5)),
+	}
+	o.object = golisp.ObjectWithTypeAndValue("el-overlay", unsafe.Pointer(o))
+	o.attach(buf, positionArg(golisp.Car(args)), positionArg(golisp.Cadr(args)))
+	return o.object, nil
 }
 
-func atomImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(!golisp.PairP(golisp.Car(args))), nil
+func overlayPutImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil {
+		return nil, err
+	}
+	o.plist = plistPut(o.plist, golisp.Cadr(args), golisp.Caddr(args))
+	return golisp.Caddr(args), nil
 }
 
-func listpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	return golisp.BooleanWithValue(golisp.NilP(v) || golisp.ListP(v)), nil
+func overlayGetImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil {
+		return nil, err
+	}
+	return o.get(featureName(golisp.Cadr(args))), nil
 }
 
-func symbolpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(golisp.SymbolP(golisp.Car(args))), nil
+func overlayPropertiesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil {
+		return nil, err
+	}
+	return golisp.Copy(o.plist), nil
 }
 
-func internImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := featureName(golisp.Car(args))
-	if name == "" {
-		return golisp.EmptyCons(), nil
+func overlayStartImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil || o.buffer == nil {
+		return golisp.EmptyCons(), err
 	}
-	return golisp.Intern(name), nil
+	return golisp.IntegerWithValue(int64(o.start + 1)), nil
 }
 
-func symbolNameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := golisp.Car(args)
-	if golisp.SymbolP(s) {
-		return golisp.StringWithValue(golisp.StringValue(s)), nil
+func overlayEndImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil || o.buffer == nil {
+		return golisp.EmptyCons(), err
 	}
-	return golisp.StringWithValue(golisp.String(s)), nil
+	return golisp.IntegerWithValue(int64(o.end + 1)), nil
 }
 
-func stringpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(golisp.StringP(golisp.Car(args))), nil
+func overlayBufferImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil || o.buffer == nil {
+		return golisp.EmptyCons(), err
+	}
+	return o.buffer.object, nil
 }
 
-func facepImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	return golisp.BooleanWithValue(golisp.SymbolP(v) || golisp.StringP(v)), nil
+func overlaypImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	_, err := overlayArg(golisp.Car(args))
+	return golisp.BooleanWithValue(err == nil), nil
 }
 
-func symbolValueImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := golisp.Car(args)
-	if !golisp.SymbolP(s) {
-		return nil, fmt.Errorf("symbol-value expects symbol, got %s", golisp.String(s))
+func (rt *runtimeState) moveOverlayImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil {
+		return nil, err
 	}
-	return env.ValueOf(s), nil
+	buf := o.buffer
+	if golisp.NotNilP(golisp.Nth(args, 4)) || buf == nil {
+		buf = rt.bufferArg(golisp.Nth(args, 4))
+	}
+	if buf == nil {
+		return nil, fmt.Errorf("move-overlay: no such buffer %s", golisp.String(golisp.Nth(args, 4)))
+	}
+	o.attach(buf, positionArg(golisp.Cadr(args)), positionArg(golisp.Caddr(args)))
+	return o.object, nil
 }
 
-func symbolFunctionImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := golisp.Car(args)
-	if !golisp.SymbolP(s) {
-		return golisp.EmptyCons(), nil
-	}
-	v := env.ValueOf(s)
-	if golisp.FunctionOrPrimitiveP(v) || golisp.MacroP(v) {
-		return v, nil
+func deleteOverlayImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	o, err := overlayArg(golisp.Car(args))
+	if err != nil {
+		return nil, err
 	}
+	o.detach()
 	return golisp.EmptyCons(), nil
 }
 
-func internSoftImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	name := featureName(golisp.Car(args))
-	if name == "" {
-		return golisp.EmptyCons(), nil
+func overlayObjects(overlays []*elOverlay) *golisp.Data {
+	items := make([]*golisp.Data, len(overlays))
+	for i, o := range overlays {
+		items[i] = o.object
 	}
-	return golisp.Intern(name), nil
+	return golisp.ArrayToList(items)
 }
 
-func natnumpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	v := golisp.Car(args)
-	return golisp.BooleanWithValue(golisp.IntegerP(v) && golisp.IntegerValue(v) >= 0), nil
+func overlaysAtImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	overlays := buf.overlaysAt(positionArg(golisp.Car(args)))
+	// SORTED asks for decreasing priority.
+	slices.Reverse(overlays)
+	return overlayObjects(overlays), nil
 }
 
-func regexpQuoteImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.StringWithValue(regexp.QuoteMeta(featureName(golisp.Car(args)))), nil
+func overlaysInImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	start := positionArg(golisp.Car(args))
+	end := positionArg(golisp.Cadr(args))
+	if start > end {
+		start, end = end, start
+	}
+	return overlayObjects(buf.overlaysIn(start, end)), nil
 }
 
-func displayColorPImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(true), nil
+// nextOverlayChange returns the first overlay start or end after pos,
+// or the end of the text.
+func nextOverlayChangeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return golisp.IntegerWithValue(1), nil
+	}
+	pos := positionArg(golisp.Car(args))
+	next := len(buf.text)
+	for _, o := range buf.overlays {
+		for _, p := range [2]int{o.start, o.end} {
+			if p > pos && p < next {
+				next = p
+			}
+		}
+	}
+	return golisp.IntegerWithValue(int64(next + 1)), nil
 }
 
-func displayImagesPImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(false), nil
+// removeOverlaysImpl deletes the overlays in [BEG, END) whose NAME
+// property is VAL, all of them when NAME is nil. Overlays reaching out
+// of the region are cut back to the part outside it instead.
+func (rt *runtimeState) removeOverlaysImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rt.currentBuffer()
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	start, end := 0, len(buf.text)
+	if positionP(golisp.Car(args)) {
+		start = positionArg(golisp.Car(args))
+	}
+	if positionP(golisp.Cadr(args)) {
+		end = positionArg(golisp.Cadr(args))
+	}
+	if start > end {
+		start, end = end, start
+	}
+	name, value := golisp.Caddr(args), golisp.Nth(args, 4)
+	for _, o := range buf.overlaysIn(start, end) {
+		if golisp.NotNilP(name) && !golisp.IsEqual(o.get(featureName(name)), value) {
+			continue
+		}
+		switch {
+		case o.start < start && o.end > end:
+			rest := *o
+			rest.object = golisp.ObjectWithTypeAndValue("el-overlay", unsafe.Pointer(&rest))
+			rest.buffer = nil
+			rest.attach(buf, end, o.end)
+			o.end = start
+		case o.start < start:
+			o.end = start
+		case o.end > end:
+			o.start = end
+		default:
+			o.detach()
+		}
+	}
+	return golisp.EmptyCons(), nil
 }
 
-func frameVisiblePImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(true), nil
+// charProperty returns prop at pos of buf, where overlays take
+// precedence over text properties, the highest priority one first.
+func (b *elBuffer) charProperty(pos int, prop string) *golisp.Data {
+	overlays := b.overlaysAt(pos)
+	for i := len(overlays) - 1; i >= 0; i-- {
+		if v := overlays[i].get(prop); golisp.NotNilP(v) {
+			return v
+		}
+	}
+	v, _ := plistGet(b.propsAt(pos), prop)
+	return v
 }
 
-func visibleFrameListImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.ArrayToList([]*golisp.Data{golisp.Intern("frame-0")}), nil
+func getCharPropertyImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	object := golisp.Caddr(args)
+	if golisp.StringP(object) {
+		return getTextPropertyImpl(args, env)
+	}
+	buf := rtGlobal.bufferArg(object)
+	if buf == nil {
+		return golisp.EmptyCons(), nil
+	}
+	return buf.charProperty(positionArg(golisp.Car(args)), featureName(golisp.Cadr(args))), nil
 }
 
-func selectedFrameImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.Intern("frame-0"), nil
+// invisible reports whether an invisible property of v hides text,
+// going by buffer-invisibility-spec: t hides anything, and a list hides
+// the values in it, or listed as (VALUE . ELLIPSIS).
+func (rt *runtimeState) invisible(v *golisp.Data) bool {
+	if golisp.NilP(v) {
+		return false
+	}
+	spec, ok := rt.boundValue(golisp.Intern("buffer-invisibility-spec"))
+	if !ok {
+		return true
+	}
+	if !golisp.PairP(spec) {
+		return golisp.BooleanValue(spec)
+	}
+	values := []*golisp.Data{v}
+	if golisp.PairP(v) {
+		values = golisp.ToArray(v)
+	}
+	for c := spec; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+		entry := golisp.Car(c)
+		if golisp.PairP(entry) {
+			entry = golisp.Car(entry)
+		}
+		for _, x := range values {
+			if golisp.IsEqual(x, entry) {
+				return true
+			}
+		}
+	}
+	return false
 }
 
-func frameSelectedWindowImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return rtGlobal.selectedWindow().object, nil
+// textFace returns the face a character is drawn with: its face
+// property, or else its font-lock-face property.
+func textFace(plist *golisp.Data) *golisp.Data {
+	if v, ok := plistGet(plist, "face"); ok && golisp.NotNilP(v) {
+		return v
+	}
+	v, _ := plistGet(plist, "font-lock-face")
+	return v
 }
 
-func selectFrameImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	if golisp.NotNilP(args) {
-		return golisp.Car(args), nil
+// faceFlag is an on/off face attribute that can also be left unspecified,
+// so that it is taken from an inherited face or from default.
+type faceFlag int8
+
+const (
+	flagUnspecified faceFlag = iota
+	flagOn
+	flagOff
+)
+
+func flagOf(on bool) faceFlag {
+	if on {
+		return flagOn
+	}
+	return flagOff
+}
+
+// elFace holds the attributes set on a face. Color names are kept as
+// given so face-foreground can return them; "" means unspecified.
+type elFace struct {
+	foreground string
+	background string
+	fg, bg     termColor
+	bold       faceFlag
+	underline  faceFlag
+	inverse    faceFlag
+	inherit    []string
+	declared   bool // by defface or as a standard face
+}
+
+// faceStyle is a face with inheritance resolved, as the screen draws it.
+type faceStyle struct {
+	fg, bg                   termColor
+	bold, underline, inverse bool
+}
+
+// standardFaces are the faces faces.el and font-lock.el define, with the
+// attributes Emacs uses for them on a tty with a dark background.
+var standardFaces = []struct {
+	name, fg, bg, inherit    string
+	bold, underline, inverse bool
+}{
+	{name: "default"},
+	{name: "bold", bold: true},
+	{name: "italic", underline: true},
+	{name: "bold-italic", bold: true, underline: true},
+	{name: "underline", underline: true},
+	{name: "fixed-pitch"},
+	{name: "variable-pitch"},
+	{name: "shadow", fg: "grey70"},
+	{name: "link", fg: "cyan1", underline: true},
+	{name: "highlight", bg: "darkolivegreen"},
+	{name: "region", bg: "blue3"},
+	{name: "secondary-selection", bg: "SkyBlue4"},
+	{name: "match", bg: "RoyalBlue3"},
+	{name: "isearch", fg: "brown4", bg: "palevioletred2"},
+	{name: "lazy-highlight", bg: "paleturquoise4"},
+	{name: "error", fg: "Pink", bold: true},
+	{name: "warning", fg: "DarkOrange", bold: true},
+	{name: "success", fg: "Green1", bold: true},
+	{name: "mode-line", inverse: true},
+	{name: "mode-line-inactive", inherit: "mode-line"},
+	{name: "header-line", inherit: "mode-line"},
+	{name: "minibuffer-prompt", fg: "cyan"},
+	{name: "font-lock-comment-face", fg: "chocolate1"},
+	{name: "font-lock-comment-delimiter-face", inherit: "font-lock-comment-face"},
+	{name: "font-lock-string-face", fg: "LightSalmon"},
+	{name: "font-lock-doc-face", inherit: "font-lock-string-face"},
+	{name: "font-lock-keyword-face", fg: "Cyan1"},
+	{name: "font-lock-builtin-face", fg: "LightSteelBlue"},
+	{name: "font-lock-function-name-face", fg: "LightSkyBlue"},
+	{name: "font-lock-variable-name-face", fg: "LightGoldenrod"},
+	{name: "font-lock-type-face", fg: "PaleGreen"},
+	{name: "font-lock-constant-face", fg: "Aquamarine"},
+	{name: "font-lock-warning-face", inherit: "error"},
+	{name: "font-lock-negation-char-face"},
+	{name: "font-lock-preprocessor-face", inherit: "font-lock-builtin-face"},
+}
+
+func (rt *runtimeState) defineStandardFaces() {
+	for _, s := range standardFaces {
+		f := rt.face(s.name)
+		f.declared = true
+		if s.fg != "" {
+			rt.setFaceColor(f, false, s.fg)
+		}
+		if s.bg != "" {
+			rt.setFaceColor(f, true, s.bg)
+		}
+		if s.bold {
+			f.bold = flagOn
+		}
+		if s.underline {
+			f.underline = flagOn
+		}
+		if s.inverse {
+			f.inverse = flagOn
+		}
+		if s.inherit != "" {
+			f.inherit = []string{s.inherit}
+		}
+	}
+}
+
+func (rt *runtimeState) face(name string) *elFace {
+	if rt.faces == nil {
+		rt.faces = make(map[string]*elFace)
+	}
+	f, ok := rt.faces[name]
+	if !ok {
+		f = &elFace{}
+		rt.faces[name] = f
 	}
-	return selectedFrameImpl(nil, nil)
+	return f
 }
 
-func windowFrameImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.Intern("frame-0"), nil
+func faceName(d *golisp.Data) (string, error) {
+	if golisp.SymbolP(d) || golisp.StringP(d) {
+		return golisp.StringValue(d), nil
+	}
+	return "", fmt.Errorf("invalid face: %s", golisp.String(d))
 }
 
-func frameParameterImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	param := featureName(golisp.Cadr(args))
-	switch param {
-	case "cursor-type":
-		return golisp.Intern("box"), nil
-	default:
-		return golisp.EmptyCons(), nil
+// setFaceColor resolves color through the same table the renderer uses.
+// Unknown names leave the attribute unspecified, as a tty frame does.
+func (rt *runtimeState) setFaceColor(f *elFace, background bool, color string) {
+	c, ok := lookupColor(color)
+	if !ok {
+		rt.warnOnce("color-"+color, "unknown color name: %s", color)
+		color = ""
+	}
+	if background {
+		f.background, f.bg = color, c
+	} else {
+		f.foreground, f.fg = color, c
 	}
 }
 
-func frameMonitorAttributesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// Minimal subset expected by gamegrid: geometry and workarea vectors.
-	geom := golisp.ArrayToList([]*golisp.Data{
-		golisp.IntegerWithValue(0), golisp.IntegerWithValue(0),
-		golisp.IntegerWithValue(1024), golisp.IntegerWithValue(768),
-	})
-	work := golisp.ArrayToList([]*golisp.Data{
-		golisp.IntegerWithValue(0), golisp.IntegerWithValue(0),
-		golisp.IntegerWithValue(1024), golisp.IntegerWithValue(768),
-	})
-	return golisp.ArrayToList([]*golisp.Data{
-		golisp.Cons(golisp.Intern("geometry"), geom),
-		golisp.Cons(golisp.Intern("workarea"), work),
-	}), nil
+func isUnspecified(v *golisp.Data) bool {
+	return golisp.SymbolP(v) && golisp.StringValue(v) == "unspecified"
 }
 
-func windowBodyPixelEdgesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// left top right bottom
-	return golisp.ArrayToList([]*golisp.Data{
-		golisp.IntegerWithValue(0),
-		golisp.IntegerWithValue(0),
-		golisp.IntegerWithValue(1024),
-		golisp.IntegerWithValue(768),
-	}), nil
+// setFaceAttrs applies a face attribute plist such as
+// (:foreground "red" :weight bold). Attributes a tty cannot show, like
+// :height or :family, are accepted and dropped.
+func (rt *runtimeState) setFaceAttrs(f *elFace, plist *golisp.Data) {
+	flag := func(v *golisp.Data) faceFlag {
+		if isUnspecified(v) {
+			return flagUnspecified
+		}
+		return flagOf(golisp.BooleanValue(v))
+	}
+	for c := plist; golisp.NotNilP(c) && golisp.NotNilP(golisp.Cdr(c)); c = golisp.Cddr(c) {
+		v := golisp.Cadr(c)
+		switch key := featureName(golisp.Car(c)); key {
+		case ":foreground", ":background":
+			color := ""
+			if golisp.StringP(v) {
+				color = golisp.StringValue(v)
+			}
+			rt.setFaceColor(f, key == ":background", color)
+		case ":weight":
+			if isUnspecified(v) {
+				f.bold = flagUnspecified
+				break
+			}
+			w := featureName(v)
+			f.bold = flagOf(w == "bold" || strings.HasSuffix(w, "-bold") || w == "heavy" || w == "black")
+		case ":bold":
+			f.bold = flag(v)
+		case ":underline":
+			f.underline = flag(v)
+		case ":slant", ":italic":
+			// Like Emacs on a tty without italics, show italic as underline.
+			if golisp.BooleanValue(v) && featureName(v) != "normal" && !isUnspecified(v) {
+				f.underline = flagOn
+			}
+		case ":inverse-video", ":reverse-video":
+			f.inverse = flag(v)
+		case ":inherit":
+			f.inherit = nil
+			switch {
+			case golisp.SymbolP(v) && !isUnspecified(v):
+				f.inherit = []string{golisp.StringValue(v)}
+			case golisp.NotNilP(v) && golisp.PairP(v):
+				for _, p := range golisp.ToArray(v) {
+					f.inherit = append(f.inherit, featureName(p))
+				}
+			}
+		}
+	}
 }
 
-func linePixelHeightImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(1), nil
+// faceSpecAttrs returns the attribute plists a defface SPEC selects here:
+// that of a default entry, then that of the first matching display.
+func (rt *runtimeState) faceSpecAttrs(spec *golisp.Data) []*golisp.Data {
+	var plists []*golisp.Data
+	for _, entry := range golisp.ToArray(spec) {
+		if golisp.NilP(entry) || !golisp.PairP(entry) {
+			continue
+		}
+		display, atts := golisp.Car(entry), golisp.Cdr(entry)
+		// Old-style entries wrap the plist in a list: (DISPLAY (ATTS...)).
+		if golisp.NotNilP(golisp.Car(atts)) && golisp.PairP(golisp.Car(atts)) && golisp.NilP(golisp.Cdr(atts)) {
+			atts = golisp.Car(atts)
+		}
+		if golisp.SymbolP(display) && golisp.StringValue(display) == "default" {
+			plists = append(plists, atts)
+			continue
+		}
+		if rt.faceDisplayMatches(display) {
+			return append(plists, atts)
+		}
+	}
+	return plists
 }
 
-func makeStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	n := int(golisp.IntegerValue(golisp.Car(args)))
-	fill := golisp.Cadr(args)
-	if n < 0 {
-		n = 0
+// faceDisplayMatches tests a defface DISPLAY against a color tty with a
+// dark background.
+func (rt *runtimeState) faceDisplayMatches(display *golisp.Data) bool {
+	switch {
+	case golisp.BooleanP(display):
+		return golisp.BooleanValue(display)
+	case golisp.SymbolP(display):
+		return golisp.StringValue(display) == "t"
+	case golisp.NilP(display) || !golisp.PairP(display):
+		return false
 	}
-	ch := rune(0)
-	if golisp.IntegerP(fill) {
-		ch = rune(golisp.IntegerValue(fill))
-	} else {
-		s := featureName(fill)
-		if s != "" {
-			ch = []rune(s)[0]
+	for _, req := range golisp.ToArray(display) {
+		values := golisp.ToArray(golisp.Cdr(req))
+		anyValue := func(ok func(v *golisp.Data) bool) bool {
+			return slices.ContainsFunc(values, ok)
+		}
+		switch featureName(golisp.Car(req)) {
+		case "type":
+			if !anyValue(func(v *golisp.Data) bool { return featureName(v) == "tty" }) {
+				return false
+			}
+		case "class":
+			if !anyValue(func(v *golisp.Data) bool { return featureName(v) == "color" }) {
+				return false
+			}
+		case "background":
+			if !anyValue(func(v *golisp.Data) bool { return featureName(v) == "dark" }) {
+				return false
+			}
+		case "min-colors":
+			if !anyValue(func(v *golisp.Data) bool {
+				return golisp.IntegerP(v) && golisp.IntegerValue(v) <= int64(terminalColorDepth().colors())
+			}) {
+				return false
+			}
+		case "supports":
+		default:
+			return false
 		}
 	}
-	if ch == 0 {
-		ch = ' '
-	}
-	items := make([]*golisp.Data, n)
-	for i := 0; i < n; i++ {
-		items[i] = golisp.IntegerWithValue(int64(ch))
-	}
-	return newElVector(items), nil
+	return true
 }
 
-func mapcarImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	fn := golisp.Car(args)
-	if golisp.PairP(fn) && golisp.SymbolP(golisp.Car(fn)) && golisp.StringValue(golisp.Car(fn)) == "quote" {
-		fn = golisp.Cadr(fn)
+// deffaceImpl declares a face from its SPEC. As in Emacs, a face that is
+// already declared keeps its attributes.
+func (rt *runtimeState) deffaceImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name := golisp.Car(args)
+	if !golisp.SymbolP(name) {
+		return nil, fmt.Errorf("defface target must be a symbol, got %s", golisp.String(name))
 	}
-	seq := golisp.Cadr(args)
-	out := make([]*golisp.Data, 0)
-	var iterate *golisp.Data
-	switch {
-	case golisp.StringP(seq):
-		rs := []rune(golisp.StringValue(seq))
-		items := make([]*golisp.Data, 0, len(rs))
-		for _, r := range rs {
-			items = append(items, golisp.IntegerWithValue(int64(r)))
-		}
-		iterate = golisp.ArrayToList(items)
-	case golisp.ListP(seq):
-		iterate = seq
-	case isElVector(seq):
-		iterate = golisp.ArrayToList(asElVector(seq).items)
-	default:
-		return golisp.EmptyCons(), nil
+	spec, err := golisp.Eval(golisp.Cadr(args), env)
+	if err != nil {
+		return nil, err
 	}
-	for c := iterate; golisp.NotNilP(c); c = golisp.Cdr(c) {
-		item := golisp.Car(c)
-		call := golisp.ArrayToList([]*golisp.Data{fn, item})
-		v, err := rtGlobal.funcallImpl(call, env)
-		if err != nil {
-			return nil, err
+	props := rt.propsFor(golisp.StringValue(name))
+	props["face-defface-spec"] = spec
+	if doc := golisp.Caddr(args); golisp.StringP(doc) {
+		props["face-documentation"] = doc
+	}
+	f := rt.face(golisp.StringValue(name))
+	if !f.declared {
+		f.declared = true
+		for _, plist := range rt.faceSpecAttrs(spec) {
+			rt.setFaceAttrs(f, plist)
 		}
-		out = append(out, v)
 	}
-	return golisp.ArrayToList(out), nil
+	if _, err := env.BindLocallyTo(name, name); err != nil {
+		return nil, err
+	}
+	return name, nil
 }
 
-func mapcImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	_, err := mapcarImpl(args, env)
+func (rt *runtimeState) makeFaceImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
+	if err != nil {
+		return nil, err
+	}
+	rt.face(name).declared = true
+	return golisp.Intern(name), nil
+}
+
+func (rt *runtimeState) copyFaceImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	from, err := faceName(golisp.Car(args))
 	if err != nil {
 		return nil, err
 	}
+	to, err := faceName(golisp.Cadr(args))
+	if err != nil {
+		return nil, err
+	}
+	f := *rt.face(from)
+	f.inherit = slices.Clone(f.inherit)
+	f.declared = true
+	*rt.face(to) = f
 	return golisp.Cadr(args), nil
 }
 
-func nconcImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	acc := make([]*golisp.Data, 0)
-	for c := args; golisp.NotNilP(c); c = golisp.Cdr(c) {
-		v := golisp.Car(c)
-		if golisp.ListP(v) {
-			acc = append(acc, golisp.ToArray(v)...)
-		}
+func (rt *runtimeState) facepImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
+	if err != nil {
+		return golisp.BooleanWithValue(false), nil
 	}
-	return golisp.ArrayToList(acc), nil
+	f, ok := rt.faces[name]
+	return golisp.BooleanWithValue(ok && f.declared), nil
 }
 
-func delqImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	item := golisp.Car(args)
-	seq := golisp.Cadr(args)
-	if !golisp.ListP(seq) {
-		return golisp.EmptyCons(), nil
-	}
-	out := make([]*golisp.Data, 0)
-	for c := seq; golisp.NotNilP(c); c = golisp.Cdr(c) {
-		v := golisp.Car(c)
-		if golisp.IsEqual(v, item) {
-			continue
-		}
-		out = append(out, v)
+func (rt *runtimeState) setFaceAttributeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
+	if err != nil {
+		return nil, err
 	}
-	return golisp.ArrayToList(out), nil
+	f := rt.face(name)
+	f.declared = true
+	rt.setFaceAttrs(f, golisp.Cddr(args))
+	return golisp.EmptyCons(), nil
 }
 
-func splitStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := featureName(golisp.Car(args))
-	sep := " "
-	if golisp.NotNilP(golisp.Cdr(args)) {
-		raw := featureName(golisp.Cadr(args))
-		if raw != "" {
-			sep = raw
-		}
+// faceAttributeImpl reports an attribute as Emacs does, with unspecified
+// for one the face leaves open.
+func (rt *runtimeState) faceAttributeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
+	if err != nil {
+		return nil, err
 	}
-	parts := strings.Split(s, sep)
-	out := make([]*golisp.Data, 0, len(parts))
-	for _, p := range parts {
-		if p == "" {
-			continue
+	f := rt.face(name)
+	unspecified := golisp.Intern("unspecified")
+	flag := func(v faceFlag, on, off *golisp.Data) *golisp.Data {
+		switch v {
+		case flagOn:
+			return on
+		case flagOff:
+			return off
 		}
-		out = append(out, golisp.StringWithValue(p))
+		return unspecified
 	}
-	return golisp.ArrayToList(out), nil
+	color := func(s string) *golisp.Data {
+		if s == "" {
+			return unspecified
+		}
+		return golisp.StringWithValue(s)
+	}
+	t, nilValue := golisp.BooleanWithValue(true), golisp.EmptyCons()
+	switch featureName(golisp.Cadr(args)) {
+	case ":foreground":
+		return color(f.foreground), nil
+	case ":background":
+		return color(f.background), nil
+	case ":weight":
+		return flag(f.bold, golisp.Intern("bold"), golisp.Intern("normal")), nil
+	case ":underline":
+		return flag(f.underline, t, nilValue), nil
+	case ":inverse-video":
+		return flag(f.inverse, t, nilValue), nil
+	case ":inherit":
+		switch len(f.inherit) {
+		case 0:
+			return unspecified, nil
+		case 1:
+			return golisp.Intern(f.inherit[0]), nil
+		}
+		items := make([]*golisp.Data, len(f.inherit))
+		for i, n := range f.inherit {
+			items[i] = golisp.Intern(n)
+		}
+		return golisp.ArrayToList(items), nil
+	}
+	return unspecified, nil
+}
+
+func (rt *runtimeState) setFaceAttr(args *golisp.Data, background bool) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
+	if err != nil {
+		return nil, err
+	}
+	color := golisp.Cadr(args)
+	switch {
+	case golisp.NilP(color):
+		rt.setFaceColor(rt.face(name), background, "")
+	case golisp.StringP(color):
+		rt.setFaceColor(rt.face(name), background, golisp.StringValue(color))
+	default:
+		return nil, fmt.Errorf("color must be a string, got %s", golisp.String(color))
+	}
+	return color, nil
 }
 
-func mapconcatImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	fn := golisp.Car(args)
-	seq := golisp.Cadr(args)
-	sep := featureName(golisp.Caddr(args))
-	call := golisp.ArrayToList([]*golisp.Data{fn, seq})
-	mapped, err := mapcarImpl(call, env)
+func (rt *runtimeState) setFaceBackgroundImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.setFaceAttr(args, true)
+}
+
+func (rt *runtimeState) setFaceForegroundImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.setFaceAttr(args, false)
+}
+
+func (rt *runtimeState) setFaceFlag(args *golisp.Data, set func(f *elFace, v faceFlag)) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
 	if err != nil {
 		return nil, err
 	}
-	parts := make([]string, 0)
-	for c := mapped; golisp.NotNilP(c); c = golisp.Cdr(c) {
-		parts = append(parts, featureName(golisp.Car(c)))
-	}
-	return golisp.StringWithValue(strings.Join(parts, sep)), nil
+	set(rt.face(name), flagOf(golisp.NotNilP(golisp.Cadr(args))))
+	return golisp.Cadr(args), nil
 }
 
-func downcaseImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.StringWithValue(strings.ToLower(featureName(golisp.Car(args)))), nil
+func (rt *runtimeState) setFaceBoldImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.setFaceFlag(args, func(f *elFace, v faceFlag) { f.bold = v })
 }
 
-func capitalizeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	s := []rune(strings.ToLower(featureName(golisp.Car(args))))
-	inWord := false
-	for i, r := range s {
-		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
-			if !inWord && r >= 'a' && r <= 'z' {
-				s[i] = rune(r - 32)
-			}
-			inWord = true
-		} else {
-			inWord = false
-		}
+func (rt *runtimeState) setFaceUnderlineImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.setFaceFlag(args, func(f *elFace, v faceFlag) { f.underline = v })
+}
+
+func (rt *runtimeState) setFaceInverseVideoImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.setFaceFlag(args, func(f *elFace, v faceFlag) { f.inverse = v })
+}
+
+func (rt *runtimeState) faceColorValue(args *golisp.Data, background bool) (*golisp.Data, error) {
+	name, err := faceName(golisp.Car(args))
+	if err != nil {
+		return nil, err
 	}
-	return golisp.StringWithValue(string(s)), nil
+	f := rt.face(name)
+	color := f.foreground
+	if background {
+		color = f.background
+	}
+	if color == "" {
+		return golisp.EmptyCons(), nil
+	}
+	return golisp.StringWithValue(color), nil
 }
 
-func prin1ToStringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.StringWithValue(golisp.String(golisp.Car(args))), nil
+func (rt *runtimeState) faceBackgroundImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.faceColorValue(args, true)
 }
 
-func makeSyntaxTableImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return keymapObject(newKeymap()), nil
+func (rt *runtimeState) faceForegroundImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	return rt.faceColorValue(args, false)
 }
 
-func modifySyntaxEntryImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.Car(args), nil
+// mergeFace fills the attributes acc leaves unspecified from f and then
+// from the faces f inherits from.
+func (rt *runtimeState) mergeFace(acc, f *elFace, depth int) {
+	if acc.foreground == "" && f.foreground != "" {
+		acc.foreground, acc.fg = f.foreground, f.fg
+	}
+	if acc.background == "" && f.background != "" {
+		acc.background, acc.bg = f.background, f.bg
+	}
+	if acc.bold == flagUnspecified {
+		acc.bold = f.bold
+	}
+	if acc.underline == flagUnspecified {
+		acc.underline = f.underline
+	}
+	if acc.inverse == flagUnspecified {
+		acc.inverse = f.inverse
+	}
+	if depth > 10 {
+		return
+	}
+	for _, name := range f.inherit {
+		if parent, ok := rt.faces[name]; ok {
+			rt.mergeFace(acc, parent, depth+1)
+		}
+	}
 }
 
-func setTextPropertiesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(true), nil
+// mergeFaceValue merges a face property value: a face name, an anonymous
+// face plist, a (foreground-color . COLOR) pair, or a list of these with
+// the first taking priority.
+func (rt *runtimeState) mergeFaceValue(acc *elFace, v *golisp.Data) {
+	switch {
+	case golisp.NilP(v):
+	case golisp.SymbolP(v), golisp.StringP(v):
+		if f, ok := rt.faces[golisp.StringValue(v)]; ok {
+			rt.mergeFace(acc, f, 0)
+		}
+	case golisp.PairP(v) && strings.HasPrefix(featureName(golisp.Car(v)), ":"):
+		anon := &elFace{}
+		rt.setFaceAttrs(anon, v)
+		rt.mergeFace(acc, anon, 0)
+	case golisp.PairP(v) && golisp.StringP(golisp.Cdr(v)):
+		anon := &elFace{}
+		switch featureName(golisp.Car(v)) {
+		case "foreground-color":
+			rt.setFaceColor(anon, false, golisp.StringValue(golisp.Cdr(v)))
+		case "background-color":
+			rt.setFaceColor(anon, true, golisp.StringValue(golisp.Cdr(v)))
+		}
+		rt.mergeFace(acc, anon, 0)
+	case golisp.PairP(v):
+		for c := v; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+			rt.mergeFaceValue(acc, golisp.Car(c))
+		}
+	}
 }
 
-func setFaceBackgroundImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.Cadr(args), nil
+// faceStyleFor resolves a face property value on top of the default face.
+func (rt *runtimeState) faceStyleFor(v *golisp.Data) faceStyle {
+	acc := &elFace{}
+	rt.mergeFaceValue(acc, v)
+	rt.mergeFace(acc, rt.face("default"), 0)
+	return faceStyle{
+		fg:        acc.fg,
+		bg:        acc.bg,
+		bold:      acc.bold == flagOn,
+		underline: acc.underline == flagOn,
+		inverse:   acc.inverse == flagOn,
+	}
 }
 
 func insertImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -2663,26 +7490,26 @@ func insertImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, er
 	if buf.point > len(buf.text) {
 		buf.point = len(buf.text)
 	}
-	var sb strings.Builder
+	var rs []rune
+	var props []propInterval
 	for c := args; golisp.NotNilP(c); c = golisp.Cdr(c) {
 		v := golisp.Car(c)
 		switch {
 		case golisp.IntegerP(v):
-			sb.WriteRune(rune(golisp.IntegerValue(v)))
-		case golisp.StringP(v), golisp.SymbolP(v):
-			sb.WriteString(golisp.StringValue(v))
+			rs = append(rs, rune(golisp.IntegerValue(v)))
+		case golisp.StringP(v):
+			props = pasteProps(props, math.MaxInt, len(rs), stringPropsOf(v))
+			rs = append(rs, []rune(golisp.StringValue(v))...)
+		case golisp.SymbolP(v):
+			rs = append(rs, []rune(golisp.StringValue(v))...)
 		default:
-			sb.WriteString(golisp.String(v))
+			rs = append(rs, []rune(golisp.String(v))...)
 		}
 	}
-	rs := []rune(sb.String())
 	if len(rs) == 0 {
 		return golisp.EmptyCons(), nil
 	}
-	left := append([]rune{}, buf.text[:buf.point]...)
-	right := append([]rune{}, buf.text[buf.point:]...)
-	buf.text = append(left, append(rs, right...)...)
-	buf.point += len(rs)
+	buf.insertTextWithProps(buf.point, rs, props)
 	return golisp.EmptyCons(), nil
 }
 
@@ -2730,8 +7557,8 @@ func insertCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data
 func eraseBufferImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
 	if buf != nil {
-		buf.text = nil
-		buf.point = 0
+		buf.widen()
+		buf.deleteText(0, len(buf.text))
 	}
 	return golisp.EmptyCons(), nil
 }
@@ -2741,17 +7568,35 @@ func deleteBlankLinesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.D
 	if buf == nil || len(buf.text) == 0 {
 		return golisp.EmptyCons(), nil
 	}
-	lines := strings.Split(string(buf.text), "\n")
-	out := make([]string, 0, len(lines))
-	for _, ln := range lines {
-		if strings.TrimSpace(ln) == "" {
-			continue
-		}
-		out = append(out, ln)
+	// Only the accessible region is cleaned up. Each blank line goes
+	// with its newline, a blank last line with the one before it. Lines
+	// are deleted from the end, so the positions before them stay put,
+	// and through deleteText, so undo and markers see each deletion.
+	begv, end := buf.begv(), buf.zv()
+	if end == begv {
+		return golisp.EmptyCons(), nil
 	}
-	buf.text = []rune(strings.Join(out, "\n"))
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
+	if buf.text[end-1] == '\n' {
+		// The region ends at a line start: there is no last line.
+		end--
+	}
+	for {
+		start := end
+		for start > begv && buf.text[start-1] != '\n' {
+			start--
+		}
+		if strings.TrimSpace(string(buf.text[start:end])) == "" {
+			switch {
+			case end < buf.zv():
+				buf.deleteText(start, end+1)
+			case start > begv:
+				buf.deleteText(start-1, end)
+			}
+		}
+		if start == begv {
+			break
+		}
+		end = start - 1
 	}
 	return golisp.EmptyCons(), nil
 }
@@ -2859,18 +7704,17 @@ func setWindowStartImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.
 
 func setWindowPointImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	p := golisp.Cadr(args)
-	if golisp.IntegerP(p) {
+	if positionP(p) {
 		buf := rtGlobal.currentBuffer()
 		if buf != nil {
-			n := min(max(int(golisp.IntegerValue(p))-1, 0), len(buf.text))
-			buf.point = n
+			buf.point = buf.clampPos(positionArg(p))
 		}
 	}
 	return p, nil
 }
 
 func windowStartImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(1), nil
+	return golisp.IntegerWithValue(int64(rtGlobal.selectedWindow().start + 1)), nil
 }
 
 func windowEndImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -2878,7 +7722,7 @@ func windowEndImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, er
 	if buf == nil {
 		return golisp.IntegerWithValue(1), nil
 	}
-	return golisp.IntegerWithValue(int64(len(buf.text) + 1)), nil
+	return golisp.IntegerWithValue(int64(buf.zv() + 1)), nil
 }
 
 func windowPointImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -2890,7 +7734,11 @@ func windowPointImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 }
 
 func pointMinImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.IntegerWithValue(1), nil
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return golisp.IntegerWithValue(1), nil
+	}
+	return golisp.IntegerWithValue(int64(buf.begv() + 1)), nil
 }
 
 func pointMaxImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -2898,12 +7746,12 @@ func pointMaxImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, err
 	if buf == nil {
 		return golisp.IntegerWithValue(1), nil
 	}
-	return golisp.IntegerWithValue(int64(len(buf.text) + 1)), nil
+	return golisp.IntegerWithValue(int64(buf.zv() + 1)), nil
 }
 
 func followingCharImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
-	if buf == nil || buf.point >= len(buf.text) {
+	if buf == nil || buf.point >= buf.zv() {
 		return golisp.IntegerWithValue(0), nil
 	}
 	return golisp.IntegerWithValue(int64(buf.text[buf.point])), nil
@@ -2915,10 +7763,10 @@ func charAfterImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 		return golisp.IntegerWithValue(0), nil
 	}
 	p := buf.point
-	if golisp.NotNilP(args) && golisp.IntegerP(golisp.Car(args)) {
-		p = int(golisp.IntegerValue(golisp.Car(args))) - 1
+	if golisp.NotNilP(args) && positionP(golisp.Car(args)) {
+		p = positionArg(golisp.Car(args))
 	}
-	if p < 0 || p >= len(buf.text) {
+	if p < buf.begv() || p >= buf.zv() {
 		return golisp.IntegerWithValue(0), nil
 	}
 	return golisp.IntegerWithValue(int64(buf.text[p])), nil
@@ -2926,7 +7774,7 @@ func charAfterImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 
 func precedingCharImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
-	if buf == nil || buf.point <= 0 || buf.point-1 >= len(buf.text) {
+	if buf == nil || buf.point <= buf.begv() || buf.point > buf.zv() {
 		return golisp.IntegerWithValue(0), nil
 	}
 	return golisp.IntegerWithValue(int64(buf.text[buf.point-1])), nil
@@ -2937,7 +7785,7 @@ func eobpImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error)
 	if buf == nil {
 		return golisp.BooleanWithValue(true), nil
 	}
-	return golisp.BooleanWithValue(buf.point >= len(buf.text)), nil
+	return golisp.BooleanWithValue(buf.point >= buf.zv()), nil
 }
 
 func forwardLineImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -2952,43 +7800,44 @@ func forwardLineImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Dat
 	if n == 0 {
 		return golisp.IntegerWithValue(0), nil
 	}
+	lo, hi := buf.begv(), buf.zv()
 	lineStart := buf.point
-	for lineStart > 0 && buf.text[lineStart-1] != '\n' {
+	for lineStart > lo && buf.text[lineStart-1] != '\n' {
 		lineStart--
 	}
 	col := buf.point - lineStart
 	moveOne := func(dir int) bool {
 		if dir > 0 {
 			i := buf.point
-			for i < len(buf.text) && buf.text[i] != '\n' {
+			for i < hi && buf.text[i] != '\n' {
 				i++
 			}
-			if i >= len(buf.text) {
-				buf.point = len(buf.text)
+			if i >= hi {
+				buf.point = hi
 				return false
 			}
 			i++
 			j := i
-			for j < len(buf.text) && buf.text[j] != '\n' && (j-i) < col {
+			for j < hi && buf.text[j] != '\n' && (j-i) < col {
 				j++
 			}
 			buf.point = j
 			return true
 		}
 		i := buf.point
-		for i > 0 && buf.text[i-1] != '\n' {
+		for i > lo && buf.text[i-1] != '\n' {
 			i--
 		}
-		if i == 0 {
-			buf.point = 0
+		if i == lo {
+			buf.point = lo
 			return false
 		}
 		i--
-		for i > 0 && buf.text[i-1] != '\n' {
+		for i > lo && buf.text[i-1] != '\n' {
 			i--
 		}
 		j := i
-		for j < len(buf.text) && buf.text[j] != '\n' && (j-i) < col {
+		for j < hi && buf.text[j] != '\n' && (j-i) < col {
 			j++
 		}
 		buf.point = j
@@ -3025,7 +7874,7 @@ func beginningOfLineImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp
 	if n != 1 {
 		_, _ = forwardLineImpl(golisp.ArrayToList([]*golisp.Data{golisp.IntegerWithValue(int64(n - 1))}), nil)
 	}
-	for buf.point > 0 && buf.text[buf.point-1] != '\n' {
+	for buf.point > buf.begv() && buf.text[buf.point-1] != '\n' {
 		buf.point--
 	}
 	return golisp.IntegerWithValue(int64(buf.point + 1)), nil
@@ -3040,13 +7889,7 @@ func forwardCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Dat
 	if golisp.NotNilP(args) && golisp.IntegerP(golisp.Car(args)) {
 		n = int(golisp.IntegerValue(golisp.Car(args)))
 	}
-	buf.point += n
-	if buf.point < 0 {
-		buf.point = 0
-	}
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
-	}
+	buf.point = buf.clampPos(buf.point + n)
 	return golisp.IntegerWithValue(int64(buf.point + 1)), nil
 }
 
@@ -3062,7 +7905,7 @@ func endOfLineImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 	if n != 1 {
 		_, _ = forwardLineImpl(golisp.ArrayToList([]*golisp.Data{golisp.IntegerWithValue(int64(n - 1))}), nil)
 	}
-	for buf.point < len(buf.text) && buf.text[buf.point] != '\n' {
+	for buf.point < buf.zv() && buf.text[buf.point] != '\n' {
 		buf.point++
 	}
 	return golisp.IntegerWithValue(int64(buf.point + 1)), nil
@@ -3077,13 +7920,7 @@ func backwardCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Da
 	if golisp.NotNilP(args) && golisp.IntegerP(golisp.Car(args)) {
 		n = int(golisp.IntegerValue(golisp.Car(args)))
 	}
-	buf.point -= n
-	if buf.point < 0 {
-		buf.point = 0
-	}
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
-	}
+	buf.point = buf.clampPos(buf.point - n)
 	return golisp.IntegerWithValue(int64(buf.point + 1)), nil
 }
 
@@ -3092,20 +7929,8 @@ func countLinesImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data
 	if buf == nil {
 		return golisp.IntegerWithValue(0), nil
 	}
-	s := int(golisp.IntegerValue(golisp.Car(args))) - 1
-	e := int(golisp.IntegerValue(golisp.Cadr(args))) - 1
-	if s < 0 {
-		s = 0
-	}
-	if e < 0 {
-		e = 0
-	}
-	if s > len(buf.text) {
-		s = len(buf.text)
-	}
-	if e > len(buf.text) {
-		e = len(buf.text)
-	}
+	s := buf.clampPos(positionArg(golisp.Car(args)))
+	e := buf.clampPos(positionArg(golisp.Cadr(args)))
 	if s > e {
 		s, e = e, s
 	}
@@ -3129,13 +7954,8 @@ func lookingAtImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 		rtGlobal.clearMatchData()
 		return golisp.BooleanWithValue(false), nil
 	}
-	if buf.point < 0 {
-		buf.point = 0
-	}
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
-	}
-	segment := string(buf.text[buf.point:])
+	buf.point = buf.clampPos(buf.point)
+	segment := string(buf.text[buf.point:buf.zv()])
 	m := re.FindStringSubmatchIndex(segment)
 	if m != nil && m[0] == 0 {
 		rtGlobal.setBufferMatchData(buf, segment, buf.point, m)
@@ -3154,20 +7974,22 @@ func searchBackwardImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.
 	if needle == "" {
 		return golisp.IntegerWithValue(int64(buf.point + 1)), nil
 	}
-	limit := 0
-	if golisp.NotNilP(golisp.Cdr(args)) && golisp.IntegerP(golisp.Cadr(args)) {
-		limit = max(int(golisp.IntegerValue(golisp.Cadr(args)))-1, 0)
+	limit := buf.begv()
+	if golisp.NotNilP(golisp.Cdr(args)) && positionP(golisp.Cadr(args)) {
+		limit = buf.clampPos(positionArg(golisp.Cadr(args)))
 	}
-	segment := string(buf.text)
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
+	buf.point = buf.clampPos(buf.point)
+	if limit > buf.point {
+		rtGlobal.clearMatchData()
+		return golisp.EmptyCons(), nil
 	}
-	seg := segment[limit:buf.point]
+	seg := string(buf.text[limit:buf.point])
 	idx := strings.LastIndex(seg, needle)
 	if idx < 0 {
 		rtGlobal.clearMatchData()
 		return golisp.EmptyCons(), nil
 	}
+	idx = utf8.RuneCountInString(seg[:idx])
 	rtGlobal.matchData = []int{limit + idx + 1, limit + idx + len([]rune(needle)) + 1}
 	rtGlobal.matchInString = false
 	rtGlobal.matchString = ""
@@ -3185,15 +8007,14 @@ func searchForwardImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.D
 	if needle == "" {
 		return golisp.IntegerWithValue(int64(buf.point + 1)), nil
 	}
-	limit := len(buf.text)
-	if golisp.NotNilP(golisp.Cdr(args)) && golisp.IntegerP(golisp.Cadr(args)) {
-		limit = min(max(int(golisp.IntegerValue(golisp.Cadr(args)))-1, 0), len(buf.text))
-	}
-	if buf.point < 0 {
-		buf.point = 0
+	limit := buf.zv()
+	if golisp.NotNilP(golisp.Cdr(args)) && positionP(golisp.Cadr(args)) {
+		limit = buf.clampPos(positionArg(golisp.Cadr(args)))
 	}
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
+	buf.point = buf.clampPos(buf.point)
+	if limit < buf.point {
+		rtGlobal.clearMatchData()
+		return golisp.EmptyCons(), nil
 	}
 	seg := string(buf.text[buf.point:limit])
 	idx := strings.Index(seg, needle)
@@ -3201,6 +8022,7 @@ func searchForwardImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.D
 		rtGlobal.clearMatchData()
 		return golisp.EmptyCons(), nil
 	}
+	idx = utf8.RuneCountInString(seg[:idx])
 	start := buf.point + idx
 	end := start + len([]rune(needle))
 	rtGlobal.matchData = []int{start + 1, end + 1}
@@ -3217,15 +8039,14 @@ func searchForwardRegexpImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*go
 		return golisp.EmptyCons(), nil
 	}
 	pat := featureName(golisp.Car(args))
-	limit := len(buf.text)
-	if golisp.NotNilP(golisp.Cdr(args)) && golisp.IntegerP(golisp.Cadr(args)) {
-		limit = min(max(int(golisp.IntegerValue(golisp.Cadr(args)))-1, 0), len(buf.text))
+	limit := buf.zv()
+	if golisp.NotNilP(golisp.Cdr(args)) && positionP(golisp.Cadr(args)) {
+		limit = buf.clampPos(positionArg(golisp.Cadr(args)))
 	}
-	if buf.point < 0 {
-		buf.point = 0
-	}
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
+	buf.point = buf.clampPos(buf.point)
+	if limit < buf.point {
+		rtGlobal.clearMatchData()
+		return golisp.EmptyCons(), nil
 	}
 	re, err := regexp.Compile(pat)
 	if err != nil {
@@ -3249,9 +8070,9 @@ func skipCharsForwardImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golis
 		return golisp.IntegerWithValue(0), nil
 	}
 	set := featureName(golisp.Car(args))
-	limit := len(buf.text)
-	if golisp.NotNilP(golisp.Cdr(args)) && golisp.IntegerP(golisp.Cadr(args)) {
-		limit = min(max(int(golisp.IntegerValue(golisp.Cadr(args)))-1, 0), len(buf.text))
+	limit := buf.zv()
+	if golisp.NotNilP(golisp.Cdr(args)) && positionP(golisp.Cadr(args)) {
+		limit = buf.clampPos(positionArg(golisp.Cadr(args)))
 	}
 	allowed := make(map[rune]bool, len(set))
 	for _, r := range set {
@@ -3273,8 +8094,8 @@ func substCharInRegionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*goli
 	if buf == nil {
 		return golisp.EmptyCons(), nil
 	}
-	start := int(golisp.IntegerValue(golisp.Car(args))) - 1
-	end := int(golisp.IntegerValue(golisp.Cadr(args))) - 1
+	start := buf.clampPos(positionArg(golisp.Car(args)))
+	end := buf.clampPos(positionArg(golisp.Cadr(args)))
 	oldCh := rune(golisp.IntegerValue(golisp.Caddr(args)))
 	newCh := rune(golisp.IntegerValue(golisp.Car(golisp.Cdddr(args))))
 	if start < 0 {
@@ -3298,7 +8119,7 @@ func substCharInRegionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*goli
 
 func bolpImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
-	if buf == nil || buf.point <= 0 {
+	if buf == nil || buf.point <= buf.begv() {
 		return golisp.BooleanWithValue(true), nil
 	}
 	return golisp.BooleanWithValue(buf.text[buf.point-1] == '\n'), nil
@@ -3306,7 +8127,7 @@ func bolpImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error)
 
 func eolpImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
-	if buf == nil || buf.point >= len(buf.text) {
+	if buf == nil || buf.point >= buf.zv() {
 		return golisp.BooleanWithValue(true), nil
 	}
 	return golisp.BooleanWithValue(buf.text[buf.point] == '\n'), nil
@@ -3346,8 +8167,7 @@ func gotoCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 	if buf == nil {
 		return golisp.IntegerWithValue(1), nil
 	}
-	p := min(max(int(golisp.IntegerValue(golisp.Car(args)))-1, 0), len(buf.text))
-	buf.point = p
+	buf.point = buf.clampPos(positionArg(golisp.Car(args)))
 	return golisp.IntegerWithValue(int64(buf.point + 1)), nil
 }
 
@@ -3365,68 +8185,24 @@ func lineEndPositionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp
 		_, _ = forwardLineImpl(golisp.ArrayToList([]*golisp.Data{golisp.IntegerWithValue(int64(n - 1))}), nil)
 	}
 	p := buf.point
-	for p < len(buf.text) && buf.text[p] != '\n' {
+	for p < buf.zv() && buf.text[p] != '\n' {
 		p++
 	}
 	buf.point = orig
 	return golisp.IntegerWithValue(int64(p + 1)), nil
 }
 
-func nextSinglePropertyChangeImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	pos := int64(1)
-	if golisp.IntegerP(golisp.Car(args)) {
-		pos = golisp.IntegerValue(golisp.Car(args))
-	}
-	if golisp.NotNilP(golisp.Cdddr(args)) && golisp.IntegerP(golisp.Car(golisp.Cdddr(args))) {
-		return golisp.Car(golisp.Cdddr(args)), nil
-	}
-	buf := rtGlobal.currentBuffer()
-	limit := int64(1)
-	if buf != nil {
-		limit = int64(len(buf.text) + 1)
-	}
-	if pos < limit {
-		return golisp.IntegerWithValue(pos + 1), nil
-	}
-	return golisp.IntegerWithValue(limit), nil
-}
-
 func deleteRegionImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
 	if buf == nil {
 		return golisp.EmptyCons(), nil
 	}
-	start := int(golisp.IntegerValue(golisp.Car(args))) - 1
-	end := int(golisp.IntegerValue(golisp.Cadr(args))) - 1
+	start := buf.clampPos(positionArg(golisp.Car(args)))
+	end := buf.clampPos(positionArg(golisp.Cadr(args)))
 	if start > end {
 		start, end = end, start
 	}
-	if start < 0 {
-		start = 0
-	}
-	if end < 0 {
-		end = 0
-	}
-	if start > len(buf.text) {
-		start = len(buf.text)
-	}
-	if end > len(buf.text) {
-		end = len(buf.text)
-	}
-	if start < end {
-		buf.text = append(append([]rune{}, buf.text[:start]...), buf.text[end:]...)
-		if buf.point > end {
-			buf.point -= end - start
-		} else if buf.point > start {
-			buf.point = start
-		}
-	}
-	if buf.point < 0 {
-		buf.point = 0
-	}
-	if buf.point > len(buf.text) {
-		buf.point = len(buf.text)
-	}
+	buf.deleteText(start, end)
 	return golisp.EmptyCons(), nil
 }
 
@@ -3443,30 +8219,34 @@ func deleteCharImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data
 		return golisp.EmptyCons(), nil
 	}
 	if n > 0 {
-		start := buf.point
-		end := min(start+n, len(buf.text))
-		if start < 0 {
-			start = 0
-		}
-		if start < end {
-			buf.text = append(append([]rune{}, buf.text[:start]...), buf.text[end:]...)
-		}
+		buf.deleteText(buf.point, buf.clampPos(buf.point+n))
 		return golisp.EmptyCons(), nil
 	}
-	n = -n
-	start := buf.point - n
-	end := buf.point
-	if start < 0 {
-		start = 0
+	buf.deleteText(buf.clampPos(buf.point+n), buf.point)
+	return golisp.EmptyCons(), nil
+}
+
+func forwardWordImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
+	buf := rtGlobal.currentBuffer()
+	if buf == nil {
+		return golisp.IntegerWithValue(1), nil
 	}
-	if end > len(buf.text) {
-		end = len(buf.text)
+	n := 1
+	if golisp.NotNilP(args) && golisp.IntegerP(golisp.Car(args)) {
+		n = int(golisp.IntegerValue(golisp.Car(args)))
 	}
-	if start < end {
-		buf.text = append(append([]rune{}, buf.text[:start]...), buf.text[end:]...)
-		buf.point = start
+	if n < 0 {
+		n = 0
 	}
-	return golisp.EmptyCons(), nil
+	for k := 0; k < n; k++ {
+		for buf.point < buf.zv() && !isWordRune(buf.text[buf.point]) {
+			buf.point++
+		}
+		for buf.point < buf.zv() && isWordRune(buf.text[buf.point]) {
+			buf.point++
+		}
+	}
+	return golisp.IntegerWithValue(int64(buf.point + 1)), nil
 }
 
 func backwardWordImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -3482,10 +8262,10 @@ func backwardWordImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Da
 		n = 0
 	}
 	for k := 0; k < n; k++ {
-		for buf.point > 0 && !isWordRune(buf.text[buf.point-1]) {
+		for buf.point > buf.begv() && !isWordRune(buf.text[buf.point-1]) {
 			buf.point--
 		}
-		for buf.point > 0 && isWordRune(buf.text[buf.point-1]) {
+		for buf.point > buf.begv() && isWordRune(buf.text[buf.point-1]) {
 			buf.point--
 		}
 	}
@@ -3538,11 +8318,11 @@ func moveToColumnImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Da
 	}
 	col := max(int(golisp.IntegerValue(golisp.Car(args))), 0)
 	lineStart := buf.point
-	for lineStart > 0 && buf.text[lineStart-1] != '\n' {
+	for lineStart > buf.begv() && buf.text[lineStart-1] != '\n' {
 		lineStart--
 	}
 	lineEnd := lineStart
-	for lineEnd < len(buf.text) && buf.text[lineEnd] != '\n' {
+	for lineEnd < buf.zv() && buf.text[lineEnd] != '\n' {
 		lineEnd++
 	}
 	newPoint := min(lineStart+col, lineEnd)
@@ -3572,10 +8352,6 @@ func indentToImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 	return golisp.IntegerWithValue(int64(target)), nil
 }
 
-func yesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(true), nil
-}
-
 func nilBoolImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	return golisp.BooleanWithValue(false), nil
 }
@@ -3584,12 +8360,6 @@ func nilValueImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, err
 	return golisp.EmptyCons(), nil
 }
 
-func primitiveUndoImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// Undo is not modeled in this runtime; return nil so callers can terminate
-	// undo walks safely.
-	return golisp.EmptyCons(), nil
-}
-
 func stringEqualImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	a := featureName(golisp.Car(args))
 	b := featureName(golisp.Cadr(args))
@@ -3647,7 +8417,7 @@ func copySequenceImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Da
 	v := golisp.Car(args)
 	switch {
 	case golisp.StringP(v):
-		return golisp.StringWithValue(golisp.StringValue(v)), nil
+		return stringWithProps([]rune(golisp.StringValue(v)), stringPropsOf(v)), nil
 	case golisp.ListP(v):
 		items := golisp.ToArray(v)
 		cp := make([]*golisp.Data, len(items))
@@ -3785,7 +8555,8 @@ func replaceMatchImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Da
 		replacement = expandReplacementTemplate(repl, matched)
 	}
 	replRunes := []rune(replacement)
-	buf.text = append(append([]rune{}, buf.text[:start]...), append(replRunes, buf.text[end:]...)...)
+	buf.deleteText(start, end)
+	buf.insertText(start, replRunes)
 	buf.point = start + len(replRunes)
 	rtGlobal.clearMatchData()
 	return golisp.StringWithValue(replacement), nil
@@ -3840,31 +8611,17 @@ func setMatchDataImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Da
 	return d, nil
 }
 
-func addTextPropertiesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	// Text properties are ignored in this runtime.
-	return golisp.BooleanWithValue(true), nil
-}
-
-func removeOverlaysImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.EmptyCons(), nil
-}
-
-func removeTextPropertiesImpl(_ *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	return golisp.BooleanWithValue(true), nil
-}
-
 func untabifyImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
 	buf := rtGlobal.currentBuffer()
 	if buf == nil {
 		return golisp.EmptyCons(), nil
 	}
-	start := 0
-	end := len(buf.text)
-	if golisp.NotNilP(args) && golisp.IntegerP(golisp.Car(args)) {
-		start = int(golisp.IntegerValue(golisp.Car(args))) - 1
+	start, end := buf.begv(), buf.zv()
+	if golisp.NotNilP(args) && positionP(golisp.Car(args)) {
+		start = buf.clampPos(positionArg(golisp.Car(args)))
 	}
-	if golisp.NotNilP(golisp.Cdr(args)) && golisp.IntegerP(golisp.Cadr(args)) {
-		end = int(golisp.IntegerValue(golisp.Cadr(args))) - 1
+	if golisp.NotNilP(golisp.Cdr(args)) && positionP(golisp.Cadr(args)) {
+		end = buf.clampPos(positionArg(golisp.Cadr(args)))
 	}
 	if start < 0 {
 		start = 0
@@ -3925,6 +8682,7 @@ func setWindowConfigurationImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (
 	if _, ok := rtGlobal.windows[cfg.selectedWindowID]; ok {
 		rtGlobal.selectedWindowID = cfg.selectedWindowID
 	}
+	rtGlobal.setCurrentBuffer(rtGlobal.selectedWindow().buffer)
 	return golisp.BooleanWithValue(true), nil
 }
 
@@ -4052,6 +8810,8 @@ func defgroupImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data
 	if _, err := env.BindLocallyTo(name, name); err != nil {
 		return nil, err
 	}
+	// Like Emacs, later defcustoms without :group join this group.
+	rtGlobal.currentGroup = golisp.StringValue(name)
 	return name, nil
 }
 
@@ -4099,7 +8859,15 @@ func defineDerivedModeImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*go
 			if km := callEnv.ValueOf(mapSym); isKeymap(km) {
 				rtGlobal.currentBuffer().localMap = km
 			}
-			return evalLetBody(body, callEnv)
+			result, err := evalLetBody(body, callEnv)
+			if err != nil {
+				return nil, err
+			}
+			hooks := golisp.ArrayToList([]*golisp.Data{golisp.Intern(modeName + "-hook")})
+			if _, err := rtGlobal.runHooksImpl(hooks, callEnv); err != nil {
+				return nil, err
+			}
+			return result, nil
 		},
 	}
 	fn := golisp.PrimitiveWithNameAndFunc(modeName, pf)
@@ -4316,6 +9084,10 @@ func letImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, err
 	local := golisp.NewSymbolTableFrameBelow(env, "let")
 	local.Previous = env
 	for _, b := range bindings {
+		if restore, ok := rtGlobal.bindPerBufferVar(b.name, b.value); ok {
+			defer restore()
+			continue
+		}
 		if _, err := local.BindLocallyTo(b.name, b.value); err != nil {
 			return nil, err
 		}
@@ -4335,6 +9107,10 @@ func letStarImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data,
 		b := golisp.Car(c)
 		switch {
 		case golisp.SymbolP(b):
+			if restore, ok := rtGlobal.bindPerBufferVar(b, golisp.EmptyCons()); ok {
+				defer restore()
+				continue
+			}
 			if _, err := local.BindLocallyTo(b, golisp.EmptyCons()); err != nil {
 				return nil, err
 			}
@@ -4351,6 +9127,10 @@ func letStarImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data,
 				}
 				value = v
 			}
+			if restore, ok := rtGlobal.bindPerBufferVar(name, value); ok {
+				defer restore()
+				continue
+			}
 			if _, err := local.BindLocallyTo(name, value); err != nil {
 				return nil, err
 			}
@@ -4365,7 +9145,11 @@ func ignoreErrorsImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.
 	result := golisp.EmptyCons()
 	for c := args; golisp.NotNilP(c); c = golisp.Cdr(c) {
 		v, err := golisp.Eval(golisp.Car(c), env)
+		if err != nil && rtGlobal.killed {
+			return nil, err
+		}
 		if err != nil {
+			stopSignal(err)
 			return golisp.EmptyCons(), nil
 		}
 		result = v
@@ -4385,7 +9169,8 @@ func catchImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp.Data, e
 	for b := body; golisp.NotNilP(b); b = golisp.Cdr(b) {
 		result, err = golisp.Eval(golisp.Car(b), env)
 		if err != nil {
-			if sig, ok := err.(throwSignal); ok && sig.tag == tag {
+			if sig, ok := signalOf(err).(throwSignal); ok && sig.tag == tag {
+				stopSignal(err)
 				return sig.value, nil
 			}
 			return nil, err
@@ -4401,9 +9186,12 @@ func conditionCaseImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp
 	if err == nil {
 		return v, nil
 	}
+	if rtGlobal.killed {
+		return nil, err
+	}
 	handlers := golisp.Cddr(args)
 	errCond := "error"
-	switch sig := err.(type) {
+	switch sig := signalOf(err).(type) {
 	case throwSignal:
 		errCond = "throw"
 	case elSignal:
@@ -4421,6 +9209,7 @@ func conditionCaseImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp
 		if !conditionCaseMatches(spec, errCond) {
 			continue
 		}
+		stopSignal(err)
 		local := env
 		if golisp.SymbolP(varName) && golisp.StringValue(varName) != "nil" {
 			local = golisp.NewSymbolTableFrameBelow(env, "condition-case")
@@ -4435,14 +9224,14 @@ func conditionCaseImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golisp
 }
 
 func conditionCaseErrorObject(errCond string, err error) *golisp.Data {
-	switch sig := err.(type) {
-	case elSignal:
-		if golisp.NotNilP(sig.data) {
-			return golisp.ArrayToList([]*golisp.Data{
-				golisp.Intern(errCond),
-				sig.data,
-			})
+	if sig, ok := signalOf(err).(elSignal); ok {
+		if golisp.NilP(sig.data) {
+			return golisp.ArrayToList([]*golisp.Data{golisp.Intern(errCond)})
 		}
+		return golisp.ArrayToList([]*golisp.Data{
+			golisp.Intern(errCond),
+			sig.data,
+		})
 	}
 	return golisp.ArrayToList([]*golisp.Data{
 		golisp.Intern(errCond),
@@ -4509,7 +9298,7 @@ func saveCurrentBufferImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*go
 	orig := rtGlobal.currentBuffer()
 	defer func() {
 		if orig != nil {
-			rtGlobal.selectedWindow().buffer = orig
+			rtGlobal.setCurrentBuffer(orig)
 		}
 	}()
 	return evalLetBody(args, env)
@@ -4522,10 +9311,10 @@ func withCurrentBufferImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*go
 	}
 	name := bufferNameFromArg(bv)
 	orig := rtGlobal.currentBuffer()
-	rtGlobal.selectedWindow().buffer = rtGlobal.ensureBuffer(name)
+	rtGlobal.setCurrentBuffer(rtGlobal.ensureBuffer(name))
 	defer func() {
 		if orig != nil {
-			rtGlobal.selectedWindow().buffer = orig
+			rtGlobal.setCurrentBuffer(orig)
 		}
 	}()
 	return evalLetBody(golisp.Cdr(args), env)
@@ -4535,11 +9324,12 @@ func withTempBufferImpl(args *golisp.Data, env *golisp.SymbolTableFrame) (*golis
 	orig := rtGlobal.currentBuffer()
 	name := fmt.Sprintf("*temp-%d*", time.Now().UnixNano())
 	tmp := rtGlobal.ensureBuffer(name)
-	rtGlobal.selectedWindow().buffer = tmp
+	tmp.locals["buffer-undo-list"] = golisp.BooleanWithValue(true)
+	rtGlobal.setCurrentBuffer(tmp)
 	defer func() {
 		delete(rtGlobal.buffers, name)
 		if orig != nil {
-			rtGlobal.selectedWindow().buffer = orig
+			rtGlobal.setCurrentBuffer(orig)
 		}
 	}()
 	return evalLetBody(args, env)
@@ -5337,17 +10127,21 @@ func nreverseImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 }
 
 func concatImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
-	var b strings.Builder
+	var rs []rune
+	var props []propInterval
 	for c := args; golisp.NotNilP(c); c = golisp.Cdr(c) {
 		v := golisp.Car(c)
 		switch {
-		case golisp.StringP(v), golisp.SymbolP(v):
-			b.WriteString(golisp.StringValue(v))
+		case golisp.StringP(v):
+			props = pasteProps(props, math.MaxInt, len(rs), stringPropsOf(v))
+			rs = append(rs, []rune(golisp.StringValue(v))...)
+		case golisp.SymbolP(v):
+			rs = append(rs, []rune(golisp.StringValue(v))...)
 		default:
-			b.WriteString(golisp.String(v))
+			rs = append(rs, []rune(golisp.String(v))...)
 		}
 	}
-	return golisp.StringWithValue(b.String()), nil
+	return stringWithProps(rs, props), nil
 }
 
 func substringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -5376,7 +10170,7 @@ func substringImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data,
 	if start > end {
 		start = end
 	}
-	return golisp.StringWithValue(string(rs[start:end])), nil
+	return stringWithProps(rs[start:end], sliceProps(stringPropsOf(sv), start, end)), nil
 }
 
 func vconcatImpl(args *golisp.Data, _ *golisp.SymbolTableFrame) (*golisp.Data, error) {
@@ -5588,6 +10382,19 @@ func asElVector(d *golisp.Data) *elVector {
 	return (*elVector)(golisp.ObjectValue(d))
 }
 
+// internKeyword makes the keyword sym evaluate to itself, as in Emacs.
+// golisp only self-evaluates names ending in a colon, so a :weight read
+// from source or made by intern would otherwise be an unbound variable.
+func internKeyword(sym *golisp.Data) *golisp.Data {
+	if !strings.HasPrefix(golisp.StringValue(sym), ":") {
+		return sym
+	}
+	if _, ok := golisp.Global.FindBindingFor(sym); !ok {
+		golisp.Global.BindToProtected(sym, sym)
+	}
+	return sym
+}
+
 func preprocessElisp(src string) (string, error) {
 	var out strings.Builder
 	vectorDepth := 0
@@ -5729,6 +10536,14 @@ func preprocessElisp(src string) (string, error) {
 			continue
 		}
 
+		if ch == ':' && (i == 0 || isDelimiter(src[i-1])) {
+			tok, n := readToken(src[i:])
+			internKeyword(golisp.Intern(tok))
+			out.WriteString(tok)
+			i += n
+			continue
+		}
+
 		if isDigit(ch) && tokenLooksLikeLeadingDigitSymbol(src, i) {
 			tok, n := readToken(src[i:])
 			out.WriteString(normalizeLeadingDigitSymbol(tok))
@@ -5927,15 +10742,87 @@ func normalizeLeadingDigitSymbol(tok string) string {
 	return "n-" + tok
 }
 
+// keyEvent is a key read from the terminal: a character or one of the
+// named keys below, with modifier bits above them. Control is folded
+// into characters that have a control code, so C-a is 1.
+type keyEvent int
+
+// The named keys come after the last Unicode code point.
+const (
+	keyLeft keyEvent = utf8.MaxRune + 1 + iota
+	keyRight
+	keyUp
+	keyDown
+	keyHome
+	keyEnd
+	keyInsert
+	keyDel
+	keyPgUp
+	keyPgDn
+	keyBacktab
+	keyF1 // through keyF1+11 for F12
+)
+
 const (
-	keyPgUp  = 251
-	keyLeft  = 252
-	keyUp    = 253
-	keyRight = 254
-	keyDown  = 255
-	keyPgDn  = 250
+	// keyMeta is set on a key typed with Meta or Alt, which terminals
+	// send as ESC followed by the key.
+	keyMeta keyEvent = 1 << (21 + iota)
+	keyControl
+	keyShift
+	keySuper
+	keyModifiers = keyMeta | keyControl | keyShift | keySuper
 )
 
+// keyNames are the names of the named keys, without the angle brackets
+// key descriptions put around them.
+var keyNames = map[keyEvent]string{
+	keyLeft: "left", keyRight: "right", keyUp: "up", keyDown: "down",
+	keyHome: "home", keyEnd: "end", keyInsert: "insert", keyDel: "delete",
+	keyPgUp: "prior", keyPgDn: "next", keyBacktab: "backtab",
+}
+
+func init() {
+	for n := range 12 {
+		keyNames[keyF1+keyEvent(n)] = fmt.Sprintf("f%d", n+1)
+	}
+}
+
+// withModifiers applies the modifiers of an xterm-style parameter, one
+// more than the sum of Shift 1, Alt 2, Control 4 and Super 8, to k.
+func (k keyEvent) withModifiers(param int) keyEvent {
+	m := param - 1
+	if m <= 0 {
+		return k
+	}
+	// Shift makes a letter upper case, except with Control, which has
+	// no upper case letters to fold: C-S-a keeps its Shift bit.
+	if m&1 != 0 {
+		switch {
+		case k >= 'a' && k <= 'z' && m&4 == 0:
+			k -= 'a' - 'A'
+		case k > 127 || m&4 != 0:
+			k |= keyShift
+		}
+	}
+	if m&4 != 0 {
+		switch base := k &^ keyModifiers; {
+		case base >= 'a' && base <= 'z', base >= '@' && base <= '_':
+			k = k&keyModifiers | base&31
+		case base == '?':
+			k = k&keyModifiers | 127
+		default:
+			k |= keyControl
+		}
+	}
+	if m&2 != 0 {
+		k |= keyMeta
+	}
+	if m&8 != 0 {
+		k |= keySuper
+	}
+	return k
+}
+
 func runGameLoop(rt *runtimeState, env *golisp.SymbolTableFrame) error {
 	tty, err := vt.NewTTY()
 	if err != nil {
@@ -5951,11 +10838,11 @@ func runGameLoop(rt *runtimeState, env *golisp.SymbolTableFrame) error {
 		fmt.Println()
 	}()
 
-	c := vt.NewCanvas()
-	c.HideCursor()
+	w, h := vt.MustTermSize()
+	c := newScreen(w, h, terminalColorDepth(), os.Stdout)
 	tty.SetTimeout(20 * time.Millisecond)
 
-	keyCh := make(chan int, 32)
+	keyCh := make(chan keyEvent, 32)
 	stopCh := make(chan struct{})
 	defer close(stopCh)
 	go func() {
@@ -5968,6 +10855,14 @@ func runGameLoop(rt *runtimeState, env *golisp.SymbolTableFrame) error {
 			}
 			raw := tty.CustomString()
 			if raw == "" {
+				if pending == "\x1b" {
+					// Nothing followed the ESC, so it was the key itself.
+					pending = ""
+					select {
+					case keyCh <- 27:
+					default:
+					}
+				}
 				continue
 			}
 			keys, rest := parseTTYKeyStream(pending + raw)
@@ -5983,197 +10878,336 @@ func runGameLoop(rt *runtimeState, env *golisp.SymbolTableFrame) error {
 
 	ticker := time.NewTicker(16 * time.Millisecond)
 	defer ticker.Stop()
-	rt.draw(c)
-	for range ticker.C {
-		if rt.gameName == "dunnet" && golisp.BooleanValue(env.ValueOf(golisp.Intern("dun-dead"))) {
-			return nil
+	rt.loop = &gameLoop{keys: keyCh, canvas: c, ticker: ticker}
+	defer func() { rt.loop = nil }()
+	rt.runFrames(func() bool {
+		return rt.gameName == "dunnet" && golisp.BooleanValue(env.ValueOf(golisp.Intern("dun-dead")))
+	}, env)
+	return nil
+}
+
+// gameLoop is the terminal session of runGameLoop. Reading from the
+// minibuffer runs its frames over again, so the game goes on while the
+// caller waits for an answer.
+type gameLoop struct {
+	keys   chan keyEvent
+	canvas *screen
+	ticker *time.Ticker
+}
+
+// runFrames runs timers, keys and eval requests frame by frame until
+// done says to stop, and reports whether the session ended first, by
+// a quitting key or kill-emacs.
+func (rt *runtimeState) runFrames(done func() bool, env *golisp.SymbolTableFrame) bool {
+	l := rt.loop
+	rt.draw(l.canvas)
+	for range l.ticker.C {
+		if done() {
+			return false
 		}
 		rt.tickTimers(env)
+		if rt.killed {
+			return true
+		}
 		for {
 			select {
-			case k := <-keyCh:
-				if rt.handleKey(k, env) {
-					return nil
+			case k := <-l.keys:
+				if rt.handleKey(k, env) || rt.killed {
+					return true
+				}
+				if done() {
+					rt.draw(l.canvas)
+					return false
+				}
+			case req := <-rt.evalRequests:
+				rt.serveEvalRequest(req, env)
+				if rt.killed {
+					return true
 				}
 			default:
-				rt.draw(c)
+				rt.draw(l.canvas)
 				goto nextFrame
 			}
 		}
 	nextFrame:
 	}
-	return nil
+	return false
 }
 
-func parseTTYKeyStream(raw string) ([]int, string) {
+// pickBundledGame shows a menu of the embedded games and returns the chosen
+// name, or "" when the user quits. It fails when no terminal is available.
+func pickBundledGame() (string, error) {
+	tty, err := vt.NewTTY()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+
+	vt.Init()
+	defer func() {
+		vt.Close()
+		fmt.Print(vt.Stop())
+	}()
+
+	c := vt.NewCanvas()
+	c.HideCursor()
+	tty.SetTimeout(20 * time.Millisecond)
+
+	selected := 0
+	for {
+		c.Clear()
+		c.WriteString(2, 1, vt.White, vt.DefaultBackground, "runmacs - pick a game")
+		for i, name := range bundledGames {
+			fg, marker := vt.LightGray, "  "
+			if i == selected {
+				fg, marker = vt.LightGreen, "> "
+			}
+			c.WriteString(2, uint(3+i), fg, vt.DefaultBackground, marker+name)
+		}
+		c.WriteString(2, uint(4+len(bundledGames)), vt.LightGray, vt.DefaultBackground, "up/down: move  enter: play  q: quit")
+		c.Draw()
+
+		raw := tty.CustomString()
+		if raw == "" {
+			continue
+		}
+		keys, _ := parseTTYKeyStream(raw)
+		for _, k := range keys {
+			switch k {
+			case keyUp, 'k', 16:
+				selected = (selected + len(bundledGames) - 1) % len(bundledGames)
+			case keyDown, 'j', 14:
+				selected = (selected + 1) % len(bundledGames)
+			case 10, 13, ' ':
+				return bundledGames[selected], nil
+			case 'q', 3, 27:
+				return "", nil
+			}
+		}
+	}
+}
+
+// parseTTYKeyStream decodes what the terminal sent into keys. An escape
+// sequence cut off at the end is returned as the rest, to be completed
+// by the next read.
+func parseTTYKeyStream(raw string) ([]keyEvent, string) {
 	if raw == "" {
 		return nil, ""
 	}
 	if after, ok := strings.CutPrefix(raw, "c:"); ok {
 		if n, err := strconv.Atoi(after); err == nil && n > 0 {
-			return []int{normalizeVTKeyCode(n)}, ""
+			return []keyEvent{normalizeVTKeyCode(n)}, ""
 		}
 	}
 
-	keys := make([]int, 0, len(raw))
+	keys := make([]keyEvent, 0, len(raw))
 	for i := 0; i < len(raw); {
-		if raw[i] == 0x1b {
-			// Incomplete escape at end: keep for next read chunk.
-			if i+1 >= len(raw) {
-				return keys, raw[i:]
-			}
-			// CSI: ESC [ ... final
-			if raw[i+1] == '[' {
-				j := i + 2
-				for j < len(raw) {
-					c := raw[j]
-					if (c >= '0' && c <= '9') || c == ';' {
-						j++
-						continue
-					}
-					break
-				}
-				if j >= len(raw) {
-					return keys, raw[i:]
-				}
-				switch raw[j] {
-				case 'A':
-					keys = append(keys, keyUp)
-					i = j + 1
-					continue
-				case 'B':
-					keys = append(keys, keyDown)
-					i = j + 1
-					continue
-				case 'C':
-					keys = append(keys, keyRight)
-					i = j + 1
-					continue
-				case 'D':
-					keys = append(keys, keyLeft)
-					i = j + 1
-					continue
-				case '~':
-					param := raw[i+2 : j]
-					switch param {
-					case "5":
-						keys = append(keys, keyPgUp)
-					case "6":
-						keys = append(keys, keyPgDn)
-					case "0", "1", "2", "3", "4", "7", "8", "9":
-						keys = append(keys, int(param[0]))
-					}
-					i = j + 1
-					continue
-				case 'u':
-					// CSI-u extension: ESC [ <codepoint> ; ... u
-					param := raw[i+2 : j]
-					if param != "" {
-						if head, _, ok := strings.Cut(param, ";"); ok {
-							param = head
-						}
-						if cp, err := strconv.Atoi(param); err == nil && cp > 0 {
-							keys = append(keys, normalizeVTKeyCode(cp))
-						}
-					}
-					i = j + 1
-					continue
-				default:
-					// Unknown CSI; consume it.
-					i = j + 1
-					continue
-				}
-			}
-			// SS3: ESC O A/B/C/D
-			if raw[i+1] == 'O' {
-				if i+2 >= len(raw) {
-					return keys, raw[i:]
-				}
-				switch raw[i+2] {
-				case 'A':
-					keys = append(keys, keyUp)
-				case 'B':
-					keys = append(keys, keyDown)
-				case 'C':
-					keys = append(keys, keyRight)
-				case 'D':
-					keys = append(keys, keyLeft)
-				// Keypad digits in application mode (SS3).
-				case 'p':
-					keys = append(keys, int('0'))
-				case 'q':
-					keys = append(keys, int('1'))
-				case 'r':
-					keys = append(keys, int('2'))
-				case 's':
-					keys = append(keys, int('3'))
-				case 't':
-					keys = append(keys, int('4'))
-				case 'u':
-					keys = append(keys, int('5'))
-				case 'v':
-					keys = append(keys, int('6'))
-				case 'w':
-					keys = append(keys, int('7'))
-				case 'x':
-					keys = append(keys, int('8'))
-				case 'y':
-					keys = append(keys, int('9'))
-				}
-				i += 3
-				continue
-			}
-			// Bare ESC key.
-			keys = append(keys, 27)
-			i++
-			continue
+		k, n := parseTTYKey(raw[i:])
+		if n == 0 {
+			return keys, raw[i:]
 		}
-
-		r, size := utf8.DecodeRuneInString(raw[i:])
-		if r == utf8.RuneError && size == 1 {
-			i++
-			continue
+		if k >= 0 {
+			keys = append(keys, k)
 		}
+		i += n
+	}
+	return keys, ""
+}
+
+// parseTTYKey decodes the key at the start of s and returns it with the
+// number of bytes it took. n is 0 when s ends inside an escape sequence
+// and k is -1 for input that is no key.
+func parseTTYKey(s string) (k keyEvent, n int) {
+	if s[0] != 0x1b {
+		r, size := utf8.DecodeRuneInString(s)
 		switch r {
+		case utf8.RuneError:
+			return -1, size
 		case '↑':
-			keys = append(keys, keyUp)
+			return keyUp, size
 		case '↓':
-			keys = append(keys, keyDown)
+			return keyDown, size
 		case '←':
-			keys = append(keys, keyLeft)
+			return keyLeft, size
 		case '→':
-			keys = append(keys, keyRight)
+			return keyRight, size
 		case '⇞':
-			keys = append(keys, keyPgUp)
+			return keyPgUp, size
 		case '⇟':
-			keys = append(keys, keyPgDn)
+			return keyPgDn, size
+		}
+		return keyEvent(r), size
+	}
+	if len(s) == 1 {
+		return 0, 0
+	}
+	switch s[1] {
+	case '[':
+		return parseCSIKey(s)
+	case 'O':
+		return parseSS3Key(s)
+	case 0x1b:
+		// ESC before an escape sequence is Meta on that key; two ESCs
+		// alone are two ESC keys.
+		if len(s) == 2 {
+			return 27, 1
+		}
+		if s[2] != '[' && s[2] != 'O' {
+			return 27, 1
+		}
+	}
+	k, n = parseTTYKey(s[1:])
+	if n == 0 || k < 0 {
+		return k, n + min(n, 1)
+	}
+	return k | keyMeta, n + 1
+}
+
+// parseCSIKey decodes ESC [ PARAMS FINAL: cursor and editing keys and
+// function keys, with xterm modifiers as the second parameter, and the
+// CSI u encoding of characters with modifiers.
+func parseCSIKey(s string) (keyEvent, int) {
+	j := 2
+	if j < len(s) && s[j] == '[' {
+		// The Linux console sends F1 to F5 as ESC [ [ A to E.
+		if j+1 >= len(s) {
+			return 0, 0
+		}
+		if c := s[j+1]; c >= 'A' && c <= 'E' {
+			return keyF1 + keyEvent(c-'A'), j + 2
+		}
+		return -1, j + 2
+	}
+	for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == ';' || s[j] == ':') {
+		j++
+	}
+	if j >= len(s) {
+		return 0, 0
+	}
+	var params []int
+	for _, p := range strings.Split(s[2:j], ";") {
+		p, _, _ = strings.Cut(p, ":")
+		n, _ := strconv.Atoi(p)
+		params = append(params, n)
+	}
+	mods := 0
+	if len(params) > 1 {
+		mods = params[1]
+	}
+	var k keyEvent
+	switch s[j] {
+	case 'A':
+		k = keyUp
+	case 'B':
+		k = keyDown
+	case 'C':
+		k = keyRight
+	case 'D':
+		k = keyLeft
+	case 'H':
+		k = keyHome
+	case 'F':
+		k = keyEnd
+	case 'P', 'Q', 'R', 'S':
+		k = keyF1 + keyEvent(s[j]-'P')
+	case 'Z':
+		k = keyBacktab
+	case '~':
+		switch p := params[0]; {
+		case p == 1 || p == 7:
+			k = keyHome
+		case p == 2:
+			k = keyInsert
+		case p == 3:
+			k = keyDel
+		case p == 4 || p == 8:
+			k = keyEnd
+		case p == 5:
+			k = keyPgUp
+		case p == 6:
+			k = keyPgDn
+		case p >= 11 && p <= 15:
+			k = keyF1 + keyEvent(p-11)
+		case p >= 17 && p <= 21:
+			k = keyF1 + 5 + keyEvent(p-17)
+		case p == 23 || p == 24:
+			k = keyF1 + 10 + keyEvent(p-23)
+		case p == 0 || p == 9:
+			// Keypad digits on some terminals.
+			k = keyEvent('0' + p)
 		default:
-			if r >= 0 && r <= 255 {
-				keys = append(keys, int(r))
-			}
+			return -1, j + 1
+		}
+	case 'u':
+		// CSI-u extension: ESC [ <codepoint> ; <modifiers> u
+		if params[0] <= 0 {
+			return -1, j + 1
 		}
-		i += size
+		k = normalizeVTKeyCode(params[0])
+	default:
+		// Unknown CSI; consume it.
+		return -1, j + 1
 	}
-	return keys, ""
+	return k.withModifiers(mods), j + 1
 }
 
-func normalizeVTKeyCode(k int) int {
-	switch k {
+// parseSS3Key decodes ESC O FINAL, which terminals in application mode
+// send for the arrows, F1 to F4 and the keypad.
+func parseSS3Key(s string) (keyEvent, int) {
+	if len(s) < 3 {
+		return 0, 0
+	}
+	switch c := s[2]; {
+	case c == 'A':
+		return keyUp, 3
+	case c == 'B':
+		return keyDown, 3
+	case c == 'C':
+		return keyRight, 3
+	case c == 'D':
+		return keyLeft, 3
+	case c == 'H':
+		return keyHome, 3
+	case c == 'F':
+		return keyEnd, 3
+	case c >= 'P' && c <= 'S':
+		return keyF1 + keyEvent(c-'P'), 3
+	case c >= 'p' && c <= 'y':
+		// Keypad digits in application mode.
+		return keyEvent('0' + c - 'p'), 3
+	}
+	return -1, 3
+}
+
+func normalizeVTKeyCode(k int) keyEvent {
+	switch {
 	// Common terminal key codes seen from VT backends.
-	case 258:
+	case k == 258:
 		return keyDown
-	case 259:
+	case k == 259:
 		return keyUp
-	case 260:
+	case k == 260:
 		return keyLeft
-	case 261:
+	case k == 261:
 		return keyRight
-	case 338:
+	case k == 338:
 		return keyPgDn
-	case 339:
+	case k == 339:
 		return keyPgUp
+	case k == 262:
+		return keyHome
+	case k == 360:
+		return keyEnd
+	case k == 330:
+		return keyDel
+	case k == 331:
+		return keyInsert
+	case k == 353:
+		return keyBacktab
+	case k >= 265 && k <= 276:
+		return keyF1 + keyEvent(k-265)
 	default:
-		return k
+		return keyEvent(k)
 	}
 }
 
@@ -6182,10 +11216,17 @@ func runHeadlessLoop(rt *runtimeState, env *golisp.SymbolTableFrame) error {
 	deadline := time.Now().Add(30 * time.Second)
 	for time.Now().Before(deadline) {
 		rt.tickTimers(env)
+		if rt.killed {
+			return nil
+		}
 		if rt.gameName == "dunnet" && golisp.BooleanValue(env.ValueOf(golisp.Intern("dun-dead"))) {
 			return nil
 		}
-		time.Sleep(20 * time.Millisecond)
+		select {
+		case req := <-rt.evalRequests:
+			rt.serveEvalRequest(req, env)
+		case <-time.After(20 * time.Millisecond):
+		}
 	}
 	return nil
 }
@@ -6204,16 +11245,26 @@ func (rt *runtimeState) tickTimers(env *golisp.SymbolTableFrame) {
 			t.nextFire = now.Add(time.Duration(p * float64(time.Second)))
 			continue
 		}
-		if now.Before(t.nextFire) {
+		if now.Before(t.nextFire) || t.running {
 			continue
 		}
-		if err := rt.invokeTimerCallback(t.callback, env); err != nil {
-			if sig, ok := err.(elSignal); ok {
-				// Timer-driven games often use conditions to end a session cleanly.
-				if sig.condition == "quit" || sig.condition == "life-extinct" {
-					t.active = false
-					continue
-				}
+		// The next run is set up first, as a callback reading from the
+		// minibuffer comes back here from its frames before it returns.
+		if t.period <= 0 {
+			t.active = false
+		} else {
+			t.nextFire = now.Add(time.Duration(t.period * float64(time.Second)))
+		}
+		t.running = true
+		err := rt.invokeTimerCallback(t.callback, env)
+		t.running = false
+		if err != nil {
+			sig, ok := signalOf(err).(elSignal)
+			stopSignal(err)
+			// Timer-driven games often use conditions to end a session cleanly.
+			if ok && (sig.condition == "quit" || sig.condition == "life-extinct") {
+				t.active = false
+				continue
 			}
 			if isBenignTimerSignal(err) {
 				t.active = false
@@ -6224,11 +11275,8 @@ func (rt *runtimeState) tickTimers(env *golisp.SymbolTableFrame) {
 			t.active = false
 			continue
 		}
-		if t.period <= 0 {
-			t.active = false
-		} else {
-			t.nextFire = now.Add(time.Duration(t.period * float64(time.Second)))
-		}
+		// Each timer run is its own change, as each command is.
+		rt.undoBoundary(rt.currentBuffer())
 	}
 }
 
@@ -6248,7 +11296,7 @@ func (rt *runtimeState) invokeTimerCallback(cb *golisp.Data, env *golisp.SymbolT
 	cbArg := rt.currentBuffer().object
 	if _, err := golisp.ApplyWithoutEval(fn, golisp.ArrayToList([]*golisp.Data{cbArg}), env); err != nil {
 		if _, err0 := golisp.ApplyWithoutEval(fn, golisp.EmptyCons(), env); err0 != nil {
-			if _, ok := err0.(elSignal); ok {
+			if _, ok := signalOf(err0).(elSignal); ok {
 				return err0
 			}
 			if isBenignTimerSignal(err0) {
@@ -6299,15 +11347,56 @@ func (rt *runtimeState) invokeByName(name string, env *golisp.SymbolTableFrame)
 	return rt.invokeBoundCommand(fn, env)
 }
 
-func keyCandidates(key int) []string {
+// String describes k as Emacs does, as "M-x", "C-<right>" or "<f1>".
+func (k keyEvent) String() string {
+	base := k &^ keyModifiers
+	var name string
+	switch {
+	case keyNames[base] != "":
+		name = "<" + keyNames[base] + ">"
+	case base == 0:
+		name, k = "@", k|keyControl
+	case base == 9:
+		name = "TAB"
+	case base == 13:
+		name = "RET"
+	case base == 27:
+		name = "ESC"
+	case base == 32:
+		name = "SPC"
+	case base == 127:
+		name = "DEL"
+	case base > 0 && base <= 26:
+		name, k = string(rune('a'+base-1)), k|keyControl
+	case base > 26 && base < 32:
+		name, k = string(rune('@'+base)), k|keyControl
+	default:
+		name = string(rune(base))
+	}
+	return k.modifierPrefix() + name
+}
+
+// modifierPrefix returns the prefixes of the modifier bits of k in the
+// order Emacs writes them, as "C-M-".
+func (k keyEvent) modifierPrefix() string {
+	prefix := ""
+	for _, m := range emacsModifiers {
+		if m.key != 0 && k&m.key != 0 {
+			prefix += m.prefix
+		}
+	}
+	return prefix
+}
+
+func keyCandidates(key keyEvent) []string {
 	switch key {
 	case 10, 13:
-		return []string{"\r", "\n", "RET", "C-m"}
+		return []string{"\r", "\n", "RET", "C-m", "C-j", "<return>"}
 	case 9:
 		return []string{"\t", "TAB", "<tab>", "C-i"}
 	case 27:
 		return []string{"ESC", "<escape>"}
-	case int(' '):
+	case ' ':
 		return []string{"SPC", " "}
 	case 2:
 		return []string{"C-b"}
@@ -6327,22 +11416,46 @@ func keyCandidates(key int) []string {
 		return []string{"<down>", "down", "C-n"}
 	case 3:
 		return []string{"C-c"}
-	default:
-		if key >= 32 && key <= 126 {
-			return []string{string(rune(key))}
+	case keyHome:
+		return []string{"<home>", "home"}
+	case keyEnd:
+		return []string{"<end>", "end"}
+	case keyDel:
+		return []string{"<delete>", "<deletechar>", "delete"}
+	case keyPgUp:
+		return []string{"<prior>", "prior"}
+	case keyPgDn:
+		return []string{"<next>", "next"}
+	case 127:
+		return []string{"DEL", "<backspace>"}
+	case 0:
+		return []string{"C-@", "C-SPC"}
+	case keyBacktab:
+		return []string{"<backtab>", "S-<tab>", "S-TAB"}
+	}
+	return []string{key.String()}
+}
+
+// dispatchViaCurrentKeymap runs the command key is bound to in the
+// buffer's keymap, or in the keymap of the prefix keys typed before it.
+// A prefix key is remembered until the next key; a sequence bound to
+// nothing is reported, as Emacs does.
+func (rt *runtimeState) dispatchViaCurrentKeymap(key keyEvent, env *golisp.SymbolTableFrame) bool {
+	km, prefix := rt.prefixMap, rt.prefixKeys
+	rt.prefixMap, rt.prefixKeys = nil, nil
+	if km == nil {
+		m := rt.currentBuffer().localMap
+		if m == nil || !isKeymap(m) {
+			return false
 		}
+		km = asKeymap(m)
 	}
-	return nil
-}
-
-func (rt *runtimeState) dispatchViaCurrentKeymap(key int, env *golisp.SymbolTableFrame) bool {
-	m := rt.currentBuffer().localMap
-	if m == nil || !isKeymap(m) {
-		return false
-	}
-	km := asKeymap(m)
 	for _, k := range keyCandidates(key) {
 		if binding, ok := km.bindings[k]; ok {
+			if sub := prefixKeymap(binding, env); sub != nil {
+				rt.prefixMap, rt.prefixKeys = sub, append(prefix, key.String())
+				return true
+			}
 			_, target := resolveKeyBinding(binding, env)
 			if golisp.FunctionOrPrimitiveP(target) {
 				if err := rt.invokeBoundCommand(target, env); err == nil {
@@ -6352,6 +11465,10 @@ func (rt *runtimeState) dispatchViaCurrentKeymap(key int, env *golisp.SymbolTabl
 			}
 		}
 	}
+	if prefix != nil {
+		rt.messages = append(rt.messages, strings.Join(append(prefix, key.String()), " ")+" is undefined")
+		return true
+	}
 	return false
 }
 
@@ -6379,7 +11496,57 @@ func (rt *runtimeState) invokeBoundCommand(fn *golisp.Data, env *golisp.SymbolTa
 	return err
 }
 
-func (rt *runtimeState) handleKey(key int, env *golisp.SymbolTableFrame) bool {
+// showingOtherBuffer reports whether a grid game has switched to another
+// buffer, such as the high-score table, that should be drawn as text.
+func (rt *runtimeState) showingOtherBuffer() bool {
+	return rt.gridBuffer != nil && rt.currentBuffer() != rt.gridBuffer
+}
+
+// beginCommand starts a top-level command: a key, a batch action or a
+// form from a REPL. What the previous one did becomes lastCommand.
+func (rt *runtimeState) beginCommand() {
+	rt.lastCommand, rt.thisCommand = rt.thisCommand, ""
+}
+
+func (rt *runtimeState) handleKey(key keyEvent, env *golisp.SymbolTableFrame) bool {
+	rt.beginCommand()
+	if mb := rt.activeMinibuffer(); mb != nil {
+		rt.minibufferKey(mb, key, env)
+		return false
+	}
+	// Without a minibuffer no command is waiting, so a signal no handler
+	// stopped has ended with the command it came from.
+	clear(raisedSignals)
+	if rt.prefixMap != nil {
+		if key == 7 { // C-g
+			rt.prefixMap, rt.prefixKeys = nil, nil
+			rt.messages = append(rt.messages, "Quit")
+			return false
+		}
+		// The rest of a key sequence goes to the prefix's keymap alone.
+		rt.commandUndoBoundary(key)
+		rt.dispatchViaCurrentKeymap(key, env)
+		return false
+	}
+	rt.commandUndoBoundary(key)
+	if rt.gridWidth == 0 && (key == 10 || key == 13) {
+		// Whether the game reads the line itself or through its keymap,
+		// the line goes into the history and the next one starts after
+		// the answer.
+		if buf := rt.currentBuffer(); buf != nil {
+			rt.addInputHistory(buf, rt.currentInputLine())
+		}
+		defer rt.markInputStart()
+	}
+	if rt.scoreBuffer != nil && rt.gridBuffer != nil && rt.currentBuffer() == rt.scoreBuffer {
+		// Like quit-window on the score table: go back to the game, then
+		// let the key act there, so "n" starts a new game right away.
+		rt.setCurrentBuffer(rt.gridBuffer)
+		switch key {
+		case 'q', 3, 27:
+			return true
+		}
+	}
 	if rt.dispatchViaCurrentKeymap(key, env) {
 		return false
 	}
@@ -6400,7 +11567,7 @@ func (rt *runtimeState) handleKey(key int, env *golisp.SymbolTableFrame) bool {
 		switch key {
 		case 3, 27:
 			return true
-		case int('q'):
+		case 'q':
 			if rt.gameName == "life" {
 				return true
 			}
@@ -6419,50 +11586,36 @@ func (rt *runtimeState) handleKey(key int, env *golisp.SymbolTableFrame) bool {
 			}
 			_, _ = insertImpl(golisp.ArrayToList([]*golisp.Data{golisp.IntegerWithValue('\n')}), nil)
 			return false
-		case 127, 8:
-			buf := rt.currentBuffer()
-			if buf != nil && buf.point > 0 && len(buf.text) > 0 {
-				buf.text = append(buf.text[:buf.point-1], buf.text[buf.point:]...)
-				buf.point--
-			}
-			return false
-		case keyLeft:
-			buf := rt.currentBuffer()
-			if buf != nil && buf.point > 0 {
-				buf.point--
-			}
-			return false
-		case keyRight:
-			buf := rt.currentBuffer()
-			if buf != nil && buf.point < len(buf.text) {
-				buf.point++
-			}
-			return false
-		default:
-			if key >= 32 && key <= 126 {
-				_, _ = insertImpl(golisp.ArrayToList([]*golisp.Data{golisp.IntegerWithValue(int64(key))}), nil)
-			}
-			return false
 		}
+		if buf := rt.currentBuffer(); buf != nil {
+			buf.inputMarker()
+			rt.editText(buf, key, env)
+		}
+		return false
 	}
 
 	switch key {
-	case int('q'), 3, 27:
+	case 'q':
+		// Ending the game shows the high-score table; quit right away
+		// only if there is none to look at.
+		_ = rt.callFirst([]string{"tetris-end-game", "snake-end-game", "pong-quit"}, env)
+		return !rt.showingOtherBuffer()
+	case 3, 27:
 		_ = rt.callFirst([]string{"tetris-end-game", "snake-end-game", "pong-quit"}, env)
 		return true
-	case int('n'):
+	case 'n':
 		if err := rt.callFirst([]string{"tetris-start-game", "snake-start-game", "pong"}, env); err != nil {
 			rt.messages = append(rt.messages, err.Error())
 			rt.warnf("key n handler error: %v", err)
 		}
 		return false
-	case int('p'):
+	case 'p':
 		if err := rt.callFirst([]string{"tetris-pause-game", "snake-pause-game", "pong-pause", "pong-resume"}, env); err != nil {
 			rt.messages = append(rt.messages, err.Error())
 			rt.warnf("key p handler error: %v", err)
 		}
 		return false
-	case int(' '):
+	case ' ':
 		if err := rt.callFirst([]string{"tetris-move-bottom"}, env); err != nil {
 			rt.messages = append(rt.messages, err.Error())
 			rt.warnf("space handler error: %v", err)
@@ -6503,27 +11656,285 @@ func (rt *runtimeState) handleKey(key int, env *golisp.SymbolTableFrame) bool {
 			rt.messages = append(rt.messages, err.Error())
 			rt.warnf("pgup handler error: %v", err)
 		}
-		return false
-	default:
-		return false
+		return false
+	default:
+		return false
+	}
+}
+
+// editText runs the editing key key in buf, the current buffer,
+// reporting whether key is one: typing, deleting, moving, undo and the
+// line-editing keys of editInputLine.
+func (rt *runtimeState) editText(buf *elBuffer, key keyEvent, env *golisp.SymbolTableFrame) bool {
+	if rt.editInputLine(buf, key, env) {
+		return true
+	}
+	switch key {
+	case 31: // C-/ and C-_
+		if _, err := rt.undoImpl(golisp.EmptyCons(), env); err != nil {
+			rt.messages = append(rt.messages, err.Error())
+		}
+	case 127, 8:
+		if buf.point > buf.begv() {
+			buf.deleteText(buf.point-1, buf.point)
+		}
+	case keyLeft:
+		if buf.point > buf.begv() {
+			buf.point--
+		}
+	case keyRight:
+		if buf.point < buf.zv() {
+			buf.point++
+		}
+	default:
+		if key < 32 || key > 126 {
+			return false
+		}
+		_, _ = insertImpl(golisp.ArrayToList([]*golisp.Data{golisp.IntegerWithValue(int64(key))}), nil)
+	}
+	return true
+}
+
+// editInputLine runs the line-editing key key on the player's input
+// in buf, reporting whether key is one.
+func (rt *runtimeState) editInputLine(buf *elBuffer, key keyEvent, env *golisp.SymbolTableFrame) bool {
+	var err error
+	switch key {
+	case 1, keyHome: // C-a goes to the start of the input, then of the line.
+		input := buf.inputMarker().pos
+		bol := buf.point
+		for bol > buf.begv() && buf.text[bol-1] != '\n' {
+			bol--
+		}
+		if input >= bol && input < buf.point {
+			buf.point = input
+		} else {
+			buf.point = bol
+		}
+	case 5, keyEnd: // C-e
+		_, err = endOfLineImpl(golisp.EmptyCons(), env)
+	case keyDel:
+		if buf.point < buf.zv() {
+			buf.deleteText(buf.point, buf.point+1)
+		}
+	case 11: // C-k
+		_, err = rt.killLineImpl(golisp.EmptyCons(), env)
+	case 23: // C-w
+		var start, end int
+		if start, end, err = rt.region(); err == nil {
+			rt.killText(buf, start, end)
+		}
+	case 25: // C-y
+		_, err = rt.yankImpl(golisp.EmptyCons(), env)
+	case keyMeta | 'y':
+		_, err = rt.yankPopImpl(golisp.EmptyCons(), env)
+	case 0: // C-SPC and C-@
+		buf.markMarker().set(buf, buf.point)
+		rt.messages = append(rt.messages, "Mark set")
+	case 9: // TAB
+		err = rt.completeInput(buf, env)
+	case keyUp, keyMeta | 'p':
+		err = rt.stepInputHistory(buf, 1)
+	case keyDown, keyMeta | 'n':
+		err = rt.stepInputHistory(buf, -1)
+	case keyMeta | 'f':
+		_, err = forwardWordImpl(golisp.EmptyCons(), env)
+	case keyMeta | 'b':
+		_, err = backwardWordImpl(golisp.EmptyCons(), env)
+	default:
+		return false
+	}
+	if err != nil {
+		rt.messages = append(rt.messages, err.Error())
+	}
+	return true
+}
+
+// inputCompletionTable returns what the word at index word of the input
+// completes against: dunnet's verbs for the first word and its object
+// names after that. It returns nil when there is nothing to complete.
+func (rt *runtimeState) inputCompletionTable(word int, env *golisp.SymbolTableFrame) *golisp.Data {
+	if rt.gameName != "dunnet" || rt.activeMinibuffer() != nil {
+		return nil
+	}
+	switch mode := featureName(env.ValueOf(golisp.Intern("dungeon-mode"))); {
+	case word > 0 && mode != "dungeon" && mode != "":
+		return nil
+	case word > 0:
+		return env.ValueOf(golisp.Intern("dun-objnames"))
+	case mode == "unix":
+		return env.ValueOf(golisp.Intern("dun-unix-verbs"))
+	case mode == "dos":
+		return env.ValueOf(golisp.Intern("dun-dos-verbs"))
+	}
+	return env.ValueOf(golisp.Intern("dun-verblist"))
+}
+
+// completeInput completes the word before point in the input, as TAB
+// does: it adds what all the candidates share, and a space after the
+// only one; when they still differ, the echo area lists them.
+func (rt *runtimeState) completeInput(buf *elBuffer, env *golisp.SymbolTableFrame) error {
+	if mb := rt.activeMinibuffer(); mb != nil {
+		return rt.completeMinibuffer(mb, env)
+	}
+	start, end := buf.inputBounds()
+	if buf.point < start || buf.point > end {
+		return nil
+	}
+	ws := buf.point
+	for ws > start && buf.text[ws-1] != ' ' && buf.text[ws-1] != '\t' {
+		ws--
+	}
+	table := rt.inputCompletionTable(len(strings.Fields(string(buf.text[start:ws]))), env)
+	if golisp.NilP(table) {
+		return nil
+	}
+	word := string(buf.text[ws:buf.point])
+	names, err := completions(word, table, golisp.EmptyCons(), env)
+	if err != nil {
+		return err
+	}
+	slices.Sort(names)
+	names = slices.Compact(names)
+	r := tryCompletion(word, names, completionIgnoreCase(env))
+	switch {
+	case golisp.NilP(r):
+		return errors.New("No match")
+	case golisp.StringP(r) && golisp.StringValue(r) != word:
+		buf.deleteText(ws, buf.point)
+		buf.insertText(ws, []rune(golisp.StringValue(r)))
+	}
+	if len(names) == 1 {
+		if buf.point == buf.zv() || buf.text[buf.point] != ' ' {
+			buf.insertText(buf.point, []rune{' '})
+		} else {
+			buf.point++
+		}
+		return nil
 	}
+	rt.messages = append(rt.messages, strings.Join(names, " "))
+	return nil
 }
 
+// currentInputLine returns what the player typed: the rest of the line
+// from the input marker, which sits where the game's output ended.
 func (rt *runtimeState) currentInputLine() string {
 	buf := rt.currentBuffer()
-	if buf == nil || len(buf.text) == 0 {
+	if buf == nil {
+		return ""
+	}
+	start, end := buf.inputBounds()
+	return strings.TrimSpace(string(buf.text[start:end]))
+}
+
+// inputBounds returns where the player's input starts and ends.
+func (b *elBuffer) inputBounds() (int, int) {
+	start := b.inputMarker().pos
+	end := start
+	for end < len(b.text) && b.text[end] != '\n' {
+		end++
+	}
+	return start, end
+}
+
+// addInputHistory puts line at the front of buf's input-ring, unless it
+// is blank or the same as the last line, keeping input-ring-size lines.
+func (rt *runtimeState) addInputHistory(buf *elBuffer, line string) {
+	ring := rt.localValue(buf, "input-ring")
+	if !golisp.PairP(ring) {
+		ring = golisp.EmptyCons()
+	}
+	if line == "" || (golisp.NotNilP(ring) && golisp.StringP(golisp.Car(ring)) && golisp.StringValue(golisp.Car(ring)) == line) {
+		return
+	}
+	ring = truncateList(golisp.Cons(golisp.StringWithValue(line), ring), "input-ring-size", 500)
+	rt.setLocalValue(buf, "input-ring", ring)
+}
+
+// stepInputHistory replaces the input with the line n steps back in
+// buf's input-ring, or forward when n is negative, as M-p and M-n do.
+// Forward past the newest line brings back what was being typed.
+func (rt *runtimeState) stepInputHistory(buf *elBuffer, n int) error {
+	start, end := buf.inputBounds()
+	if rt.lastCommand != "history" {
+		rt.historyPos, rt.historyDraft = 0, string(buf.text[start:end])
+	}
+	rt.thisCommand = "history"
+	ring := rt.localValue(buf, "input-ring")
+	pos := rt.historyPos + n
+	switch {
+	case pos > golisp.Length(ring):
+		return errors.New("Beginning of history; no preceding item")
+	case pos < 0:
+		return errors.New("End of history; no next item")
+	}
+	rt.historyPos = pos
+	line := rt.historyDraft
+	if pos > 0 {
+		line = golisp.StringValue(golisp.Nth(ring, pos))
+	}
+	buf.deleteText(start, end)
+	buf.insertText(start, []rune(line))
+	buf.point = start + utf8.RuneCountInString(line)
+	return nil
+}
+
+// inputHistoryFile is where the game's input history is kept between
+// runs, or "" when there is nowhere to keep it.
+func (rt *runtimeState) inputHistoryFile() string {
+	dir := userStateDir()
+	if dir == "" || rt.gameName == "" {
 		return ""
 	}
-	p := min(max(buf.point, 0), len(buf.text))
-	start := p
-	for start > 0 && buf.text[start-1] != '\n' {
-		start--
+	return filepath.Join(dir, "runmacs", "history", rt.gameName)
+}
+
+// loadInputHistory makes buf the buffer whose input history is saved,
+// and fills its input-ring from the last run.
+func (rt *runtimeState) loadInputHistory(buf *elBuffer) {
+	rt.historyBuffer = buf
+	data, err := os.ReadFile(rt.inputHistoryFile())
+	if err != nil {
+		return
+	}
+	ring := golisp.EmptyCons()
+	for line := range strings.SplitSeq(string(data), "\n") {
+		if line != "" {
+			ring = golisp.Cons(golisp.StringWithValue(line), ring)
+		}
+	}
+	rt.setLocalValue(buf, "input-ring", truncateList(ring, "input-ring-size", 500))
+}
+
+// saveInputHistory writes the game buffer's input-ring to the history
+// file, oldest line first. It runs once, as the game exits.
+func (rt *runtimeState) saveInputHistory() {
+	path := rt.inputHistoryFile()
+	if rt.historyBuffer == nil || path == "" {
+		return
+	}
+	var lines []string
+	for c := rt.localValue(rt.historyBuffer, "input-ring"); golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+		if golisp.StringP(golisp.Car(c)) {
+			lines = append(lines, golisp.StringValue(golisp.Car(c)))
+		}
+	}
+	slices.Reverse(lines)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		rt.warnf("input history: %v", err)
+		return
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		rt.warnf("input history: %v", err)
+	}
+}
+
+// markInputStart moves the input marker of the current buffer to point,
+// once the game has answered a line of input.
+func (rt *runtimeState) markInputStart() {
+	if buf := rt.currentBuffer(); buf != nil {
+		buf.inputMarker().set(buf, buf.point)
 	}
-	line := strings.TrimSpace(string(buf.text[start:p]))
-	line = strings.TrimPrefix(line, ">")
-	line = strings.TrimPrefix(line, "$")
-	line = strings.TrimSpace(line)
-	return line
 }
 
 func (rt *runtimeState) handleDunnetEnter(env *golisp.SymbolTableFrame) error {
@@ -6690,7 +12101,7 @@ func (rt *runtimeState) statusFromCurrentKeymap() (string, bool) {
 
 	addBinding := func(key string) {
 		b, ok := km.bindings[key]
-		if !ok {
+		if !ok || prefixKeymap(b, rt.env) != nil {
 			return
 		}
 		fnName, _ := resolveKeyBinding(b, rt.env)
@@ -6726,14 +12137,28 @@ func (rt *runtimeState) statusFromCurrentKeymap() (string, bool) {
 	return strings.Join(tokens, " | "), true
 }
 
-func (rt *runtimeState) draw(c *vt.Canvas) {
+// echoArea returns what the bottom line shows instead of status: the
+// prefix keys of an unfinished key sequence, as "C-c-", or else the
+// latest message.
+func (rt *runtimeState) echoArea(status string) string {
+	switch {
+	case rt.prefixKeys != nil:
+		return strings.Join(rt.prefixKeys, " ") + "-"
+	case len(rt.messages) > 0:
+		return rt.messages[len(rt.messages)-1]
+	}
+	return status
+}
+
+func (rt *runtimeState) draw(c *screen) {
 	c.Clear()
 	w, h := c.Size()
-	if rt.gridWidth == 0 || rt.gridHeight == 0 {
+	if rt.gridWidth == 0 || rt.gridHeight == 0 || rt.showingOtherBuffer() {
 		rt.drawTextBuffer(c, w, h)
 		c.Draw()
 		return
 	}
+	def := rt.face("default")
 	gridH := min(uint(rt.gridHeight), h-1)
 	gridW := min(uint(rt.gridWidth), w)
 	for y := range gridH {
@@ -6750,96 +12175,665 @@ func (rt *runtimeState) draw(c *vt.Canvas) {
 	if kmStatus, ok := rt.statusFromCurrentKeymap(); ok {
 		status = kmStatus
 	}
-	if len(rt.messages) > 0 {
-		status = rt.messages[len(rt.messages)-1]
-	}
+	status = rt.echoArea(status)
 	if len(status) > int(w) {
 		status = status[:w]
 	}
-	if h > 0 {
-		c.WriteString(0, h-1, vt.LightGray, vt.DefaultBackground, status)
+	switch {
+	case h == 0:
+	case rt.activeMinibuffer() != nil:
+		rt.drawMinibuffer(c, h-1, w)
+	default:
+		c.WriteString(0, h-1, def.fg, def.bg, status)
 	}
 	c.Draw()
 }
 
-func (rt *runtimeState) drawTextBuffer(c *vt.Canvas, w, h uint) {
+// displayCell is a character as drawTextBuffer shows it.
+type displayCell struct {
+	r  rune
+	st faceStyle
+}
+
+// layoutText lays buf out in screen rows from start, a line beginning,
+// with overlay strings put in, invisible text left out and faces
+// resolved. It stops after maxRows rows and also returns the row point is
+// on, or -1 when point is not among them.
+func (rt *runtimeState) layoutText(buf *elBuffer, start, maxRows int) ([][]displayCell, int) {
+	rows := [][]displayCell{nil}
+	if buf == nil {
+		return rows, -1
+	}
+	plain := rt.faceStyleFor(golisp.EmptyCons())
+	styles := make(map[*golisp.Data]faceStyle)
+	styleFor := func(face *golisp.Data) faceStyle {
+		if golisp.NilP(face) {
+			return plain
+		}
+		st, ok := styles[face]
+		if !ok {
+			st = rt.faceStyleFor(face)
+			styles[face] = st
+		}
+		return st
+	}
+	put := func(r rune, st faceStyle) {
+		if r == '\n' {
+			rows = append(rows, nil)
+			return
+		}
+		rows[len(rows)-1] = append(rows[len(rows)-1], displayCell{r, st})
+	}
+	// Overlay strings are drawn with their own text properties.
+	putString := func(s *golisp.Data) {
+		if !golisp.StringP(s) {
+			return
+		}
+		props := stringPropsOf(s)
+		for i, r := range []rune(golisp.StringValue(s)) {
+			put(r, styleFor(textFace(propsAt(props, i))))
+		}
+	}
+	// The overlays over a position only change at overlay boundaries, so
+	// those are collected once and the covering set is found again only
+	// when one is crossed.
+	starting := make(map[int][]*elOverlay)
+	ending := make(map[int][]*elOverlay)
+	for _, o := range buf.overlays {
+		starting[o.start] = append(starting[o.start], o)
+		if o.start < o.end {
+			ending[o.end] = append(ending[o.end], o)
+		}
+	}
+	overlays := buf.overlaysAt(start)
+	pointRow := -1
+	text := buf.text[:buf.zv()]
+	for p := start; p <= len(text) && len(rows) <= maxRows; p++ {
+		for _, o := range ending[p] {
+			putString(o.get("after-string"))
+		}
+		for _, o := range starting[p] {
+			putString(o.get("before-string"))
+			putString(o.get("display"))
+			if o.end == p {
+				putString(o.get("after-string"))
+			}
+		}
+		if p != start && (len(starting[p]) > 0 || len(ending[p]) > 0) {
+			overlays = buf.overlaysAt(p)
+		}
+		if p == buf.point {
+			pointRow = len(rows) - 1
+		}
+		if p == len(text) {
+			break
+		}
+		plist := buf.propsAt(p)
+		invisible, _ := plistGet(plist, "invisible")
+		var faces []*golisp.Data
+		hidden, overridden := false, false
+		// The highest priority overlay comes first, as faces merge in order.
+		for i := len(overlays) - 1; i >= 0; i-- {
+			o := overlays[i]
+			if v := o.get("invisible"); golisp.NotNilP(v) && !overridden {
+				invisible, overridden = v, true
+			}
+			// A display string stands in for the text it covers.
+			if golisp.StringP(o.get("display")) {
+				hidden = true
+			}
+			if f := o.get("face"); golisp.NotNilP(f) {
+				faces = append(faces, f)
+			}
+		}
+		if hidden || rt.invisible(invisible) {
+			continue
+		}
+		if len(faces) == 0 {
+			put(text[p], styleFor(textFace(plist)))
+			continue
+		}
+		faces = append(faces, textFace(plist))
+		put(text[p], rt.faceStyleFor(golisp.ArrayToList(faces)))
+	}
+	if len(rows) > maxRows {
+		rows = rows[:maxRows]
+		if pointRow >= maxRows {
+			pointRow = -1
+		}
+	}
+	return rows, pointRow
+}
+
+// lineStart returns the beginning of the line n lines before the one pos
+// is on, stopping at the start of the accessible region.
+func (b *elBuffer) lineStart(pos, n int) int {
+	pos = b.clampPos(pos)
+	for {
+		for pos > b.begv() && b.text[pos-1] != '\n' {
+			pos--
+		}
+		if n == 0 || pos == b.begv() {
+			return pos
+		}
+		pos--
+		n--
+	}
+}
+
+func (rt *runtimeState) drawTextBuffer(c *screen, w, h uint) {
 	if h == 0 {
 		return
 	}
+	def := rt.face("default")
+	win := rt.selectedWindow()
 	buf := rt.currentBuffer()
-	text := ""
+	visible := max(int(h-1), 1)
+	var rows [][]displayCell
 	if buf != nil {
-		text = string(buf.text)
-	}
-	lines := strings.Split(text, "\n")
-	visible := max(int(h-1), 0)
-	start := 0
-	if len(lines) > visible {
-		start = len(lines) - visible
-	}
-	y := uint(0)
-	for i := start; i < len(lines) && y < h-1; i++ {
-		line := lines[i]
-		if len(line) > int(w) {
-			line = line[:w]
+		// The window start stays put while point is in view.
+		start := buf.lineStart(win.start, 0)
+		if buf.point < start {
+			start = buf.lineStart(buf.point, 0)
+		}
+		var pointRow int
+		rows, pointRow = rt.layoutText(buf, start, visible)
+		if pointRow < 0 && buf.point > start {
+			// Point is below the window: put its line on the last row.
+			start = buf.lineStart(buf.point, visible-1)
+			rows, _ = rt.layoutText(buf, start, visible)
+		}
+		win.start = start
+	}
+	for y, row := range rows {
+		if uint(y) >= h-1 {
+			break
+		}
+		for x, cell := range row {
+			if uint(x) >= w {
+				break
+			}
+			c.WriteStyled(uint(x), uint(y), cell.st, cell.r)
 		}
-		c.WriteString(0, y, vt.LightGray, vt.DefaultBackground, line)
-		y++
 	}
 	status := rt.defaultStatusLine()
-	if len(rt.messages) > 0 {
-		status = rt.messages[len(rt.messages)-1]
-	}
+	status = rt.echoArea(status)
 	if len(status) > int(w) {
 		status = status[:w]
 	}
-	c.WriteString(0, h-1, vt.LightGray, vt.DefaultBackground, status)
+	if rt.activeMinibuffer() != nil {
+		rt.drawMinibuffer(c, h-1, w)
+		return
+	}
+	c.WriteString(0, h-1, def.fg, def.bg, status)
 }
 
-func (rt *runtimeState) cellStyle(d *golisp.Data) (rune, vt.AttributeColor, vt.AttributeColor) {
-	bg := vt.DefaultBackground
-	fg := vt.White
-	if golisp.IntegerP(d) {
-		n := golisp.IntegerValue(d)
-		switch rt.gameName {
-		case "snake":
-			switch n {
-			case 0, 4:
-				return ' ', fg, bg
-			case 1:
-				return '█', vt.LightGreen, bg
-			case 2:
-				return '●', vt.LightRed, bg
-			case 3:
-				return '▒', vt.LightGray, bg
-			default:
-				rt.warnOnce(fmt.Sprintf("snake-unknown-cell-%d", n), "unknown snake cell value: %d", n)
+// gridGlyph is how one gamegrid cell value is drawn, resolved once from
+// the game's display options when gamegrid-init runs. The face is shared,
+// so set-face-background on it recolors the cells.
+type gridGlyph struct {
+	r    rune
+	face *elFace
+}
+
+// resolveGridGlyph does for one entry of the display options vector what
+// gamegrid-initialize-display does in Emacs: each of GLYPH-SPECS,
+// FACE-SPECS and COLOR-SPECS is matched against the display mode.
+func (rt *runtimeState) resolveGridGlyph(c int, spec *golisp.Data) gridGlyph {
+	g := gridGlyph{r: ' ', face: rt.face("default")}
+	glyph := rt.matchSpecList(golisp.Car(spec))
+	face := rt.matchSpecList(golisp.Cadr(spec))
+	color := rt.matchSpecList(golisp.Caddr(spec))
+	switch {
+	case golisp.IntegerP(glyph):
+		g.r = rune(golisp.IntegerValue(glyph))
+	case golisp.NilP(glyph) && c >= 32 && c <= 126:
+		// No glyph spec: Emacs shows the character itself, as with score digits.
+		g.r = rune(c)
+	}
+	if !golisp.SymbolP(face) {
+		return g
+	}
+	switch golisp.StringValue(face) {
+	case "color-tty":
+		if golisp.SymbolP(color) {
+			if v, ok := rt.boundValue(color); ok {
+				color = v
 			}
-		default:
-			switch n {
-			case 0, 1, 2, 3, 4, 5, 6:
-				cols := []vt.AttributeColor{vt.Blue, vt.White, vt.Yellow, vt.Magenta, vt.Cyan, vt.Green, vt.Red}
-				return '█', cols[n], bg
-			case 7, 9:
-				return ' ', fg, bg
-			case 8:
-				return '▒', vt.LightGray, bg
-			default:
-				rt.warnOnce(fmt.Sprintf("tetris-unknown-cell-%d", n), "unknown tetris cell value: %d", n)
+		}
+		if !golisp.StringP(color) {
+			rt.warnOnce("grid-color-"+golisp.String(color), "gamegrid color is not a string: %s", golisp.String(color))
+			return g
+		}
+		name := golisp.StringValue(color)
+		// gamegrid-setup-face sets both foreground and background.
+		g.face = rt.face("gamegrid-color-tty-face-" + name)
+		rt.setFaceColor(g.face, false, name)
+		rt.setFaceColor(g.face, true, name)
+	case "mono-tty":
+		g.face = rt.face("gamegrid-mono-tty-face")
+		rt.setFaceColor(g.face, false, "black")
+		rt.setFaceColor(g.face, true, "white")
+	}
+	return g
+}
+
+// matchSpecList returns the value of the first (LOCALE VALUE) pair whose
+// locale is t, the display mode, or a list containing it.
+func (rt *runtimeState) matchSpecList(specs *golisp.Data) *golisp.Data {
+	mode := golisp.StringValue(rt.displayMode)
+	for c := specs; golisp.NotNilP(c) && golisp.PairP(c); c = golisp.Cdr(c) {
+		spec := golisp.Car(c)
+		if golisp.NilP(spec) || !golisp.PairP(spec) {
+			continue
+		}
+		locale, value := golisp.Car(spec), golisp.Cadr(spec)
+		matched := false
+		switch {
+		case golisp.BooleanP(locale):
+			matched = golisp.BooleanValue(locale)
+		case golisp.SymbolP(locale):
+			matched = golisp.StringValue(locale) == mode || golisp.StringValue(locale) == "t"
+		case golisp.PairP(locale):
+			for l := locale; golisp.NotNilP(l) && golisp.PairP(l); l = golisp.Cdr(l) {
+				if golisp.SymbolP(golisp.Car(l)) && golisp.StringValue(golisp.Car(l)) == mode {
+					matched = true
+					break
+				}
 			}
 		}
+		if matched && golisp.NotNilP(value) {
+			return value
+		}
+	}
+	return golisp.EmptyCons()
+}
+
+func (rt *runtimeState) cellStyle(d *golisp.Data) (rune, termColor, termColor) {
+	def := rt.face("default")
+	if golisp.IntegerP(d) {
+		n := golisp.IntegerValue(d)
+		if n >= 0 && n < int64(len(rt.gridGlyphs)) {
+			g := rt.gridGlyphs[n]
+			return g.r, g.face.fg, g.face.bg
+		}
 		if n >= 32 && n <= 126 {
-			return rune(n), vt.LightGray, bg
+			return rune(n), def.fg, def.bg
 		}
+		rt.warnOnce(fmt.Sprintf("unknown-cell-%d", n), "no display options for cell value: %d", n)
+		return ' ', def.fg, def.bg
 	}
 	if golisp.StringP(d) {
 		s := golisp.StringValue(d)
 		if s == "" {
-			return ' ', fg, bg
+			return ' ', def.fg, def.bg
 		}
-		return []rune(s)[0], vt.LightGray, bg
+		return []rune(s)[0], def.fg, def.bg
 	}
 	t := golisp.TypeName(golisp.TypeOf(d))
 	rt.warnOnce("unknown-cell-type-"+t, "unknown cell data type: %s (%s)", t, golisp.String(d))
-	return ' ', fg, bg
+	return ' ', def.fg, def.bg
+}
+
+// colorDepth is how many colors the terminal can show.
+type colorDepth int
+
+const (
+	color16 colorDepth = iota
+	color256
+	colorTrue
+)
+
+// detectColorDepth looks at COLORTERM and TERM first, then at max_colors
+// in the terminal's terminfo entry.
+func detectColorDepth() colorDepth {
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return colorTrue
+	}
+	term := os.Getenv("TERM")
+	switch {
+	case strings.HasSuffix(term, "-direct"), strings.Contains(term, "truecolor"), strings.Contains(term, "24bit"):
+		return colorTrue
+	case strings.Contains(term, "256color"):
+		return color256
+	}
+	n, ok := terminfoColors(term)
+	switch {
+	case !ok:
+		return color16
+	case n >= 1<<24:
+		return colorTrue
+	case n >= 256:
+		return color256
+	}
+	return color16
+}
+
+// terminalColorDepth is detectColorDepth, looked up once.
+var terminalColorDepth = sync.OnceValue(detectColorDepth)
+
+// colors is the number of colors at depth d, as display-color-cells
+// counts them.
+func (d colorDepth) colors() int {
+	switch d {
+	case color256:
+		return 256
+	case colorTrue:
+		return 1 << 24
+	}
+	return 16
+}
+
+// terminfoColors finds the compiled terminfo entry for term in the usual
+// ncurses search order and returns its max_colors.
+func terminfoColors(term string) (int, bool) {
+	if term == "" || strings.ContainsRune(term, '/') {
+		return 0, false
+	}
+	var dirs []string
+	if d := os.Getenv("TERMINFO"); d != "" {
+		dirs = append(dirs, d)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		dirs = append(dirs, filepath.Join(home, ".terminfo"))
+	}
+	for _, d := range filepath.SplitList(os.Getenv("TERMINFO_DIRS")) {
+		if d == "" {
+			d = "/usr/share/terminfo"
+		}
+		dirs = append(dirs, d)
+	}
+	dirs = append(dirs, "/etc/terminfo", "/lib/terminfo", "/usr/share/terminfo")
+	for _, dir := range dirs {
+		// Linux uses the first letter, macOS its hex code.
+		for _, sub := range []string{term[:1], fmt.Sprintf("%x", term[0])} {
+			data, err := os.ReadFile(filepath.Join(dir, sub, term))
+			if err == nil {
+				return parseTerminfoColors(data)
+			}
+		}
+	}
+	return 0, false
+}
+
+// parseTerminfoColors reads max_colors, numeric capability 13, from a
+// compiled terminfo entry in either the legacy or the 32-bit format.
+func parseTerminfoColors(data []byte) (int, bool) {
+	const maxColors = 13
+	if len(data) < 12 {
+		return 0, false
+	}
+	le16 := func(i int) int { return int(binary.LittleEndian.Uint16(data[i:])) }
+	numSize := 2
+	switch le16(0) {
+	case 0o432:
+	case 0o1036:
+		numSize = 4
+	default:
+		return 0, false
+	}
+	namesSize, boolCount, numCount := le16(2), le16(4), le16(6)
+	if numCount <= maxColors {
+		return 0, false
+	}
+	off := 12 + namesSize + boolCount
+	if off%2 == 1 {
+		off++
+	}
+	off += maxColors * numSize
+	if off+numSize > len(data) {
+		return 0, false
+	}
+	n := int(int16(binary.LittleEndian.Uint16(data[off:])))
+	if numSize == 4 {
+		n = int(int32(binary.LittleEndian.Uint32(data[off:])))
+	}
+	return n, n > 0
+}
+
+// termColor is a resolved face color. index is the tty color number for
+// the names Emacs gives to the 16 terminal colors, or -1.
+type termColor struct {
+	r, g, b uint8
+	index   int
+	set     bool
+}
+
+// xtermPalette is the RGB value xterm uses for each of the 16 colors.
+var xtermPalette = [16][3]uint8{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// ttyColorNames are the names tty-color-alist gives colors 0-7; colors
+// 8-15 take a "bright" prefix.
+var ttyColorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+var namedColors = sync.OnceValue(func() map[string]termColor {
+	colors := make(map[string]termColor, 800)
+	for line := range strings.SplitSeq(rgbTxt, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || strings.HasPrefix(line, "!") {
+			continue
+		}
+		r, errR := strconv.ParseUint(fields[0], 10, 8)
+		g, errG := strconv.ParseUint(fields[1], 10, 8)
+		b, errB := strconv.ParseUint(fields[2], 10, 8)
+		if errR != nil || errG != nil || errB != nil {
+			continue
+		}
+		name := strings.ToLower(strings.Join(fields[3:], " "))
+		colors[name] = termColor{r: uint8(r), g: uint8(g), b: uint8(b), index: -1, set: true}
+	}
+	for i, name := range ttyColorNames {
+		c := colors[name]
+		c.index = i
+		colors[name] = c
+		p := xtermPalette[i+8]
+		colors["bright"+name] = termColor{r: p[0], g: p[1], b: p[2], index: i + 8, set: true}
+	}
+	return colors
+})
+
+// lookupColor resolves an Emacs color: an rgb.txt or tty color name, or
+// #RGB with 1 to 4 hex digits per component. "" and the unspecified-*
+// names mean the terminal default.
+func lookupColor(name string) (termColor, bool) {
+	switch name {
+	case "", "unspecified-fg", "unspecified-bg":
+		return termColor{index: -1}, true
+	}
+	if hex, ok := strings.CutPrefix(name, "#"); ok {
+		n := len(hex) / 3
+		if n == 0 || n > 4 || len(hex)%3 != 0 {
+			return termColor{}, false
+		}
+		var rgb [3]uint8
+		for i := range rgb {
+			v, err := strconv.ParseUint(hex[i*n:(i+1)*n], 16, 16)
+			if err != nil {
+				return termColor{}, false
+			}
+			// Scale to 8 bits: "#f00" and "#ffff00000000" are both red.
+			rgb[i] = uint8(v * 255 / (1<<(4*n) - 1))
+		}
+		return termColor{r: rgb[0], g: rgb[1], b: rgb[2], index: -1, set: true}, true
+	}
+	c, ok := namedColors()[strings.ToLower(name)]
+	if !ok {
+		c, ok = namedColors()[strings.ToLower(strings.ReplaceAll(name, " ", ""))]
+	}
+	return c, ok
+}
+
+func colorDistance(a [3]uint8, c termColor) int {
+	dr, dg, db := int(a[0])-int(c.r), int(a[1])-int(c.g), int(a[2])-int(c.b)
+	return dr*dr + dg*dg + db*db
+}
+
+func (c termColor) nearest16() int {
+	best, bestDist := 0, math.MaxInt
+	for i, p := range xtermPalette {
+		if d := colorDistance(p, c); d < bestDist {
+			best, bestDist = i, d
+		}
+	}
+	return best
+}
+
+// nearest256 picks from the 6x6x6 cube and the gray ramp of the 256-color
+// palette.
+func (c termColor) nearest256() int {
+	levels := [6]int{0, 95, 135, 175, 215, 255}
+	step := func(v uint8) int {
+		best := 0
+		for i, l := range levels {
+			if abs(int(v)-l) < abs(int(v)-levels[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+	ri, gi, bi := step(c.r), step(c.g), step(c.b)
+	cube := [3]uint8{uint8(levels[ri]), uint8(levels[gi]), uint8(levels[bi])}
+	best, bestDist := 16+36*ri+6*gi+bi, colorDistance(cube, c)
+	for i := range 24 {
+		v := uint8(8 + 10*i)
+		if d := colorDistance([3]uint8{v, v, v}, c); d < bestDist {
+			best, bestDist = 232+i, d
+		}
+	}
+	return best
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// sgr returns the SGR parameters selecting c at the given depth. The tty
+// color names keep their palette number below truecolor, as in Emacs.
+func (c termColor) sgr(depth colorDepth, background bool) string {
+	base := 30
+	if background {
+		base = 40
+	}
+	if !c.set {
+		return strconv.Itoa(base + 9)
+	}
+	if depth == colorTrue {
+		return fmt.Sprintf("%d;2;%d;%d;%d", base+8, c.r, c.g, c.b)
+	}
+	i := c.index
+	if i < 0 && depth == color256 {
+		return fmt.Sprintf("%d;5;%d", base+8, c.nearest256())
+	}
+	if i < 0 {
+		i = c.nearest16()
+	}
+	if i < 8 {
+		return strconv.Itoa(base + i)
+	}
+	return strconv.Itoa(base + 60 + i - 8)
+}
+
+// sgr returns the SGR parameters that select st, starting from a reset.
+func (st faceStyle) sgr(depth colorDepth) string {
+	params := []string{"0"}
+	if st.bold {
+		params = append(params, "1")
+	}
+	if st.underline {
+		params = append(params, "4")
+	}
+	if st.inverse {
+		params = append(params, "7")
+	}
+	params = append(params, st.fg.sgr(depth, false), st.bg.sgr(depth, true))
+	return strings.Join(params, ";")
+}
+
+type screenCell struct {
+	r  rune
+	st faceStyle
+}
+
+// screen is a cell grid written to the terminal with escape sequences
+// chosen for its color depth; vt's canvas only knows the 16 colors.
+type screen struct {
+	w, h  uint
+	depth colorDepth
+	cells []screenCell
+	shown []screenCell
+	out   io.Writer
+}
+
+func newScreen(w, h uint, depth colorDepth, out io.Writer) *screen {
+	return &screen{w: w, h: h, depth: depth, cells: make([]screenCell, w*h), out: out}
+}
+
+func (s *screen) Size() (uint, uint) {
+	return s.w, s.h
+}
+
+func (s *screen) Clear() {
+	clear(s.cells)
+}
+
+func (s *screen) WriteRune(x, y uint, fg, bg termColor, r rune) {
+	s.WriteStyled(x, y, faceStyle{fg: fg, bg: bg}, r)
+}
+
+func (s *screen) WriteStyled(x, y uint, st faceStyle, r rune) {
+	if x >= s.w || y >= s.h {
+		return
+	}
+	s.cells[y*s.w+x] = screenCell{r: r, st: st}
+}
+
+func (s *screen) WriteString(x, y uint, fg, bg termColor, str string) {
+	for _, r := range str {
+		s.WriteRune(x, y, fg, bg, r)
+		x++
+	}
+}
+
+// Draw rewrites the rows that changed since the last call. The bottom
+// right cell is left alone so the terminal never scrolls.
+func (s *screen) Draw() {
+	var sb strings.Builder
+	for y := range s.h {
+		row := s.cells[y*s.w : (y+1)*s.w]
+		if s.shown != nil && slices.Equal(row, s.shown[y*s.w:(y+1)*s.w]) {
+			continue
+		}
+		fmt.Fprintf(&sb, "\x1b[%d;1H", y+1)
+		var last *screenCell
+		for x := range row {
+			if y == s.h-1 && uint(x) == s.w-1 {
+				break
+			}
+			c := &row[x]
+			if last == nil || last.st != c.st {
+				sb.WriteString("\x1b[" + c.st.sgr(s.depth) + "m")
+			}
+			last = c
+			if c.r == 0 {
+				sb.WriteByte(' ')
+			} else {
+				sb.WriteRune(c.r)
+			}
+		}
+	}
+	if sb.Len() == 0 {
+		return
+	}
+	sb.WriteString("\x1b[0m")
+	io.WriteString(s.out, sb.String())
+	s.shown = slices.Clone(s.cells)
 }
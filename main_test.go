@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/steelseries/golisp"
+)
+
+func TestFormsComplete(t *testing.T) {
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"", true},
+		{"foo", true},
+		{"(+ 1 2)", true},
+		{"(+ 1 (* 2 3)", false},
+		{"[1 2", false},
+		{"(vector [1 2] 3)", true},
+		{`(message "(")`, true},
+		{`(message "a \" (")`, true},
+		{`(message "abc`, false},
+		{"(list ?( ?\\))", true},
+		{"(foo) ; (unclosed", true},
+		{"(foo ; )\n", false},
+		{"(foo))", true},
+	}
+	for _, tt := range tests {
+		if got := formsComplete(tt.src); got != tt.want {
+			t.Errorf("formsComplete(%q) = %v; want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func newTestRuntime(t *testing.T) *runtimeState {
+	t.Helper()
+	rt := &runtimeState{
+		grid:            make(map[[2]int]*golisp.Data),
+		gridDefault:     golisp.EmptyCons(),
+		displayMode:     golisp.Intern("color-tty"),
+		loadingFeatures: make(map[string]bool),
+		symbolProps:     make(map[string]map[string]*golisp.Data),
+		timers:          make(map[string]*elTimer),
+		buffers:         make(map[string]*elBuffer),
+		windows:         make(map[int]*elWindow),
+		nextWindowID:    1,
+		menus:           make(map[string]*golisp.Data),
+		warned:          make(map[string]bool),
+		funcByName:      make(map[string]*golisp.Data),
+		errorParents:    map[string]string{"error": "", "quit": "error"},
+		env:             golisp.Global,
+	}
+	rtGlobal = rt
+	rt.ensureInitialWindowAndBuffer()
+	installElispCompat(rt)
+	return rt
+}
+
+// evalForTest evaluates src in rt and returns the printed value.
+func evalForTest(t *testing.T, rt *runtimeState, src string) string {
+	t.Helper()
+	v, err := rt.evalString(src, rt.env)
+	if err != nil {
+		t.Fatalf("%s: %v", src, err)
+	}
+	return prin1String(v)
+}
+
+type evalStep struct {
+	src  string
+	want string
+}
+
+// runEvalSteps evaluates each step in a fresh buffer called name.
+func runEvalSteps(t *testing.T, rt *runtimeState, name string, steps []evalStep) {
+	t.Helper()
+	for _, s := range steps {
+		src := fmt.Sprintf("(with-current-buffer (get-buffer-create %q) %s)", name, s.src)
+		if got := evalForTest(t, rt, src); got != s.want {
+			t.Errorf("%s = %s; want %s", s.src, got, s.want)
+		}
+	}
+}
+
+func TestMarkerAdjustment(t *testing.T) {
+	rt := newTestRuntime(t)
+	runEvalSteps(t, rt, "markers", []evalStep{
+		{`(insert "hello world")`, "nil"},
+		{`(progn (setq m-before (copy-marker 7) m-after (copy-marker 7 t) m-later (copy-marker 9)) nil)`, "nil"},
+		// Text inserted at a marker goes after it unless it advances.
+		{`(progn (goto-char 7) (insert "big "))`, "nil"},
+		{`(list (marker-position m-before) (marker-position m-after) (marker-position m-later))`, "(7 11 13)"},
+		{`(progn (goto-char 1) (insert ">") (marker-position m-later))`, "14"},
+		// Deleting around a marker leaves it where the text was.
+		{`(progn (delete-region 6 14) (list (marker-position m-before) (marker-position m-after) (marker-position m-later)))`, "(6 6 6)"},
+		{`(buffer-substring (point-min) (point-max))`, `">hellrld"`},
+		{`(progn (set-marker m-before nil) (marker-position m-before))`, "nil"},
+		{`(progn (set-marker m-after 3) (goto-char 2) (insert "ab") (marker-position m-after))`, "5"},
+	})
+}
+
+func TestNarrowing(t *testing.T) {
+	rt := newTestRuntime(t)
+	runEvalSteps(t, rt, "narrowing", []evalStep{
+		{`(insert "one two three")`, "nil"},
+		{`(progn (narrow-to-region 5 8) (list (point-min) (point-max) (buffer-narrowed-p)))`, "(5 8 t)"},
+		{`(buffer-substring (point-min) (point-max))`, `"two"`},
+		{`(goto-char 1)`, "5"},
+		{`(progn (goto-char (point-max)) (insert "s") (list (point-min) (point-max)))`, "(5 9)"},
+		// save-restriction puts the narrowing back, however the body changed it.
+		{`(save-restriction (widen) (narrow-to-region 1 4) (list (point-min) (point-max)))`, "(1 4)"},
+		{`(list (point-min) (point-max))`, "(5 9)"},
+		{`(save-restriction (widen) (buffer-substring (point-min) (point-max)))`, `"one twos three"`},
+		{`(progn (widen) (list (point-min) (point-max) (buffer-narrowed-p)))`, "(1 15 nil)"},
+	})
+}
+
+func TestUndoRoundTrip(t *testing.T) {
+	rt := newTestRuntime(t)
+	buf := rt.ensureBuffer("undo-test")
+	rt.setCurrentBuffer(buf)
+	steps := []struct {
+		change func()
+		want   string
+	}{
+		{func() { buf.insertText(0, []rune("hello world")) }, "hello world"},
+		{func() { buf.deleteText(2, 4) }, "heo world"},
+		{func() { buf.insertText(0, []rune(">> ")) }, ">> heo world"},
+		{func() { buf.deleteText(3, len(buf.text)) }, ">> "},
+		{func() { buf.insertText(3, []rune("bye")) }, ">> bye"},
+	}
+	for _, s := range steps {
+		s.change()
+		rt.undoBoundary(buf)
+		if got := string(buf.text); got != s.want {
+			t.Fatalf("text = %q; want %q", got, s.want)
+		}
+	}
+	// Past the boundary the last step left.
+	l := golisp.Cdr(rt.undoListOf(buf))
+	for i := len(steps) - 1; i >= 0; i-- {
+		want := ""
+		if i > 0 {
+			want = steps[i-1].want
+		}
+		var err error
+		if l, err = rt.primitiveUndo(1, l); err != nil {
+			t.Fatalf("undoing %q: %v", steps[i].want, err)
+		}
+		rt.undoBoundary(buf)
+		if got := string(buf.text); got != want {
+			t.Errorf("undoing %q gave %q; want %q", steps[i].want, got, want)
+		}
+	}
+	// The undoing was recorded too, so it can be undone in turn.
+	if _, err := rt.primitiveUndo(1, golisp.Cdr(rt.undoListOf(buf))); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf.text); got != "hello world" {
+		t.Errorf("undoing the undo gave %q; want %q", got, "hello world")
+	}
+}
+
+func TestLetBindsUndoList(t *testing.T) {
+	rt := newTestRuntime(t)
+	buf := rt.ensureBuffer("undo-let")
+	rt.setCurrentBuffer(buf)
+	evalForTest(t, rt, `(let ((buffer-undo-list t)) (insert "secret"))`)
+	if l := rt.undoListOf(buf); golisp.NotNilP(l) {
+		t.Errorf("insert with buffer-undo-list bound to t recorded %s", prin1String(l))
+	}
+	evalForTest(t, rt, `(let* ((buffer-undo-list t)) (insert " more"))`)
+	evalForTest(t, rt, `(insert "!")`)
+	if got, want := prin1String(rt.undoListOf(buf)), "((12 . 13))"; got != want {
+		t.Errorf("buffer-undo-list = %s; want %s", got, want)
+	}
+}
+
+func TestKillRing(t *testing.T) {
+	rt := newTestRuntime(t)
+	steps := []evalStep{
+		{`(progn (insert "one\ntwo\nthree\n") (goto-char 1))`, "1"},
+		// Consecutive kill-line commands add up to one kill.
+		{`(kill-line)`, "nil"},
+		{`(kill-line)`, "nil"},
+		{`(current-kill 0)`, "\"one\n\""},
+		{`(kill-line)`, "nil"},
+		{`(list (current-kill 0) (current-kill 1))`, "(\"two\" \"one\n\")"},
+		{`(progn (kill-new "x") (kill-append "y" nil) (kill-append "w" t) (current-kill 0))`, `"wxy"`},
+		{`(progn (goto-char (point-max)) (yank) (buffer-substring (point-min) (point-max)))`, "\"\nthree\nwxy\""},
+		{`(progn (yank-pop) (buffer-substring (point-min) (point-max)))`, "\"\nthree\ntwo\""},
+		{`(progn (yank-pop) (buffer-substring (point-min) (point-max)))`, "\"\nthree\none\n\""},
+		{`(point)`, "12"},
+		{`(condition-case nil (yank-pop) (error 'refused))`, "refused"},
+	}
+	for _, s := range steps {
+		rt.beginCommand()
+		src := fmt.Sprintf("(with-current-buffer (get-buffer-create %q) %s)", "kills", s.src)
+		if got := evalForTest(t, rt, src); got != s.want {
+			t.Errorf("%s = %s; want %s", s.src, got, s.want)
+		}
+	}
+}
+
+func TestInputHistory(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	rt := newTestRuntime(t)
+	rt.gameName = "history-test"
+	buf := rt.ensureBuffer("history")
+	rt.setCurrentBuffer(buf)
+	rt.loadInputHistory(buf)
+	for _, line := range []string{"look", "go north", "go north", ""} {
+		rt.addInputHistory(buf, line)
+	}
+	buf.insertText(0, []rune("> "))
+	buf.inputMarker().pos = 2
+	buf.insertText(2, []rune("inv"))
+	steps := []struct {
+		n       int
+		want    string
+		wantErr bool
+	}{
+		{1, "go north", false},
+		{1, "look", false},
+		{1, "look", true},
+		{-1, "go north", false},
+		{-1, "inv", false},
+		{-1, "inv", true},
+	}
+	for _, s := range steps {
+		rt.beginCommand()
+		err := rt.stepInputHistory(buf, s.n)
+		if (err != nil) != s.wantErr {
+			t.Errorf("stepping %d to %q: error %v", s.n, s.want, err)
+		}
+		rt.thisCommand = "history"
+		if got := string(buf.text[2:]); got != s.want {
+			t.Errorf("stepping %d gave %q; want %q", s.n, got, s.want)
+		}
+	}
+
+	rt.saveInputHistory()
+	data, err := os.ReadFile(rt.inputHistoryFile())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "look\ngo north\n"; got != want {
+		t.Errorf("history file = %q; want %q", got, want)
+	}
+	next := rt.ensureBuffer("history-2")
+	rt.loadInputHistory(next)
+	if got, want := prin1String(rt.localValue(next, "input-ring")), `("go north" "look")`; got != want {
+		t.Errorf("loaded input-ring = %s; want %s", got, want)
+	}
+}
+
+func TestTryCompletion(t *testing.T) {
+	tests := []struct {
+		s     string
+		names []string
+		fold  bool
+		want  string
+	}{
+		{"x", nil, false, "nil"},
+		{"foo", []string{"foo"}, false, "t"},
+		{"fo", []string{"foo"}, false, `"foo"`},
+		{"f", []string{"foobar", "foobaz"}, false, `"fooba"`},
+		{"f", []string{"foo", "bar"}, false, `""`},
+		{"f", []string{"Foo", "foo"}, false, `""`},
+		{"f", []string{"Foo", "foo"}, true, `"Foo"`},
+		{"FOO", []string{"foo"}, true, "t"},
+		{"ä", []string{"Ärger", "ärgern"}, true, `"Ärger"`},
+		{"é", []string{"éa", "éb"}, false, `"é"`},
+	}
+	for _, tt := range tests {
+		if got := prin1String(tryCompletion(tt.s, tt.names, tt.fold)); got != tt.want {
+			t.Errorf("tryCompletion(%q, %q, %v) = %s; want %s", tt.s, tt.names, tt.fold, got, tt.want)
+		}
+	}
+}
+
+func TestNestedSignals(t *testing.T) {
+	rt := newTestRuntime(t)
+	evalForTest(t, rt, `(define-error 'nested-test "Nested test")`)
+	tests := []evalStep{
+		// Errors caught during cleanup leave the one being unwound alone.
+		{`(condition-case e
+		    (unwind-protect (signal 'nested-test '(1))
+		      (ignore-errors (signal 'error '(2))))
+		  (nested-test (list 'ok e))
+		  (error 'wrong))`, "(ok (nested-test (1)))"},
+		{`(condition-case e
+		    (unwind-protect (signal 'nested-test '(1))
+		      (condition-case nil (signal 'error '(2)) (error nil)))
+		  (nested-test (list 'ok e)))`, "(ok (nested-test (1)))"},
+		{`(catch 'outer (unwind-protect (throw 'outer 'thrown) (catch 'inner (throw 'inner 1))))`, "thrown"},
+		{`(condition-case e (signal 'nested-test '(3)) (error (list 'parent e)))`, "(parent (nested-test (3)))"},
+	}
+	for _, tt := range tests {
+		if got := evalForTest(t, rt, tt.src); got != tt.want {
+			t.Errorf("%s = %s; want %s", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestRequireMatch(t *testing.T) {
+	rt := newTestRuntime(t)
+	directions := golisp.ArrayToList([]*golisp.Data{
+		golisp.StringWithValue("north"),
+		golisp.StringWithValue("northeast"),
+		golisp.StringWithValue("south"),
+	})
+	tests := []struct {
+		require   string
+		input     string
+		confirmed bool
+		exit      bool
+		wantInput string
+		wantNote  string
+	}{
+		{"nil", "up", false, true, "up", ""},
+		{"t", "", false, true, "", ""},
+		{"t", "south", false, true, "south", ""},
+		{"t", "so", false, true, "south", ""},
+		{"t", "nor", false, true, "north", ""},
+		{"t", "up", false, false, "up", "[No match]"},
+		{"confirm", "up", false, false, "up", "[Confirm]"},
+		{"confirm", "up", true, true, "up", ""},
+	}
+	for _, tt := range tests {
+		mb := rt.newMinibuffer("Go: ", tt.input, golisp.EmptyCons())
+		mb.table = &completionTable{collection: directions, pred: golisp.EmptyCons(), requireMatch: golisp.Intern(tt.require)}
+		if tt.require == "nil" {
+			mb.table.requireMatch = golisp.EmptyCons()
+		}
+		exit := rt.minibufferCanExit(mb, tt.confirmed, rt.env)
+		if exit != tt.exit || string(mb.buf.text) != tt.wantInput || mb.note != tt.wantNote {
+			t.Errorf("require-match %s with %q: exit %v, input %q, note %q; want %v, %q, %q",
+				tt.require, tt.input, exit, mb.buf.text, mb.note, tt.exit, tt.wantInput, tt.wantNote)
+		}
+	}
+}
+
+func TestKbdEvents(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"a", "(97)"},
+		{"abc", "(97 98 99)"},
+		{"C-x a", "(24 97)"},
+		{"C-x C-f", "(24 6)"},
+		{"RET SPC TAB ESC DEL", "(13 32 9 27 127)"},
+		{"C-?", "(127)"},
+		{"C-@", "(0)"},
+		{"M-x", "(134217848)"},
+		{"C-M-x", "(134217752)"},
+		{"C-S-a", "(33554433)"},
+		{"s-a", "(8388705)"},
+		{"<f5>", "(f5)"},
+		{"C-<right>", "(C-right)"},
+		{"C-x <up>", "(24 up)"},
+	}
+	for _, tt := range tests {
+		if got := prin1String(golisp.ArrayToList(kbdEvents(tt.in))); got != tt.want {
+			t.Errorf("kbdEvents(%q) = %s; want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestParseTTYKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+		n    int
+	}{
+		{"a", "a", 1},
+		{"\x01", "C-a", 1},
+		{"\x7f", "DEL", 1},
+		{"é", "é", 2},
+		{"\x1bx", "M-x", 2},
+		{"\x1b\x1b", "ESC", 1},
+		{"\x1b\x1bx", "ESC", 1},
+		{"\x1b\x1b[A", "M-<up>", 4},
+		{"\x1b[A", "<up>", 3},
+		{"\x1bOC", "<right>", 3},
+		{"\x1bOP", "<f1>", 3},
+		{"\x1b[Z", "<backtab>", 3},
+		{"\x1b[1;2A", "S-<up>", 6},
+		{"\x1b[1;3D", "M-<left>", 6},
+		{"\x1b[1;5C", "C-<right>", 6},
+		{"\x1b[1;6C", "C-S-<right>", 6},
+		{"\x1b[3~", "<delete>", 4},
+		{"\x1b[5;5~", "C-<prior>", 6},
+		{"\x1b[15~", "<f5>", 5},
+		{"\x1b[24;2~", "S-<f12>", 7},
+		// The Linux console sends F1 to F5 as ESC [ [ A to E.
+		{"\x1b[[A", "<f1>", 4},
+		{"\x1b[[E", "<f5>", 4},
+		{"\x1b[97u", "a", 5},
+		{"\x1b[97;5u", "C-a", 7},
+		{"\x1b[97;6u", "C-S-a", 7},
+		{"\x1b[97;3u", "M-a", 7},
+		{"\x1b[97;2u", "A", 7},
+		{"\x1b[63;5u", "DEL", 7},
+	}
+	for _, tt := range tests {
+		k, n := parseTTYKey(tt.in)
+		if k.String() != tt.want || n != tt.n {
+			t.Errorf("parseTTYKey(%q) = %s, %d; want %s, %d", tt.in, k, n, tt.want, tt.n)
+		}
+	}
+}
+
+func TestParseTTYKeyIncomplete(t *testing.T) {
+	for _, in := range []string{"\x1b", "\x1b[", "\x1b[1;5", "\x1b[[", "\x1bO"} {
+		if _, n := parseTTYKey(in); n != 0 {
+			t.Errorf("parseTTYKey(%q) took %d bytes of an unfinished sequence", in, n)
+		}
+	}
+	keys, rest := parseTTYKeyStream("ab\x1b[1;")
+	if len(keys) != 2 || keys[0] != 'a' || keys[1] != 'b' || rest != "\x1b[1;" {
+		t.Errorf("parseTTYKeyStream = %v, %q; want [a b], %q", keys, rest, "\x1b[1;")
+	}
+}
+
+func TestParseCSIKeyIgnoresUnknown(t *testing.T) {
+	tests := []struct {
+		in string
+		n  int
+	}{
+		{"\x1b[99~", 5},
+		{"\x1b[1;5X", 6},
+		{"\x1b[[Z", 4},
+	}
+	for _, tt := range tests {
+		if k, n := parseCSIKey(tt.in); k != -1 || n != tt.n {
+			t.Errorf("parseCSIKey(%q) = %d, %d; want -1, %d", tt.in, k, n, tt.n)
+		}
+	}
+}
+
+func TestKeyEventString(t *testing.T) {
+	tests := []struct {
+		k    keyEvent
+		want string
+	}{
+		{'x', "x"},
+		{0, "C-@"},
+		{9, "TAB"},
+		{13, "RET"},
+		{24, "C-x"},
+		{27, "ESC"},
+		{28, "C-\\"},
+		{' ', "SPC"},
+		{127, "DEL"},
+		{keyMeta | 'x', "M-x"},
+		{keyMeta | 24, "C-M-x"},
+		{keyShift | 1, "C-S-a"},
+		{keyF1 + 4, "<f5>"},
+		{keyPgDn, "<next>"},
+		{keyControl | keyRight, "C-<right>"},
+		{keySuper | keyMeta | keyUp, "M-s-<up>"},
+	}
+	for _, tt := range tests {
+		if got := tt.k.String(); got != tt.want {
+			t.Errorf("keyEvent(%d).String() = %q; want %q", tt.k, got, tt.want)
+		}
+	}
+}